@@ -0,0 +1,220 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	authTimeLen  = 8                // timestamp length of signed message
+	authSeqLen   = 8                // sequence number length of signed session message
+	authMacLen   = sha256.Size      // mac length of signed message
+	authNonceLen = 8                // nonce length of session hello and welcome
+	authSkewMax  = 30 * time.Second // max clock difference between brokers
+)
+
+// messageAuth sign and verify session messages, kind tells message types apart
+type messageAuth interface {
+	sign(kind byte, payload []byte) []byte
+	verify(kind byte, data []byte) ([]byte, error)
+}
+
+// federationAuth sign and verify federation messages with network shared secret,
+// and check if broker address is allowed to join network.
+// empty secret sends and accepts unsigned messages, empty allow list allows all
+type federationAuth struct {
+	secret []byte
+	allow  []*net.IPNet
+}
+
+// newFederationAuth new federationAuth, allow is list of IP or CIDR
+func newFederationAuth(secret string, allow []string) (*federationAuth, error) {
+	a := &federationAuth{secret: []byte(secret)}
+
+	for _, s := range allow {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid allowed address " + s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, ipNet)
+	}
+
+	return a, nil
+}
+
+// allowed check if broker at addr (host:port or host) may join network
+func (a *federationAuth) allowed(addr string) bool {
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+		ip = ips[0]
+	}
+
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign append timestamp and mac to payload, kind tells request from response
+//
+//	+---------+-----------+--------------------+
+//	| payload | timestamp | hmac-sha256        |
+//	|         |    64     | 256                |
+//	+---------+-----------+--------------------+
+func (a *federationAuth) sign(kind byte, payload []byte) []byte {
+	if len(a.secret) == 0 {
+		return payload
+	}
+
+	now := uint64(time.Now().Unix())
+	data := append(payload[:len(payload):len(payload)],
+		byte(now>>56), byte(now>>48), byte(now>>40), byte(now>>32), byte(now>>24), byte(now>>16), byte(now>>8), byte(now))
+
+	return append(data, a.mac(kind, data)...)
+}
+
+// verify check timestamp and mac of signed data, return payload
+func (a *federationAuth) verify(kind byte, data []byte) ([]byte, error) {
+	if len(a.secret) == 0 {
+		return data, nil
+	}
+
+	if len(data) < authTimeLen+authMacLen {
+		return nil, errors.New("message not signed")
+	}
+	signed, mac := data[:len(data)-authMacLen], data[len(data)-authMacLen:]
+	if !hmac.Equal(mac, a.mac(kind, signed)) {
+		return nil, errors.New("message signature mismatch")
+	}
+
+	var ts uint64
+	for _, b := range signed[len(signed)-authTimeLen:] {
+		ts = ts<<8 | uint64(b)
+	}
+	skew := time.Since(time.Unix(int64(ts), 0))
+	if skew > authSkewMax || skew < -authSkewMax {
+		return nil, errors.New("message expired")
+	}
+
+	return signed[:len(signed)-authTimeLen], nil
+}
+
+func (a *federationAuth) mac(kind byte, data []byte) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte{kind})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// newAuthNonce random nonce of session hello or welcome
+func newAuthNonce() []byte {
+	buf := make([]byte, authNonceLen)
+	_, _ = rand.Read(buf)
+	return buf
+}
+
+// sessionAuth sign and verify messages after hello and welcome of one broker session,
+// mac binds nonces of hello and welcome, direction and sequence number,
+// so messages can not be replayed in another session, sent back or sent again.
+// sign and verify may run in different goroutines, but each of them not concurrently
+type sessionAuth struct {
+	auth     *federationAuth
+	nonce    []byte // nonce of hello then nonce of welcome
+	opener   bool   // this broker sent hello
+	sent     uint64 // sequence number of last signed message
+	received uint64 // sequence number of last verified message
+}
+
+// newSessionAuth new sessionAuth of session with nonces of hello and welcome
+func newSessionAuth(auth *federationAuth, hello, welcome []byte, opener bool) *sessionAuth {
+	return &sessionAuth{
+		auth:   auth,
+		nonce:  append(append([]byte{}, hello...), welcome...),
+		opener: opener,
+	}
+}
+
+// sign append sequence number and mac to payload
+//
+//	+---------+-----------+--------------------+
+//	| payload | sequence  | hmac-sha256        |
+//	|         |    64     | 256                |
+//	+---------+-----------+--------------------+
+func (s *sessionAuth) sign(kind byte, payload []byte) []byte {
+	if len(s.auth.secret) == 0 {
+		return payload
+	}
+
+	s.sent++
+	data := append(payload[:len(payload):len(payload)], make([]byte, authSeqLen)...)
+	binary.BigEndian.PutUint64(data[len(payload):], s.sent)
+
+	return append(data, s.mac(kind, s.opener, data)...)
+}
+
+// verify check sequence number and mac of signed data, return payload
+func (s *sessionAuth) verify(kind byte, data []byte) ([]byte, error) {
+	if len(s.auth.secret) == 0 {
+		return data, nil
+	}
+
+	if len(data) < authSeqLen+authMacLen {
+		return nil, errors.New("message not signed")
+	}
+	signed, mac := data[:len(data)-authMacLen], data[len(data)-authMacLen:]
+	if !hmac.Equal(mac, s.mac(kind, !s.opener, signed)) {
+		return nil, errors.New("message signature mismatch")
+	}
+
+	seq := binary.BigEndian.Uint64(signed[len(signed)-authSeqLen:])
+	if seq != s.received+1 {
+		return nil, errors.New("message replayed or lost")
+	}
+	s.received = seq
+
+	return signed[:len(signed)-authSeqLen], nil
+}
+
+func (s *sessionAuth) mac(kind byte, opener bool, data []byte) []byte {
+	direction := byte(0)
+	if opener {
+		direction = 1
+	}
+
+	h := hmac.New(sha256.New, s.auth.secret)
+	h.Write([]byte{kind, direction})
+	h.Write(s.nonce)
+	h.Write(data)
+	return h.Sum(nil)
+}
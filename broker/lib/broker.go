@@ -1,11 +1,11 @@
 package broker
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"net"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/weilinfox/youmu-thlink/utils"
@@ -18,24 +18,28 @@ var logger = logrus.WithField("broker", "internal")
 
 var peers = make(map[int]int)
 
-func Main(listenAddr string, upperAddr string) {
+// Federation how broker joins thlink network
+type Federation struct {
+	Seeds     []string // seed broker addresses
+	Advertise string   // public address host:port of this broker, empty to use address other brokers see
+	Secret    string   // network shared secret signing federation messages, empty for unsigned
+	Allow     []string // IP or CIDR of brokers allowed to join, empty allows all
 
-	var upperAddress string // upper
-	var upperStatus = 0     // upper broker 0 health, >0 retry times
-	var selfPort int        // self port
-	var newBrokers sync.Map // 1 jump string=>time.Time
-	var netBrokers sync.Map // >1 jump string=>time.Time
+	Meta utils.BrokerMeta // metadata shown in network discovery, load, transports and version are filled by broker
+}
+
+// Main start broker listening listenAddr, join thlink network as federation says
+func Main(listenAddr string, federation Federation) {
 
 	_, slistenPort, err := net.SplitHostPort(listenAddr)
 	if err != nil {
 		logger.WithError(err).Fatal("Address split error")
 	}
 	listenPort64, err := strconv.ParseInt(slistenPort, 10, 32)
-	selfPort = int(listenPort64)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		logger.WithError(err).Fatal("Address port parse error")
 	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		logger.WithError(err).Fatal("Address resolve error")
 	}
@@ -48,161 +52,73 @@ func Main(listenAddr string, upperAddr string) {
 	}
 	defer listener.Close()
 
-	// net data syncing
-	// TODO: make it more efficient
-	go func() {
-
-		for {
-			// tell upper broker
-			if upperAddr != "" {
-
-				tcpConn, err := net.DialTimeout("tcp", upperAddr, time.Second)
-
-				if err != nil {
-
-					if upperAddress == "" {
-						logger.WithError(err).Fatal("Upper broker connect error")
-					} else {
-						upperStatus++
-						logger.WithError(err).WithField("retry", upperStatus).Error("Upper broker connect error")
-					}
-
-				} else {
-
-					// logger.Debug("Ping upper addr")
-					_, err = tcpConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, []byte{byte(selfPort >> 8), byte(selfPort)}))
-					if err != nil {
-						if upperAddress == "" {
-							logger.WithError(err).Fatal("Send NET_INFO_UPDATE to upper broker error")
-						} else {
-							upperStatus++
-							logger.WithError(err).WithField("retry", upperStatus).Error("Send NET_INFO_UPDATE to upper broker error")
-						}
-					}
-
-					_ = tcpConn.Close()
-
-					// first time
-					if upperAddress == "" {
-						upperAddress = tcpConn.RemoteAddr().String()
-						upperStatus = 0
-						logger.Info("Upper broker connected ", upperAddress)
-
-						// sync broker list
-						tcpConn, err := net.DialTimeout("tcp", upperAddr, time.Second)
-
-						if err != nil {
-
-							logger.WithError(err).Fatal("Upper broker connect for sync error")
-
-						} else {
-
-							logger.Info("Sync brokers in thlink network")
-							_, err = tcpConn.Write(utils.NewDataFrame(utils.NET_INFO, []byte{byte(selfPort >> 8), byte(selfPort)}))
-							if err != nil {
-								logger.WithError(err).Fatal("Send NET_INFO to upper broker error")
-							}
-							// read broker list
-							buf := make([]byte, utils.TransBufSize)
-							n, err := tcpConn.Read(buf)
-							if err != nil {
-								logger.WithError(err).Fatal("Read NET_INFO response error")
-							}
-							// parse broker list
-							dataStream := utils.NewDataStream()
-							dataStream.Append(buf[:n])
-							if !dataStream.Parse() {
-								logger.Fatal("Parse NET_INFO response error")
-							}
-							for i := 0; i < dataStream.Len(); {
-								logger.Info("Sync broker: ", string(dataStream.Data()[i+1:i+1+int(dataStream.Data()[i])]))
-								netBrokers.Store(string(dataStream.Data()[i+1:i+1+int(dataStream.Data()[i])]), time.Now())
-								i += 1 + int(dataStream.Data()[i])
-							}
-
-							_ = tcpConn.Close()
-
-						}
-
-					}
-
-				}
-
-			}
-
-			// find 10s timeout broker
-			data := []byte{byte(selfPort >> 8), byte(selfPort)}
-			newBrokers.Range(func(k, v interface{}) bool {
-				if time.Now().Sub(v.(time.Time)).Seconds() > 10 {
-					logger.Info("Timeout broker: ", k)
-					newBrokers.Delete(k)
-					data = append(data, byte(len(k.(string)))|0x80)
-					data = append(data, []byte(k.(string))...)
-				}
-				return true
-			})
-			if len(data) > 2 {
-				// tell 1 jump brokers
-				newBrokers.Range(func(k, _ interface{}) bool {
-					bkrConn, err := net.DialTimeout("tcp", k.(string), time.Second)
-					if err != nil {
-						logger.WithError(err).Warn("Send new broker 1 jump broker error")
-						return true
-					}
-					logger.Debug("Send timeout broker data to ", k.(string))
-					_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, data))
-					return true
-				})
-				// tell upper broker
-				if upperAddress != "" {
-					bkrConn, err := net.DialTimeout("tcp", upperAddress, time.Second)
-					if err != nil {
-						logger.WithError(err).Warn("Send new broker to upper broker error")
-					} else {
-						logger.Debug("Send timeout broker data to upper broker ", upperAddress)
-						_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, data))
-					}
-				}
-			}
+	// udp address echo for NAT type detection
+	echo, err := newAddrEcho(tcpAddr.String())
+	if err != nil {
+		logger.WithError(err).Warn("Udp address echo listen failed")
+	} else {
+		defer echo.close()
+		go echo.serve()
+	}
 
-			time.Sleep(time.Second)
+	// broker membership
+	auth, err := newFederationAuth(federation.Secret, federation.Allow)
+	if err != nil {
+		logger.WithError(err).Fatal("Federation allow list parse error")
+	}
+	if len(federation.Secret) == 0 {
+		logger.Warn("No network secret, federation is unauthenticated: any allowed broker can announce brokers in network, set the same secret on every broker")
+	}
+	selfMeta := func() []byte {
+		meta := federation.Meta
+		meta.Load = len(peers)
+		meta.Transports = utils.BrokerTransports
+		meta.Version = utils.Version
+		return meta.Encode()
+	}
+	var advertiseHost string
+	if federation.Advertise != "" {
+		advertiseHost, _, err = net.SplitHostPort(federation.Advertise)
+		if err != nil {
+			logger.WithError(err).Fatal("Advertise address parse error")
 		}
+		logger.Info("Advertise as ", federation.Advertise)
+	}
+	members := newMembership(int(listenPort64), federation.Advertise, federation.Seeds, auth, selfMeta)
+	go members.run()
 
-	}()
+	// knownBroker check if broker address is in thlink network
+	knownBroker := func(addr string) bool {
+		if members.known(addr) {
+			return true
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return false
+		}
+		return members.known(tcpAddr.String())
+	}
 
 	for {
 
-		buf := make([]byte, utils.CmdBufSize)
 		conn, err := listener.Accept()
 		if err != nil {
 			logger.WithError(err).Error("TCP listen error")
 			continue
 		}
-		n, err := conn.Read(buf)
-		if err != nil {
-			logger.WithError(err).Error("TCP read failed")
-			conn.Close()
-			continue
-		}
 
-		if n >= utils.CmdBufSize {
-			logger.Warn("RawData data too long!")
-			conn.Close()
-			continue
-		}
+		go func() {
+			defer conn.Close()
 
-		// handle commands
-		dataStream := utils.NewDataStream()
-		dataStream.Append(buf[:n])
-		if !dataStream.Parse() {
-			logger.Warn("Invalid command")
-			continue
-		}
+			dataStream, err := readCommand(conn)
+			if err != nil {
+				logger.WithError(err).Warn("Invalid command")
+				return
+			}
 
-		cmdData := dataStream.Data()
-		cmdLen := dataStream.Len()
-		cmdType := dataStream.Type()
-		go func() {
+			cmdData := dataStream.Data()
+			cmdLen := dataStream.Len()
+			cmdType := dataStream.Type()
 			switch cmdType {
 			case utils.PING:
 				// ping
@@ -214,20 +130,31 @@ func Main(listenAddr string, upperAddr string) {
 
 			case utils.TUNNEL:
 				// new tcp/udp tunnel
-				// <type> t/u
-				var port1, port2 int
+				// <type> t/u <tunnel type> q/t <flags> s for spectate cache, d for direct connection
+				// udp tunnel response: port1, port2, port3 (0 if no spectate cache), room code,
+				// 0 and advertised host if broker has advertise address or direct connection asked,
+				// then 0 and nonce PUNCH_HOST should carry if direct connection asked
+				var port1, port2, port3 int
+				var code, nonce string
 				var err error
 
-				if cmdLen > 1 {
+				if federation.Meta.Capacity > 0 && len(peers) >= federation.Meta.Capacity {
+					logger.WithField("host", conn.RemoteAddr().String()).Warn("Broker full, refuse new tunnel")
+				} else if cmdLen > 1 {
 					switch cmdData[0] {
 					case 't':
 						logger.WithField("host", conn.RemoteAddr().String()).Info("New tcp tunnel")
-						host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+						// listen on local address client reached
+						host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
 						port1, port2, err = newTcpTunnel(host)
 					case 'u':
 						logger.WithField("host", conn.RemoteAddr().String()).Info("New udp tunnel")
 						host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-						port1, port2, err = newUdpTunnel(host, cmdData[1])
+						flags := cmdData[2:cmdLen]
+						if bytes.IndexByte(flags, 'd') >= 0 {
+							nonce = newPunchNonce()
+						}
+						port1, port2, port3, code, err = newUdpTunnel(host, cmdData[1], bytes.IndexByte(flags, 's') >= 0, nonce)
 					default:
 						logger.Warn("Invalid tunnel type")
 					}
@@ -237,7 +164,67 @@ func Main(listenAddr string, upperAddr string) {
 					}
 				}
 
-				_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, []byte{byte(port1 >> 8), byte(port1), byte(port2 >> 8), byte(port2)}))
+				resp := []byte{byte(port1 >> 8), byte(port1), byte(port2 >> 8), byte(port2)}
+				if port3 > 0 || code != "" {
+					// spectator port of spectate cache
+					resp = append(resp, byte(port3>>8), byte(port3))
+				}
+				resp = append(resp, []byte(code)...)
+				if code != "" && (advertiseHost != "" || nonce != "") {
+					resp = append(resp, 0)
+					resp = append(resp, []byte(advertiseHost)...)
+				}
+				if code != "" && nonce != "" {
+					resp = append(resp, 0)
+					resp = append(resp, []byte(nonce)...)
+				}
+				_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, resp))
+
+				if err != nil {
+					logger.WithError(err).Error("Send response failed")
+				}
+
+			case utils.JOIN:
+				// new guest tunnel attached to udp tunnel
+				// <tunnel type> q/t <target> p 16bit guest udp port / r room code / f relay target
+				// response with 16bit port of guest tunnel, no data if failed
+				var port int
+
+				if cmdLen > 2 && cmdData[1] == 'f' {
+					// forward to broker in network
+					broker, target, err := parseRelayTarget(cmdData[1:])
+					if err == nil && !knownBroker(broker) {
+						err = errors.New("broker " + broker + " not in network")
+					}
+					if err != nil {
+						logger.WithError(err).Warn("Invalid relay join request")
+					} else {
+						logger.WithField("host", conn.RemoteAddr().String()).Info("New relay tunnel to ", broker)
+						host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+						port, err = newRelayTunnel(host, cmdData[0], broker, target)
+						if err != nil {
+							logger.WithError(err).Error("Failed to build relay tunnel")
+						}
+					}
+				} else if cmdLen > 2 {
+					r, err := findRoom(cmdData[1:])
+					if err != nil {
+						logger.WithError(err).Warn("Invalid join request")
+					} else {
+						logger.WithField("host", conn.RemoteAddr().String()).Info("New guest tunnel")
+						host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+						port, err = newJoinTunnel(host, cmdData[0], r)
+						if err != nil {
+							logger.WithError(err).Error("Failed to build guest tunnel")
+						}
+					}
+				}
+
+				var resp []byte
+				if port > 0 {
+					resp = []byte{byte(port >> 8), byte(port)}
+				}
+				_, err := conn.Write(utils.NewDataFrame(utils.JOIN, resp))
 
 				if err != nil {
 					logger.WithError(err).Error("Send response failed")
@@ -255,43 +242,50 @@ func Main(listenAddr string, upperAddr string) {
 			case utils.NET_INFO:
 				// broker count BrokersCntMax max, broker No bigger than BrokersCntMax will not send
 				// NET_INFO, self port 16bit (client should be 0)
-				if cmdLen == 2 {
+				// with metadata: NET_INFO, self port 16bit, m, 16bit offset
+				// response with 16bit total, then BrokersCntMax entries from offset at most,
+				// entry is address len, address, 16bit metadata len, metadata; the first entry is this broker with empty address
+				if cmdLen == 5 && cmdData[2] == 'm' {
 
-					var data []byte
-					var count int
 					rp := int(cmdData[0])<<8 + int(cmdData[1])
+					offset := int(cmdData[3])<<8 + int(cmdData[4])
 					hr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 					ar := net.JoinHostPort(hr, strconv.Itoa(rp))
-					logger.Debug("Net info command from ", ar)
-					newBrokers.Range(func(k, _ interface{}) bool {
-						if count > utils.BrokersCntMax {
-							return false
+					logger.Debug("Net info command from ", ar, " offset ", offset)
+
+					addrs := append([]string{""}, members.alive(ar)...)
+					data := []byte{byte(len(addrs) >> 8), byte(len(addrs))}
+					for i := offset; i < len(addrs) && i < offset+utils.BrokersCntMax; i++ {
+						var meta []byte
+						if i == 0 {
+							meta = selfMeta()
+						} else {
+							meta = members.metadata(addrs[i])
 						}
+						data = append(data, byte(len(addrs[i])))
+						data = append(data, []byte(addrs[i])...)
+						data = append(data, byte(len(meta)>>8), byte(len(meta)))
+						data = append(data, meta...)
+					}
 
-						if k == ar {
-							return true
-						}
+					_, err := conn.Write(utils.NewDataFrame(utils.NET_INFO, data))
+					if err != nil {
+						logger.WithError(err).Error("Send response failed")
+					}
 
-						data = append(data, byte(len(k.(string))))
-						data = append(data, []byte(k.(string))...)
+				} else if cmdLen == 2 {
 
-						count++
-						return true
-					})
-					netBrokers.Range(func(k, _ interface{}) bool {
-						if count > utils.BrokersCntMax {
-							return false
+					var data []byte
+					rp := int(cmdData[0])<<8 + int(cmdData[1])
+					hr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+					ar := net.JoinHostPort(hr, strconv.Itoa(rp))
+					logger.Debug("Net info command from ", ar)
+					for i, addr := range members.alive(ar) {
+						if i >= utils.BrokersCntMax {
+							break
 						}
-
-						data = append(data, byte(len(k.(string))))
-						data = append(data, []byte(k.(string))...)
-
-						count++
-						return true
-					})
-					if count <= utils.BrokersCntMax && upperAddress != "" {
-						data = append(data, byte(len(upperAddress)))
-						data = append(data, []byte(upperAddress)...)
+						data = append(data, byte(len(addr)))
+						data = append(data, []byte(addr)...)
 					}
 
 					// all known broker address
@@ -303,104 +297,9 @@ func Main(listenAddr string, upperAddr string) {
 				}
 
 			case utils.NET_INFO_UPDATE:
-				// broker HANDSHAKE
-				// NET_INFO_UPDATE, self port 16bit, address len address string, address len address string...
-				// response with router table
-				if cmdLen >= 2 {
-					remotePort := int(cmdData[0])<<8 + int(cmdData[1])
-					addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-					peerAddress := net.JoinHostPort(addr, strconv.Itoa(remotePort))
-
-					// ping package
-					if peerAddress != upperAddress {
-						if _, ok := newBrokers.Load(peerAddress); ok {
-							// old broker
-							newBrokers.Store(peerAddress, time.Now())
-						} else {
-
-							// new broker, no response
-							newBrokers.Store(peerAddress, time.Now())
-							logger.Info("New broker connected: ", peerAddress)
-
-							newData := []byte{byte(selfPort >> 8), byte(selfPort), byte(len(peerAddress))}
-							newData = append(newData, []byte(peerAddress)...)
-							// send to other 1 jump brokers
-							newBrokers.Range(func(k, _ interface{}) bool {
-
-								if k == peerAddress {
-									return true
-								}
-
-								bkrConn, err := net.DialTimeout("tcp", k.(string), time.Second)
-								if err != nil {
-									logger.WithError(err).Warn("Send new broker 1 jump broker error")
-									return true
-								}
-								logger.Debug("Send new broker to ", k.(string))
-								_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, newData))
-
-								return true
-							})
-							// send to upper broker
-							if upperAddress != "" {
-								bkrConn, err := net.DialTimeout("tcp", upperAddress, time.Second)
-								if err != nil {
-									logger.WithError(err).Warn("Send new broker to upper broker error")
-								} else {
-									logger.Debug("Send new broker to ", upperAddress)
-									_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, newData))
-								}
-							}
-
-						}
-					}
-
-					// not a broker ping package
-					if cmdLen > 2 {
-						routeData := cmdData[2:]
-						for i := 0; i < len(routeData); i++ {
-							// u > 0 delete; u == 0 update
-							u := routeData[i] & 0x80
-							l := int(routeData[i] & 0x7f)
-							if u > 0 {
-								logger.WithField("from", conn.RemoteAddr()).Info("Remove broker: ", string(routeData[i+1:i+1+l]))
-								netBrokers.Delete(string(routeData[i+1 : i+1+l]))
-							} else {
-								logger.WithField("from", conn.RemoteAddr()).Info("New broker: ", string(routeData[i+1:i+1+l]))
-								netBrokers.Store(string(routeData[i+1:i+1+l]), time.Now())
-							}
-							i += l
-						}
-
-						// send to other 1 jump brokers
-						newBrokers.Range(func(k, _ interface{}) bool {
-
-							if k == peerAddress {
-								return true
-							}
-
-							bkrConn, err := net.DialTimeout("tcp", k.(string), time.Second)
-							if err != nil {
-								logger.WithError(err).Warn("Send broker update to 1 jump broker error")
-								return true
-							}
-							logger.Debug("Send new broker to ", k.(string))
-							_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, append([]byte{byte(selfPort >> 8), byte(selfPort)}, routeData...)))
-
-							return true
-						})
-						// send to upper broker
-						if upperAddress != "" && peerAddress != upperAddress {
-							bkrConn, err := net.DialTimeout("tcp", upperAddress, time.Second)
-							if err != nil {
-								logger.WithError(err).Warn("Send broker update to upper broker error")
-							} else {
-								logger.Debug("Send new broker to ", upperAddress)
-								_, _ = bkrConn.Write(utils.NewDataFrame(utils.NET_INFO_UPDATE, append([]byte{byte(selfPort >> 8), byte(selfPort)}, routeData...)))
-							}
-						}
-					}
-				}
+				// broker session
+				// NET_INFO_UPDATE frames of session message, connection kept until session ends
+				members.serve(conn, dataStream)
 
 			case utils.VERSION:
 				// tunnel VERSION
@@ -419,21 +318,53 @@ func Main(listenAddr string, upperAddr string) {
 				logger.Warn("RawData data invalid")
 			}
 
-			_ = conn.Close()
-
 		}()
 
 	}
 }
 
+// readCommand read one command frame from conn in 5s
+func readCommand(conn net.Conn) (*utils.DataStream, error) {
+
+	dataStream := utils.NewDataStream()
+	err := readFrame(conn, dataStream, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataStream, nil
+}
+
+// readFrame read conn until next frame parsed by dataStream in timeout
+func readFrame(conn net.Conn, dataStream *utils.DataStream, timeout time.Duration) error {
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, utils.TransBufSize)
+	for read := 0; !dataStream.Parse(); {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		read += n
+		if read > utils.CmdFrameMax {
+			return errors.New("command frame too long")
+		}
+		dataStream.Append(buf[:n])
+	}
+
+	return nil
+}
+
 // start new tcp tunnel
 func newTcpTunnel(hostIP string) (int, int, error) {
 
-	serveTcpAddr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:0")
+	serveTcpAddr, err := net.ResolveTCPAddr("tcp", ":0")
 
 	// quic tunnel between broker and client
 	tlsConfig, err := utils.GenerateTLSConfig()
-	hostListener, err := quic.ListenAddr(hostIP+":0", tlsConfig, nil)
+	hostListener, err := quic.ListenAddr(net.JoinHostPort(hostIP, "0"), tlsConfig, nil)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -443,21 +374,19 @@ func newTcpTunnel(hostIP string) (int, int, error) {
 		return 0, 0, err
 	}
 
-	_, hostPort, _ := net.SplitHostPort(hostListener.Addr().String())
-	_, servePort, _ := net.SplitHostPort(serveListener.Addr().String())
-	iHostPort, _ := strconv.ParseInt(hostPort, 10, 32)
-	iServePort, _ := strconv.ParseInt(servePort, 10, 32)
+	hostPort, servePort := utils.AddrPort(hostListener.Addr()), utils.AddrPort(serveListener.Addr())
 
-	logger.Infof("New tcp peer " + hostPort + "-" + servePort)
-	peers[int(iHostPort)] = int(iServePort)
-	go handleTcpTunnel(int(iHostPort), hostListener, serveListener)
+	logger.Infof("New tcp peer %d-%d", hostPort, servePort)
+	peers[hostPort] = servePort
+	go handleTcpTunnel(hostPort, hostListener, serveListener)
 
-	return int(iHostPort), int(iServePort), nil
+	return hostPort, servePort, nil
 
 }
 
-// start new udp tunnel
-func newUdpTunnel(hostIP string, tunnelType byte) (int, int, error) {
+// start new udp tunnel, with th12.3 spectate cache server if spectate is true,
+// return port1, port2, port3 and room code
+func newUdpTunnel(hostIP string, tunnelType byte, spectate bool, nonce string) (int, int, int, string, error) {
 
 	config := utils.TunnelConfig{}
 	switch tunnelType {
@@ -466,21 +395,36 @@ func newUdpTunnel(hostIP string, tunnelType byte) (int, int, error) {
 	case 't':
 		config.Type = utils.ListenTcpListenUdp
 	default:
-		return 0, 0, errors.New("no such tunnel type " + string(tunnelType))
+		return 0, 0, 0, "", errors.New("no such tunnel type " + string(tunnelType))
 	}
 
 	tunnel, err := utils.NewTunnel(&config)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, "", err
+	}
+
+	var spectator *spectateServer
+	var port3 int
+	if spectate {
+		spectator, port3, err = newSpectateServer()
+		if err != nil {
+			tunnel.Close()
+			return 0, 0, 0, "", err
+		}
 	}
 
 	port1, port2 := tunnel.Ports()
 	peers[port1] = port2
 	logger.Infof("New udp peer " + strconv.Itoa(port1) + "-" + strconv.Itoa(port2))
+	if spectator != nil {
+		logger.Infof("New spectate cache for udp peer %d at %d", port1, port3)
+	}
+	r := newRoom(port2)
+	logger.Infof("New room %s for udp peer %d", r.code, port1)
 
-	go handleUdpTunnel(tunnel)
+	go handleUdpTunnel(tunnel, spectator, r, nonce)
 
-	return port1, port2, nil
+	return port1, port2, port3, r.code, nil
 
 }
 
@@ -601,7 +545,7 @@ func handleTcpTunnel(clientPort int, hostListener quic.Listener, serveListener *
 	<-ch
 }
 
-func handleUdpTunnel(tunnel *utils.Tunnel) {
+func handleUdpTunnel(tunnel *utils.Tunnel, spectator *spectateServer, r *room, nonce string) {
 
 	port1, port2 := tunnel.Ports()
 
@@ -610,6 +554,15 @@ func handleUdpTunnel(tunnel *utils.Tunnel) {
 	}()
 	defer logger.Infof("End udp peer %d-%d", port1, port2)
 	defer tunnel.Close()
+	defer r.close()
+
+	tunnel.SetPunchCallback(newRendezvous(tunnel, nonce).punch)
+
+	if spectator != nil {
+		defer spectator.close()
+		tunnel.SetFrameCallback(spectator.cacheFrame)
+		go spectator.serve()
+	}
 
 	err := tunnel.Serve(nil, nil, nil, nil)
 	if err != nil {
@@ -1,11 +1,13 @@
 package broker
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -26,8 +28,8 @@ func TestRun(t *testing.T) {
 	t.Log("Run broker")
 
 	logrus.SetLevel(logrus.DebugLevel)
-	go Main("127.0.0.1:4646", "")
-	go Main("127.0.0.1:4647", serverAddress)
+	go Main("127.0.0.1:4646", Federation{})
+	go Main("127.0.0.1:4647", Federation{Seeds: []string{serverAddress}})
 	//time.Sleep(time.Second)
 }
 
@@ -374,3 +376,674 @@ func testNetInfo(addr string, ans string, t *testing.T) {
 	t.Log("Test", addr, ans, "finished")
 
 }
+
+func TestRendezvous(t *testing.T) {
+	brokerTcpAddr, _ := net.ResolveTCPAddr("tcp4", serverAddress)
+	conn, err := net.DialTCP("tcp4", nil, brokerTcpAddr)
+	if err != nil {
+		t.Fatal("Fail to connect to server: ", err.Error())
+	}
+	defer conn.Close()
+
+	buf := make([]byte, utils.TransBufSize)
+
+	_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, []byte{'u', 't', 'd'}))
+	if err != nil {
+		t.Fatal("Fail to send new udp tunnel command: ", err.Error())
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("Cannot read from server: ", err.Error())
+	}
+	dataStream := utils.NewDataStream()
+	dataStream.Append(buf[:n])
+	if !dataStream.Parse() || dataStream.Type() != utils.TUNNEL || dataStream.Len() <= 6 {
+		t.Fatal("Not a new udp tunnel response: ", buf[:n])
+	}
+	port1 := int(dataStream.Data()[0])<<8 + int(dataStream.Data()[1])
+	port2 := int(dataStream.Data()[2])<<8 + int(dataStream.Data()[3])
+	fields := bytes.SplitN(dataStream.Data()[6:], []byte{0}, 3)
+	if len(fields) != 3 || len(fields[2]) == 0 {
+		t.Fatal("No nonce in new udp tunnel response: ", buf[:n])
+	}
+	nonce := append([]byte{}, fields[2]...)
+
+	// host tunnel
+	tunnel, err := utils.NewTunnel(&utils.TunnelConfig{
+		Type:     utils.DialTcpDialUdp,
+		Address0: "127.0.0.1:" + strconv.Itoa(port1),
+		Address1: "127.0.0.1:10800",
+	})
+	if err != nil {
+		t.Fatal("Fail to dial tunnel: ", err.Error())
+	}
+	defer tunnel.Close()
+	guestEndpoint := make(chan string, 1)
+	tunnel.SetFrameCallback(func(dataType utils.DataType, data []byte) {
+		if dataType == utils.RENDEZVOUS {
+			guestEndpoint <- string(data)
+		}
+	})
+	go tunnel.Serve(nil, nil, nil, nil)
+
+	relayAddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:"+strconv.Itoa(port2))
+	register := func(punchType utils.PunchType, nonce []byte) (*net.UDPConn, string) {
+		udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal("Fail to listen udp: ", err.Error())
+		}
+		_, err = udpConn.WriteToUDP(utils.NewPunchPackage(punchType, nonce), relayAddr)
+		if err != nil {
+			t.Fatal("Fail to send punch package: ", err.Error())
+		}
+		_ = udpConn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			udpConn.Close()
+			return nil, ""
+		}
+		punchType, data, ok := utils.ParsePunchPackage(buf[:n])
+		if !ok || punchType != utils.PUNCH_PEER {
+			t.Fatal("Not a PUNCH_PEER response: ", buf[:n])
+		}
+		return udpConn, string(data)
+	}
+
+	// wait for tunnel accepted
+	time.Sleep(time.Millisecond * 100)
+
+	if spoof, _ := register(utils.PUNCH_HOST, []byte("0123456789abcdef")); spoof != nil {
+		spoof.Close()
+		t.Error("PUNCH_HOST with wrong nonce should be dropped")
+	}
+
+	host, hostEndpoint := register(utils.PUNCH_HOST, nonce)
+	if host == nil {
+		t.Fatal("Cannot register host endpoint")
+	}
+	defer host.Close()
+	if hostEndpoint != host.LocalAddr().String() {
+		t.Error("Host endpoint not match: ", hostEndpoint, " ", host.LocalAddr().String())
+	}
+
+	guest, peer := register(utils.PUNCH_GUEST, nil)
+	if guest == nil {
+		t.Fatal("Cannot register guest endpoint")
+	}
+	defer guest.Close()
+	if peer != hostEndpoint {
+		t.Error("Host endpoint told to guest not match: ", peer)
+	}
+
+	// guests told to host are rate limited
+	other, peer := register(utils.PUNCH_GUEST, nil)
+	if other == nil {
+		t.Fatal("Cannot register guest endpoint")
+	}
+	defer other.Close()
+	if peer != "" {
+		t.Error("Guest in rate limit should stay on relay: ", peer)
+	}
+
+	select {
+	case e := <-guestEndpoint:
+		if e != guest.LocalAddr().String() {
+			t.Error("Guest endpoint told to host not match: ", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("No RENDEZVOUS frame received")
+	}
+}
+
+func TestJoin(t *testing.T) {
+
+	command := func(dataType utils.DataType, data []byte) []byte {
+		conn, err := net.Dial("tcp4", serverAddress)
+		if err != nil {
+			t.Fatal("Fail to connect to server: ", err.Error())
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(utils.NewDataFrame(dataType, data))
+		if err != nil {
+			t.Fatal("Fail to send command: ", err.Error())
+		}
+		buf := make([]byte, utils.CmdBufSize)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal("Cannot read from server: ", err.Error())
+		}
+		dataStream := utils.NewDataStream()
+		dataStream.Append(buf[:n])
+		if !dataStream.Parse() || dataStream.Type() != dataType {
+			t.Fatal("Invalid response: ", buf[:n])
+		}
+		return append([]byte{}, dataStream.Data()...)
+	}
+
+	tunnelResp := command(utils.TUNNEL, []byte{'u', 't'})
+	if len(tunnelResp) <= 6 {
+		t.Fatal("No room code in TUNNEL response: ", tunnelResp)
+	}
+	code := tunnelResp[6:]
+
+	// host connect
+	tunnel, err := utils.NewTunnel(&utils.TunnelConfig{
+		Type:     utils.DialTcpDialUdp,
+		Address0: "127.0.0.1:" + strconv.Itoa(int(tunnelResp[0])<<8+int(tunnelResp[1])),
+		Address1: "127.0.0.1:10800",
+	})
+	if err != nil {
+		t.Fatal("Fail to dial tunnel: ", err.Error())
+	}
+	defer tunnel.Close()
+	go tunnel.Serve(nil, nil, nil, nil)
+
+	if resp := command(utils.JOIN, append([]byte{'t', 'r'}, "ZZZZZZ"...)); len(resp) != 0 {
+		t.Error("Join not existing room succeeded: ", resp)
+	}
+	if resp := command(utils.JOIN, append([]byte{'t', 'r'}, code...)); len(resp) != 2 {
+		t.Error("Join with room code failed: ", resp)
+	}
+	if resp := command(utils.JOIN, []byte{'q', 'p', tunnelResp[2], tunnelResp[3]}); len(resp) != 2 {
+		t.Error("Join with guest port failed: ", resp)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	// guest joins through broker A to host on broker B
+	brokerA, brokerB := "127.0.0.1:4654", "127.0.0.1:4655"
+	go Main(brokerA, Federation{})
+	time.Sleep(100 * time.Millisecond)
+	go Main(brokerB, Federation{Seeds: []string{brokerA}})
+	time.Sleep(1500 * time.Millisecond)
+
+	command := func(broker string, dataType utils.DataType, data []byte) []byte {
+		conn, err := net.Dial("tcp4", broker)
+		if err != nil {
+			t.Fatal("Fail to connect to server: ", err.Error())
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(utils.NewDataFrame(dataType, data))
+		if err != nil {
+			t.Fatal("Fail to send command: ", err.Error())
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		dataStream, err := readCommand(conn)
+		if err != nil || dataStream.Type() != dataType {
+			t.Fatal("Invalid response: ", err)
+		}
+		return append([]byte{}, dataStream.Data()...)
+	}
+
+	// host game answers with prefix
+	game, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Fail to listen udp: ", err.Error())
+	}
+	defer game.Close()
+	go func() {
+		buf := make([]byte, utils.CmdBufSize)
+		for {
+			n, addr, err := game.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = game.WriteToUDP(append([]byte("host "), buf[:n]...), addr)
+		}
+	}()
+
+	// host connect to broker B
+	tunnelResp := command(brokerB, utils.TUNNEL, []byte{'u', 't'})
+	if len(tunnelResp) <= 6 {
+		t.Fatal("No room code in TUNNEL response: ", tunnelResp)
+	}
+	host, err := utils.NewTunnel(&utils.TunnelConfig{
+		Type:     utils.DialTcpDialUdp,
+		Address0: "127.0.0.1:" + strconv.Itoa(int(tunnelResp[0])<<8+int(tunnelResp[1])),
+		Address1: game.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal("Fail to dial tunnel: ", err.Error())
+	}
+	defer host.Close()
+	go host.Serve(nil, nil, nil, nil)
+
+	// only brokers in network are relayed to
+	target := append([]byte{'t', 'f', byte(len("127.0.0.1:4657"))}, "127.0.0.1:4657"...)
+	target = append(target, 'r')
+	target = append(target, tunnelResp[6:]...)
+	if resp := command(brokerA, utils.JOIN, target); len(resp) != 0 {
+		t.Error("Join through relay to broker not in network succeeded: ", resp)
+	}
+
+	// guest join room on broker B through broker A
+	target = append([]byte{'t', 'f', byte(len(brokerB))}, brokerB...)
+	target = append(target, 'r')
+	target = append(target, tunnelResp[6:]...)
+	joinResp := command(brokerA, utils.JOIN, target)
+	if len(joinResp) != 2 {
+		t.Fatal("Join through relay failed: ", joinResp)
+	}
+	guest, err := utils.NewTunnel(&utils.TunnelConfig{
+		Type:     utils.DialTcpListenUdp,
+		Address0: "127.0.0.1:" + strconv.Itoa(int(joinResp[0])<<8+int(joinResp[1])),
+		Address1: "127.0.0.1:4656",
+	})
+	if err != nil {
+		t.Fatal("Fail to dial relay tunnel: ", err.Error())
+	}
+	defer guest.Close()
+	go guest.Serve(nil, nil, nil, nil)
+
+	// guest game to host game and back
+	player, err := net.Dial("udp4", "127.0.0.1:4656")
+	if err != nil {
+		t.Fatal("Fail to dial guest tunnel: ", err.Error())
+	}
+	defer player.Close()
+	buf := make([]byte, utils.CmdBufSize)
+	for i := 0; i < 5; i++ {
+		_, _ = player.Write([]byte("guest"))
+		_ = player.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := player.Read(buf)
+		if err == nil {
+			if string(buf[:n]) != "host guest" {
+				t.Fatal("Relay data error: ", string(buf[:n]))
+			}
+			return
+		}
+	}
+	t.Error("No data through relay tunnel")
+}
+
+func TestMembership(t *testing.T) {
+	now := time.Now()
+	auth, _ := newFederationAuth("", nil)
+	m := newMembership(4600, "", nil, auth, nil)
+	m.self["10.0.0.1:4600"] = true
+
+	// digest of 10.0.0.2:4646 knowing 10.0.0.3:4646 and this broker
+	peer := newMembership(4646, "", nil, auth, func() []byte {
+		meta := utils.BrokerMeta{Name: "peer", Capacity: 10}
+		return meta.Encode()
+	})
+	peer.incarnation, peer.heartbeat = 100, 7
+	peer.members["10.0.0.3:4646"] = &member{incarnation: 50, heartbeat: 3, updated: now}
+	peer.members["10.0.0.1:4600"] = &member{incarnation: m.incarnation, heartbeat: 1, updated: now}
+	err := m.merge("10.0.0.2:4646", peer.digest(), true, now)
+	if err != nil {
+		t.Fatal("Merge digest failed: ", err.Error())
+	}
+	if len(m.members) != 2 || !m.known("10.0.0.2:4646") || !m.known("10.0.0.3:4646") {
+		t.Fatal("Merge result error: ", m.members)
+	}
+	if meta, err := utils.DecodeBrokerMeta(m.metadata("10.0.0.2:4646")); err != nil || meta.Name != "peer" || meta.Capacity != 10 {
+		t.Error("Broker metadata not merged: ", meta, err)
+	}
+
+	// rumour not override broker talking directly, its direct beat always wins
+	m.update("10.0.0.2:4646", 0xffffffff, 0, nil, false, now)
+	if m.members["10.0.0.2:4646"].incarnation != 100 {
+		t.Error("Rumour overrides direct beat")
+	}
+	m.update("10.0.0.2:4646", 0xffffffff, 0, nil, false, now.Add(suspectTimeout))
+	m.update("10.0.0.2:4646", 100, 7, nil, true, now.Add(suspectTimeout))
+	if m.members["10.0.0.2:4646"].incarnation != 100 {
+		t.Error("Direct beat not win over rumour")
+	}
+
+	// stale heartbeat not refresh member
+	m.tick(now.Add(suspectTimeout + time.Second))
+	if m.members["10.0.0.3:4646"].state != memberSuspect {
+		t.Error("Broker not suspected")
+	}
+	m.update("10.0.0.3:4646", 50, 3, nil, false, now.Add(suspectTimeout+time.Second))
+	m.tick(now.Add(deadTimeout + time.Second))
+	if m.known("10.0.0.3:4646") || len(m.alive("")) != 0 {
+		t.Error("Broker not dead")
+	}
+
+	// newer heartbeat and restart bring broker back
+	m.update("10.0.0.2:4646", 100, 8, nil, false, now.Add(deadTimeout+time.Second))
+	m.update("10.0.0.3:4646", 60, 0, nil, false, now.Add(deadTimeout+time.Second))
+	if alive := m.alive("10.0.0.2:4646"); len(alive) != 1 || alive[0] != "10.0.0.3:4646" {
+		t.Error("Broker not alive again: ", alive)
+	}
+
+	m.tick(now.Add(deadTimeout + forgetTimeout + 2*time.Second))
+	if len(m.members) != 0 {
+		t.Error("Dead broker not forgotten")
+	}
+
+	if m.merge("10.0.0.2:4646", []byte{0, 0, 0, 1, 0, 0, 0, 1, 20, 'x'}, true, now) == nil {
+		t.Error("Broken digest accepted")
+	}
+}
+
+func TestSeedDown(t *testing.T) {
+	// seed broker not started yet, broker should keep running
+	go Main("127.0.0.1:4648", Federation{Seeds: []string{"127.0.0.1:4649"}})
+	time.Sleep(1500 * time.Millisecond)
+	go Main("127.0.0.1:4649", Federation{})
+	time.Sleep(2500 * time.Millisecond) // session reconnects with backoff
+
+	testNetInfo("127.0.0.1:4649", "127.0.0.1:4648", t)
+}
+
+func TestFederationAuth(t *testing.T) {
+	auth, err := newFederationAuth("secret", []string{"10.0.0.0/8", "192.168.1.2"})
+	if err != nil {
+		t.Fatal("Parse allow list failed: ", err.Error())
+	}
+	if _, err = newFederationAuth("", []string{"not an ip"}); err == nil {
+		t.Error("Invalid allow list accepted")
+	}
+
+	for addr, ok := range map[string]bool{"10.1.2.3:4646": true, "192.168.1.2:4646": true, "192.168.1.3:4646": false, "127.0.0.1": false} {
+		if auth.allowed(addr) != ok {
+			t.Error("Allow list check error: ", addr)
+		}
+	}
+
+	payload := []byte("payload")
+	signed := auth.sign('q', payload)
+	data, err := auth.verify('q', signed)
+	if err != nil || string(data) != "payload" {
+		t.Error("Verify signed message failed: ", err)
+	}
+	if _, err = auth.verify('r', signed); err == nil {
+		t.Error("Request accepted as response")
+	}
+	signed[0] ^= 1
+	if _, err = auth.verify('q', signed); err == nil {
+		t.Error("Tampered message accepted")
+	}
+	other, _ := newFederationAuth("other", nil)
+	if _, err = other.verify('q', auth.sign('q', payload)); err == nil {
+		t.Error("Message of other network accepted")
+	}
+
+	// session messages are bound to nonces, direction and sequence
+	hello, welcome := newAuthNonce(), newAuthNonce()
+	opener, server := newSessionAuth(auth, hello, welcome, true), newSessionAuth(auth, hello, welcome, false)
+	signed = opener.sign('q', payload)
+	if data, err = server.verify('q', signed); err != nil || string(data) != "payload" {
+		t.Error("Verify session message failed: ", err)
+	}
+	if _, err = server.verify('q', signed); err == nil {
+		t.Error("Replayed session message accepted")
+	}
+	if _, err = opener.verify('q', server.sign('q', payload)); err != nil {
+		t.Error("Verify session answer failed: ", err)
+	}
+	if _, err = opener.verify('q', opener.sign('q', payload)); err == nil {
+		t.Error("Reflected session message accepted")
+	}
+	stranger := newSessionAuth(auth, hello, newAuthNonce(), false)
+	if _, err = stranger.verify('q', newSessionAuth(auth, hello, welcome, true).sign('q', payload)); err == nil {
+		t.Error("Message of other session accepted")
+	}
+
+	// broker with secret refuses unsigned session, accepts signed one
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen failed: ", err.Error())
+	}
+	defer listener.Close()
+	local, _ := newFederationAuth("secret", []string{"127.0.0.1"})
+	m := newMembership(listener.Addr().(*net.TCPAddr).Port, "", nil, local, nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dataStream, err := readCommand(conn)
+				if err == nil {
+					m.serve(conn, dataStream)
+				}
+			}()
+		}
+	}()
+
+	plain, _ := newFederationAuth("", nil)
+	peer := newMembership(4646, "", nil, plain, nil)
+	if err = peer.send(listener.Addr().String(), sessionQuery, peer.digest()); err == nil {
+		t.Error("Unsigned session accepted")
+	}
+	remote, _ := newFederationAuth("secret", nil)
+	peer = newMembership(4646, "", nil, remote, nil)
+	if err = peer.send(listener.Addr().String(), sessionHeartbeat, peer.beat()); err != nil {
+		t.Fatal("Signed session refused: ", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !peer.known(listener.Addr().String()) {
+		t.Error("Heartbeat not answered")
+	}
+	for i := 0; i < 2; i++ {
+		if err = peer.send(listener.Addr().String(), sessionQuery, peer.digest()); err != nil {
+			t.Fatal("Signed session refused: ", err.Error())
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !m.known("127.0.0.1:4646") || !peer.known(listener.Addr().String()) {
+		t.Error("Membership after gossip error")
+	}
+	if len(peer.connected()) != 1 {
+		t.Error("Session not kept")
+	}
+	peer.sessions[listener.Addr().String()].close()
+}
+
+func TestNetInfoMeta(t *testing.T) {
+	conn, err := net.Dial("tcp4", serverAddress)
+	if err != nil {
+		t.Fatal("Fail to connect to server: ", err.Error())
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(utils.NewDataFrame(utils.NET_INFO, []byte{0, 0, 'm', 0, 0}))
+	if err != nil {
+		t.Fatal("Fail to send net info command: ", err.Error())
+	}
+
+	dataStream, err := readCommand(conn)
+	if err != nil {
+		t.Fatal("Fail to read net response: ", err.Error())
+	}
+	data := dataStream.Data()
+	if len(data) < 2 || int(data[0])<<8+int(data[1]) != 2 {
+		t.Fatal("Net response total error: ", data)
+	}
+
+	var addrs []string
+	for i := 2; i < len(data); {
+		l := int(data[i])
+		addrs = append(addrs, string(data[i+1:i+1+l]))
+		i += 1 + l
+		ml := int(data[i])<<8 + int(data[i+1])
+		meta, err := utils.DecodeBrokerMeta(data[i+2 : i+2+ml])
+		if err != nil || meta.Version != utils.Version || len(meta.Transports) != len(utils.BrokerTransports) {
+			t.Error("Broker metadata error: ", meta, err)
+		}
+		i += 2 + ml
+	}
+	if len(addrs) != 2 || addrs[0] != "" || addrs[1] != "127.0.0.1:4647" {
+		t.Error("Net response content error: ", addrs)
+	}
+}
+
+func TestAdvertise(t *testing.T) {
+	go Main("127.0.0.1:4650", Federation{Advertise: "localhost:4650"})
+	time.Sleep(100 * time.Millisecond)
+	go Main("127.0.0.1:4651", Federation{Seeds: []string{"127.0.0.1:4650"}})
+	time.Sleep(1500 * time.Millisecond)
+
+	// known by advertised address in network
+	testNetInfo("127.0.0.1:4651", "localhost:4650", t)
+	testNetInfo("127.0.0.1:4650", "127.0.0.1:4651", t)
+
+	// advertised host in TUNNEL response
+	conn, err := net.Dial("tcp4", "127.0.0.1:4650")
+	if err != nil {
+		t.Fatal("Fail to connect to server: ", err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, []byte{'u', 'q'}))
+	if err != nil {
+		t.Fatal("Fail to send tunnel command: ", err.Error())
+	}
+	dataStream, err := readCommand(conn)
+	if err != nil {
+		t.Fatal("Fail to read tunnel response: ", err.Error())
+	}
+	if dataStream.Len() != 6+roomCodeLen+1+len("localhost") || !strings.HasSuffix(string(dataStream.Data()), "\x00localhost") {
+		t.Error("Tunnel response without advertised host: ", dataStream.Data())
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	go Main("[::1]:4652", Federation{})
+	time.Sleep(100 * time.Millisecond)
+	go Main("[::1]:4653", Federation{Seeds: []string{"[::1]:4652"}})
+	time.Sleep(1500 * time.Millisecond)
+
+	conn, err := net.Dial("tcp6", "[::1]:4652")
+	if err != nil {
+		t.Fatal("Fail to connect to server: ", err.Error())
+	}
+	defer conn.Close()
+
+	// IPv6 broker in network
+	_, err = conn.Write(utils.NewDataFrame(utils.NET_INFO, []byte{0, 0}))
+	if err != nil {
+		t.Fatal("Fail to send net info command: ", err.Error())
+	}
+	dataStream, err := readCommand(conn)
+	if err != nil {
+		t.Fatal("Fail to read net response: ", err.Error())
+	}
+	if dataStream.Len() < 1 || string(dataStream.Data()[1:]) != "[::1]:4653" {
+		t.Error("Net response content error: ", string(dataStream.Data()))
+	}
+
+	// tunnel listening on IPv6
+	conn, err = net.Dial("tcp6", "[::1]:4652")
+	if err != nil {
+		t.Fatal("Fail to connect to server: ", err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, []byte{'u', 'q'}))
+	if err != nil {
+		t.Fatal("Fail to send tunnel command: ", err.Error())
+	}
+	dataStream, err = readCommand(conn)
+	if err != nil || dataStream.Type() != utils.TUNNEL || dataStream.Len() < 4 {
+		t.Fatal("Fail to read tunnel response: ", err)
+	}
+	port := int(dataStream.Data()[2])<<8 + int(dataStream.Data()[3])
+	udpConn, err := net.Dial("udp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal("Fail to dial tunnel: ", err.Error())
+	}
+	_ = udpConn.Close()
+}
+
+func TestSpectateCache(t *testing.T) {
+	s, _, err := newSpectateServer()
+	if err != nil {
+		t.Fatal("New spectate server error: ", err)
+	}
+	defer s.close()
+
+	s.cacheFrame(utils.SPECTATE_CACHE, append([]byte{byte(utils.SPECTATE_INIT)}, make([]byte, 81)...))
+	match := append([]byte{byte(utils.SPECTATE_MATCH)}, make([]byte, 99)...)
+	match[99] = 1
+	s.cacheFrame(utils.SPECTATE_CACHE, match)
+
+	// first GAME_REPLAY_REQUEST with frame id 0xffffffff gets GAME_MATCH
+	request := []byte{clientGame123, gameReplayRequest123, 0xff, 0xff, 0xff, 0xff, 0}
+	if reply := s.handle("spectator", request); len(reply) != 99 || reply[98] != 1 {
+		t.Fatal("Spectator not get GAME_MATCH: ", reply)
+	}
+
+	// earlier match is served from cache, match not cached goes to next cached one
+	s.cacheFrame(utils.SPECTATE_CACHE, []byte{byte(utils.SPECTATE_INPUT), 1, 1, 0, 0, 0, 1, 0, 0, 0, 0})
+	match[99] = 3
+	s.cacheFrame(utils.SPECTATE_CACHE, match)
+	request = []byte{clientGame123, gameReplayRequest123, 0, 0, 0, 0, 1}
+	if reply := s.handle("spectator", request); len(reply) < 3 || reply[0] != hostGame123 || reply[1] != gameReplay123 {
+		t.Error("Spectator not get GAME_REPLAY of earlier match: ", reply)
+	}
+	request = []byte{clientGame123, gameReplayRequest123, 2, 0, 0, 0, 1}
+	if reply := s.handle("spectator", request); len(reply) != 99 || reply[98] != 3 {
+		t.Error("Spectator finishing earlier match not get next GAME_MATCH: ", reply)
+	}
+	request = []byte{clientGame123, gameReplayRequest123, 0, 0, 0, 0, 2}
+	if reply := s.handle("spectator", request); len(reply) != 99 || reply[98] != 3 {
+		t.Error("Spectator of match not cached not get next GAME_MATCH: ", reply)
+	}
+
+	// spectators are limited, silent ones expire
+	request = []byte{clientGame123, gameReplayRequest123, 0xff, 0xff, 0xff, 0xff, 0}
+	for i := 0; i < spectatorMax; i++ {
+		s.watch(strconv.Itoa(i), time.Now())
+	}
+	if reply := s.handle("new", request); reply != nil || len(s.spectators) > spectatorMax {
+		t.Fatal("Spectator over limit served: ", len(s.spectators))
+	}
+	for a := range s.spectators {
+		s.spectators[a] = time.Now().Add(-2 * spectatorTimeout)
+	}
+	if reply := s.handle("new", request); reply == nil || len(s.spectators) != 1 {
+		t.Error("Expired spectators not forgotten: ", len(s.spectators))
+	}
+}
+
+func TestAddrEcho(t *testing.T) {
+	e, err := newAddrEcho("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("New address echo error: ", err)
+	}
+	go e.serve()
+	defer e.close()
+
+	conn, err := net.DialUDP("udp", nil, e.conns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("Dial address echo error: ", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, utils.CmdBufSize)
+
+	// request shorter than answer is dropped
+	_, _ = conn.Write(utils.NewDataFrame(utils.ADDR_ECHO, []byte{byte(utils.ECHO_SAME_PORT)}))
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err = conn.Read(buf); err == nil {
+		t.Error("Short address echo request answered")
+	}
+
+	// padded request is answered
+	_, _ = conn.Write(utils.NewDataFrame(utils.ADDR_ECHO, make([]byte, utils.AddrEchoLen)))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || !strings.HasSuffix(string(buf[:n]), conn.LocalAddr().String()) {
+		t.Error("Address echo not answered: ", err)
+	}
+
+	// burst of one ip is limited
+	now := time.Now()
+	for i := 0; i < echoBurst; i++ {
+		e.allow("192.0.2.1", now)
+	}
+	if e.allow("192.0.2.1", now) {
+		t.Error("Address echo not rate limited")
+	}
+	if !e.allow("192.0.2.1", now.Add(time.Second)) {
+		t.Error("Address echo bucket not refilled")
+	}
+}
@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerEcho = logrus.WithField("broker", "echo")
+
+const (
+	echoRate  = 5    // answers per second of one source ip
+	echoBurst = 20   // answers in a burst of one source ip
+	echoIpMax = 4096 // source ips remembered by rate limit
+)
+
+// addrEcho answer ADDR_ECHO with observed udp address, on udp port same as command interface
+// and an alternate port, so that client can find out its NAT type
+type addrEcho struct {
+	conns   [2]*net.UDPConn // command port and alternate port
+	altPort int
+
+	lock    sync.Mutex
+	buckets map[string]*echoBucket // rate limit of source ip
+}
+
+// echoBucket token bucket of one source ip
+type echoBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newAddrEcho listen udp on addr and an alternate port of the same ip
+func newAddrEcho(addr string) (*addrEcho, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	altConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: udpAddr.IP})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &addrEcho{
+		conns:   [2]*net.UDPConn{conn, altConn},
+		altPort: utils.AddrPort(altConn.LocalAddr()),
+		buckets: make(map[string]*echoBucket),
+	}, nil
+}
+
+// serve answer requests on both ports
+func (e *addrEcho) serve() {
+
+	loggerEcho.Info("Start udp address echo at ", e.conns[0].LocalAddr().String(), " and port ", e.altPort)
+
+	ch := make(chan int, 2)
+	for i := range e.conns {
+		go func(from int) {
+			defer func() {
+				ch <- 1
+			}()
+
+			buf := make([]byte, utils.CmdBufSize)
+
+			for {
+				n, addr, err := e.conns[from].ReadFromUDP(buf)
+				if err != nil {
+					loggerEcho.WithError(err).Error("Read udp address echo request failed")
+					break
+				}
+
+				dataStream := utils.NewDataStream()
+				dataStream.Append(buf[:n])
+				if !dataStream.Parse() || dataStream.Type() != utils.ADDR_ECHO {
+					continue
+				}
+
+				answer := from
+				if dataStream.Len() > 0 && utils.AddrEchoFlag(dataStream.Data()[0]) == utils.ECHO_CHANGE_PORT {
+					answer = 1 - from
+				}
+
+				resp := []byte{byte(answer), byte(e.altPort >> 8), byte(e.altPort)}
+				resp = append(resp, []byte(addr.String())...)
+				frame := utils.NewDataFrame(utils.ADDR_ECHO, resp)
+
+				// never answer more than asked, and not too often, or echo is a reflection amplifier
+				if n < len(frame) || !e.allow(addr.IP.String(), time.Now()) {
+					continue
+				}
+
+				_, err = e.conns[answer].WriteToUDP(frame, addr)
+				if err != nil {
+					loggerEcho.WithError(err).Warn("Send udp address echo failed")
+				}
+			}
+		}(i)
+	}
+
+	<-ch
+	e.close()
+}
+
+// allow take a token from bucket of source ip, return false if ip is rate limited
+func (e *addrEcho) allow(ip string, now time.Time) bool {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	b, ok := e.buckets[ip]
+	if !ok {
+		if len(e.buckets) >= echoIpMax {
+			// forget ips with full bucket
+			for i, o := range e.buckets {
+				if o.tokens+now.Sub(o.last).Seconds()*echoRate >= echoBurst {
+					delete(e.buckets, i)
+				}
+			}
+			if len(e.buckets) >= echoIpMax {
+				return false
+			}
+		}
+		b = &echoBucket{tokens: echoBurst, last: now}
+		e.buckets[ip] = b
+	}
+
+	b.tokens = math.Min(echoBurst, b.tokens+now.Sub(b.last).Seconds()*echoRate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// close stop serving
+func (e *addrEcho) close() {
+	for _, c := range e.conns {
+		_ = c.Close()
+	}
+}
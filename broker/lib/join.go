@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerJoin = logrus.WithField("broker", "join")
+
+// room code alphabet, without easily confused 0/O and 1/I/L
+const (
+	roomCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	roomCodeLen      = 6
+)
+
+// room udp tunnel guests can join with its guest port or room code
+type room struct {
+	lock  sync.Mutex
+	code  string
+	port  int             // guest udp port (port2) of tunnel
+	joins []*utils.Tunnel // guest tunnels attached
+}
+
+var (
+	roomsByCode sync.Map // room code string => *room
+	roomsByPort sync.Map // guest udp port int => *room
+)
+
+// newRoom register udp tunnel with guest udp port, return room with unique code
+func newRoom(port int) *room {
+
+	r := &room{port: port}
+	buf := make([]byte, roomCodeLen)
+
+	for {
+		_, _ = rand.Read(buf)
+		for i := range buf {
+			buf[i] = roomCodeAlphabet[int(buf[i])%len(roomCodeAlphabet)]
+		}
+		r.code = string(buf)
+
+		if _, loaded := roomsByCode.LoadOrStore(r.code, r); !loaded {
+			break
+		}
+	}
+	roomsByPort.Store(port, r)
+
+	return r
+}
+
+// close unregister room and close guest tunnels attached
+func (r *room) close() {
+
+	roomsByCode.Delete(r.code)
+	roomsByPort.Delete(r.port)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, t := range r.joins {
+		t.Close()
+	}
+	r.joins = nil
+}
+
+// findRoom find room with JOIN request target
+//
+//	+------+--------------------------+
+//	| 'p'  | 16bit guest udp port     |
+//	| 'r'  | room code                |
+//	+------+--------------------------+
+func findRoom(target []byte) (*room, error) {
+
+	if len(target) < 2 {
+		return nil, errors.New("invalid join target")
+	}
+
+	var v interface{}
+	var ok bool
+	switch target[0] {
+	case 'p':
+		if len(target) != 3 {
+			return nil, errors.New("invalid join port")
+		}
+		v, ok = roomsByPort.Load(int(target[1])<<8 | int(target[2]))
+	case 'r':
+		v, ok = roomsByCode.Load(string(target[1:]))
+	default:
+		return nil, errors.New("invalid join target type")
+	}
+
+	if !ok {
+		return nil, errors.New("no such room")
+	}
+
+	return v.(*room), nil
+}
+
+// newJoinTunnel start guest tunnel of tunnelType q/t listening on hostIP, attached to room
+// as a virtual client of its guest udp port
+func newJoinTunnel(hostIP string, tunnelType byte, r *room) (int, error) {
+
+	config := utils.TunnelConfig{
+		Address0: net.JoinHostPort(hostIP, "0"),
+		Address1: "127.0.0.1:" + strconv.Itoa(r.port),
+	}
+	switch tunnelType {
+	case 'q':
+		config.Type = utils.ListenQuicDialUdp
+	case 't':
+		config.Type = utils.ListenTcpDialUdp
+	default:
+		return 0, errors.New("no such tunnel type " + string(tunnelType))
+	}
+
+	tunnel, err := utils.NewTunnel(&config)
+	if err != nil {
+		return 0, err
+	}
+
+	r.lock.Lock()
+	r.joins = append(r.joins, tunnel)
+	r.lock.Unlock()
+
+	port, _ := tunnel.Ports()
+	loggerJoin.Infof("New guest tunnel %d for room %s", port, r.code)
+
+	go func() {
+		defer loggerJoin.Infof("End guest tunnel %d for room %s", port, r.code)
+		defer tunnel.Close()
+
+		err := tunnel.Serve(nil, nil, nil, nil)
+		if err != nil {
+			loggerJoin.WithError(err).Error("Guest tunnel serve error")
+		}
+
+		r.lock.Lock()
+		for i, t := range r.joins {
+			if t == tunnel {
+				r.joins = append(r.joins[:i], r.joins[i+1:]...)
+				break
+			}
+		}
+		r.lock.Unlock()
+	}()
+
+	return port, nil
+}
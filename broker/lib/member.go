@@ -0,0 +1,420 @@
+package broker
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerMember = logrus.WithField("broker", "member")
+
+const (
+	gossipInterval = time.Second      // one gossip round
+	suspectTimeout = 5 * time.Second  // no newer heartbeat, broker suspected
+	deadTimeout    = 15 * time.Second // no newer heartbeat, broker dead
+	forgetTimeout  = time.Minute      // dead broker removed from table
+	seedRounds     = 10               // rounds between contacting seed and dead brokers
+	gossipSizeMax  = 60000            // max digest size in NET_INFO_UPDATE
+	gossipParallel = 8                // brokers contacted at the same time in one round
+)
+
+// memberState state of broker in membership table, judged by this broker locally
+type memberState int
+
+const (
+	memberAlive memberState = iota
+	memberSuspect
+	memberDead
+)
+
+// member broker in thlink network.
+// heartbeat is bumped by the broker itself every gossip round, incarnation is its start time,
+// so (incarnation, heartbeat) only grows and a restarted broker always wins over stale gossip
+type member struct {
+	incarnation uint32
+	heartbeat   uint32
+	meta        []byte    // encoded utils.BrokerMeta
+	updated     time.Time // last time (incarnation, heartbeat) grew
+	direct      time.Time // last beat heard from the broker itself
+	state       memberState
+}
+
+// membership gossip based broker membership.
+// every round broker exchanges the whole table with a random known broker (anti-entropy),
+// seed brokers and dead brokers are retried every seedRounds so partitions heal by themselves
+type membership struct {
+	lock        sync.Mutex
+	port        int    // self port
+	advertise   string // advertised address, empty to let other brokers decide
+	id          uint64 // random broker id telling if talking to myself
+	incarnation uint32
+	heartbeat   uint32
+	round       int
+	self        map[string]bool // addresses of this broker, from config, local interfaces and reaching itself
+	seeds       []string
+	members     map[string]*member
+	sessions    map[string]*session // sessions opened by this broker
+	auth        *federationAuth
+	meta        func() []byte // encoded metadata of this broker
+}
+
+// newMembership new membership of broker listening port, advertise and seeds can be empty,
+// meta returns encoded metadata of this broker and can be nil
+func newMembership(port int, advertise string, seeds []string, auth *federationAuth, meta func() []byte) *membership {
+	if meta == nil {
+		meta = func() []byte { return nil }
+	}
+
+	self := make(map[string]bool)
+	if advertise != "" {
+		self[advertise] = true
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				self[net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port))] = true
+			}
+		}
+	}
+
+	return &membership{
+		port:        port,
+		advertise:   advertise,
+		id:          newBrokerID(),
+		incarnation: uint32(time.Now().Unix()),
+		self:        self,
+		seeds:       seeds,
+		members:     make(map[string]*member),
+		sessions:    make(map[string]*session),
+		auth:        auth,
+		meta:        meta,
+	}
+}
+
+// run gossip rounds forever
+func (m *membership) run() {
+	for {
+		m.tick(time.Now())
+
+		// heartbeat through opened sessions and push and pull digest with targets,
+		// brokers are contacted in parallel so that a black-holed one does not hold up others
+		beat, digest := m.beat(), m.digest()
+		sem := make(chan int, gossipParallel)
+		var wg sync.WaitGroup
+		contact := func(addr string, msg sessionMsg, payload []byte) {
+			wg.Add(1)
+			sem <- 1
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				err := m.send(addr, msg, payload)
+				if err != nil && msg == sessionQuery {
+					loggerMember.WithError(err).Debug("Gossip with ", addr, " failed")
+				}
+			}()
+		}
+		for _, addr := range m.connected() {
+			contact(addr, sessionHeartbeat, beat)
+		}
+		for _, addr := range m.targets() {
+			contact(addr, sessionQuery, digest)
+		}
+		wg.Wait()
+
+		time.Sleep(gossipInterval)
+	}
+}
+
+// tick bump heartbeat and update member states
+func (m *membership) tick(now time.Time) {
+	m.lock.Lock()
+
+	m.heartbeat++
+	m.round++
+
+	var forgotten []*session
+	for addr, b := range m.members {
+		age := now.Sub(b.updated)
+		switch {
+		case age > forgetTimeout:
+			loggerMember.Info("Forget broker: ", addr)
+			delete(m.members, addr)
+			if s, ok := m.sessions[addr]; ok {
+				delete(m.sessions, addr)
+				forgotten = append(forgotten, s)
+			}
+		case age > deadTimeout:
+			if b.state != memberDead {
+				loggerMember.Info("Timeout broker: ", addr)
+				b.state = memberDead
+			}
+		case age > suspectTimeout:
+			if b.state == memberAlive {
+				loggerMember.Warn("Suspect broker: ", addr)
+				b.state = memberSuspect
+			}
+		}
+	}
+
+	m.lock.Unlock()
+
+	for _, s := range forgotten {
+		s.close()
+	}
+}
+
+// connected addresses of connected sessions
+func (m *membership) connected() []string {
+	m.lock.Lock()
+	sessions := make(map[string]*session, len(m.sessions))
+	for addr, s := range m.sessions {
+		sessions[addr] = s
+	}
+	m.lock.Unlock()
+
+	var addrs []string
+	for addr, s := range sessions {
+		s.lock.Lock()
+		if s.conn != nil {
+			addrs = append(addrs, addr)
+		}
+		s.lock.Unlock()
+	}
+
+	return addrs
+}
+
+// targets brokers to gossip with this round
+func (m *membership) targets() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var live, dead []string
+	for addr, b := range m.members {
+		if b.state == memberDead {
+			dead = append(dead, addr)
+		} else {
+			live = append(live, addr)
+		}
+	}
+
+	var targets []string
+	if len(live) > 0 {
+		targets = append(targets, live[rand.Intn(len(live))])
+	}
+
+	// alone, first round or every seedRounds, contact seeds not alive and one dead broker
+	if len(live) == 0 || m.round%seedRounds == 1 {
+		for _, s := range m.seeds {
+			if a, err := net.ResolveTCPAddr("tcp", s); err == nil {
+				if b, ok := m.members[a.String()]; ok && b.state != memberDead || m.self[a.String()] {
+					continue
+				}
+			}
+			targets = append(targets, s)
+		}
+		if len(dead) > 0 {
+			targets = append(targets, dead[rand.Intn(len(dead))])
+		}
+	}
+
+	return targets
+}
+
+// beat encode self heartbeat and metadata
+//
+//	+-------------+-----------+------------+----------+
+//	| incarnation | heartbeat | meta len   | metadata |
+//	|     32      |    32     | 16         |          |
+//	+-------------+-----------+------------+----------+
+func (m *membership) beat() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.appendBeat(nil, m.incarnation, m.heartbeat, m.meta())
+}
+
+// digest encode self heartbeat and all not dead members
+//
+//	+------+-----+---------+---------+------+-----+
+//	| beat | len | address | beat    | ...  |     |
+//	|      |  8  |         |         |      |     |
+//	+------+-----+---------+---------+------+-----+
+func (m *membership) digest() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	data := m.appendBeat(nil, m.incarnation, m.heartbeat, m.meta())
+	for addr, b := range m.members {
+		if b.state == memberDead {
+			continue
+		}
+		if len(data)+1+len(addr)+10+len(b.meta) > gossipSizeMax {
+			break
+		}
+		data = append(data, byte(len(addr)))
+		data = append(data, []byte(addr)...)
+		data = m.appendBeat(data, b.incarnation, b.heartbeat, b.meta)
+	}
+
+	return data
+}
+
+func (m *membership) appendBeat(data []byte, incarnation, heartbeat uint32, meta []byte) []byte {
+	data = appendUint32(data, incarnation)
+	data = appendUint32(data, heartbeat)
+	data = append(data, byte(len(meta)>>8), byte(len(meta)))
+	return append(data, meta...)
+}
+
+// parseBeat parse beat at beginning of data, return parsed length
+func parseBeat(data []byte) (incarnation, heartbeat uint32, meta []byte, n int, err error) {
+	if len(data) < 10 {
+		return 0, 0, nil, 0, errors.New("digest broken")
+	}
+	n = 10 + int(data[8])<<8 + int(data[9])
+	if len(data) < n {
+		return 0, 0, nil, 0, errors.New("digest broken")
+	}
+
+	return binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), data[10:n], n, nil
+}
+
+// merge digest or beat received from broker at addr, direct is true if it is surely addr talking
+func (m *membership) merge(addr string, data []byte, direct bool, now time.Time) error {
+
+	type beat struct {
+		addr                   string
+		incarnation, heartbeat uint32
+		meta                   []byte
+	}
+
+	incarnation, heartbeat, meta, i, err := parseBeat(data)
+	if err != nil {
+		return err
+	}
+
+	var beats []beat
+	for i < len(data) {
+		l := int(data[i])
+		if i+1+l > len(data) {
+			return errors.New("digest broken")
+		}
+		a := string(data[i+1 : i+1+l])
+		i += 1 + l
+
+		incarnation, heartbeat, meta, n, err := parseBeat(data[i:])
+		if err != nil {
+			return err
+		}
+		i += n
+		// allowed may look up host name, not under lock
+		if m.auth.allowed(a) {
+			beats = append(beats, beat{a, incarnation, heartbeat, meta})
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.update(addr, incarnation, heartbeat, meta, direct, now)
+	for _, b := range beats {
+		if !m.self[b.addr] && b.addr != addr {
+			m.update(b.addr, b.incarnation, b.heartbeat, b.meta, false, now)
+		}
+	}
+
+	return nil
+}
+
+// update member with beat heard from the broker itself (direct) or rumoured by other brokers, lock before call.
+// Rumours only count if (incarnation, heartbeat) is newer and the broker has not talked to us lately,
+// direct beats always win, so even without network secret no broker can make another one
+// look dead by rumouring a too new beat about it
+func (m *membership) update(addr string, incarnation, heartbeat uint32, meta []byte, direct bool, now time.Time) {
+	b, ok := m.members[addr]
+	if !ok {
+		loggerMember.Info("New broker: ", addr)
+		b = &member{incarnation: incarnation, heartbeat: heartbeat, meta: append([]byte(nil), meta...), updated: now}
+		if direct {
+			b.direct = now
+		}
+		m.members[addr] = b
+		return
+	}
+
+	if direct {
+		b.direct = now
+	} else if now.Sub(b.direct) < suspectTimeout {
+		return
+	} else if incarnation < b.incarnation || incarnation == b.incarnation && heartbeat <= b.heartbeat {
+		return
+	}
+	if incarnation > b.incarnation && b.incarnation != 0 {
+		loggerMember.Info("Broker restarted: ", addr)
+	}
+	if b.state != memberAlive {
+		loggerMember.Info("Broker alive again: ", addr)
+	}
+	b.incarnation, b.heartbeat, b.updated, b.state = incarnation, heartbeat, now, memberAlive
+	b.meta = append([]byte(nil), meta...)
+}
+
+// alive addresses of alive brokers except except, sorted
+func (m *membership) alive(except string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var addrs []string
+	for addr, b := range m.members {
+		if b.state == memberAlive && addr != except {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// metadata encoded metadata of broker at addr
+func (m *membership) metadata(addr string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if b, ok := m.members[addr]; ok {
+		return b.meta
+	}
+	return nil
+}
+
+// known check if addr is a broker not dead in thlink network
+func (m *membership) known(addr string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.members[addr]
+	return ok && b.state != memberDead
+}
+
+// appendUint32 append big endian uint32 to b
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// newBrokerID random broker id
+func newBrokerID() uint64 {
+	buf := make([]byte, 8)
+	_, _ = crand.Read(buf)
+	return binary.BigEndian.Uint64(buf)
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+var loggerRelay = logrus.WithField("broker", "relay")
+
+// parseRelayTarget parse JOIN target forwarded to other broker
+//
+//	+------+-----------------+----------------+--------------+
+//	| 'f'  | 8bit address len| broker address | inner target |
+//	+------+-----------------+----------------+--------------+
+//
+// inner target is JOIN target of the other broker, see findRoom
+func parseRelayTarget(target []byte) (string, []byte, error) {
+
+	if len(target) < 2 || target[0] != 'f' || len(target) < 2+int(target[1])+2 {
+		return "", nil, errors.New("invalid relay target")
+	}
+
+	return string(target[2 : 2+int(target[1])]), target[2+int(target[1]):], nil
+}
+
+// newRelayTunnel start guest tunnel of tunnelType q/t listening on hostIP, forwarded over
+// broker-to-broker QUIC link to guest tunnel joined with target on broker.
+// The link is an ordinary public JOIN 'q' on broker, so it gets nothing a guest joining broker
+// directly would not get, and broker needs no relay support. Caller only relays to brokers in network
+func newRelayTunnel(hostIP string, tunnelType byte, broker string, target []byte) (int, error) {
+
+	host, _, err := net.SplitHostPort(broker)
+	if err != nil {
+		return 0, err
+	}
+
+	// ask for guest tunnel on broker
+	conn, err := net.DialTimeout("tcp", broker, time.Second)
+	if err != nil {
+		return 0, err
+	}
+	_, err = conn.Write(utils.NewDataFrame(utils.JOIN, append([]byte{'q'}, target...)))
+	if err != nil {
+		_ = conn.Close()
+		return 0, err
+	}
+	buf := make([]byte, utils.CmdBufSize)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, err := conn.Read(buf)
+	_ = conn.Close()
+	if err != nil {
+		return 0, err
+	}
+	dataStream := utils.NewDataStream()
+	dataStream.Append(buf[:n])
+	if !dataStream.Parse() || dataStream.Type() != utils.JOIN || dataStream.Len() < 2 {
+		return 0, errors.New("broker " + broker + " refused to join")
+	}
+	linkPort := int(dataStream.Data()[0])<<8 | int(dataStream.Data()[1])
+
+	// broker-to-broker link
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"myonTHlink"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	qConn, err := quic.DialAddrContext(ctx, net.JoinHostPort(host, strconv.Itoa(linkPort)), tlsConfig, nil)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	link, err := qConn.OpenStreamSync(context.Background())
+	if err != nil {
+		_ = qConn.CloseWithError(0, "")
+		return 0, err
+	}
+
+	// listen for guest
+	var port int
+	var accept func() (io.ReadWriteCloser, error)
+	var closeListener func()
+	switch tunnelType {
+	case 'q':
+		tlsConfig, err := utils.GenerateTLSConfig()
+		if err != nil {
+			break
+		}
+		listener, err := quic.ListenAddr(net.JoinHostPort(hostIP, "0"), tlsConfig, nil)
+		if err != nil {
+			break
+		}
+		port = listener.Addr().(*net.UDPAddr).Port
+		accept = func() (io.ReadWriteCloser, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			c, err := listener.Accept(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return c.AcceptStream(context.Background())
+		}
+		closeListener = func() {
+			_ = listener.Close()
+		}
+	case 't':
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(hostIP)})
+		if err != nil {
+			break
+		}
+		port = listener.Addr().(*net.TCPAddr).Port
+		accept = func() (io.ReadWriteCloser, error) {
+			_ = listener.SetDeadline(time.Now().Add(time.Second * 10))
+			c, err := listener.AcceptTCP()
+			if err != nil {
+				return nil, err
+			}
+			_ = c.SetNoDelay(true)
+			return c, nil
+		}
+		closeListener = func() {
+			_ = listener.Close()
+		}
+	default:
+		err = errors.New("no such tunnel type " + string(tunnelType))
+	}
+	if accept == nil {
+		_ = qConn.CloseWithError(0, "")
+		if err == nil {
+			err = errors.New("listen for guest failed")
+		}
+		return 0, err
+	}
+
+	loggerRelay.Infof("New relay tunnel %d to %s port %d", port, broker, linkPort)
+
+	go func() {
+		defer loggerRelay.Infof("End relay tunnel %d to %s port %d", port, broker, linkPort)
+		defer func() {
+			_ = qConn.CloseWithError(0, "")
+		}()
+		defer closeListener()
+
+		guest, err := accept()
+		if err != nil {
+			loggerRelay.WithError(err).Error("Get guest connection failed")
+			return
+		}
+		defer guest.Close()
+
+		ch := make(chan int, 2)
+		go func() {
+			_, _ = io.Copy(link, guest)
+			ch <- 1
+		}()
+		go func() {
+			_, _ = io.Copy(guest, link)
+			ch <- 1
+		}()
+		<-ch
+	}()
+
+	return port, nil
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerRendezvous = logrus.WithField("broker", "rendezvous")
+
+const (
+	rendezvousMax      = 16          // guests told to host of one tunnel
+	rendezvousInterval = time.Second // interval between guests told to host
+)
+
+// rendezvous exchange observed udp endpoints of host client and guests of a udp tunnel,
+// so that they can try hole punching and talk directly
+type rendezvous struct {
+	lock   sync.Mutex
+	tunnel *utils.Tunnel
+	nonce  []byte          // given to host client in TUNNEL response, PUNCH_HOST must carry it
+	host   *net.UDPAddr    // observed endpoint of host client, nil before PUNCH_HOST
+	guests map[string]bool // guest endpoints told to host
+	last   time.Time       // last guest told to host
+}
+
+// newPunchNonce new nonce for host client registering endpoint
+func newPunchNonce() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// newRendezvous new rendezvous of tunnel, host registration is refused if nonce is empty
+func newRendezvous(tunnel *utils.Tunnel, nonce string) *rendezvous {
+	return &rendezvous{
+		tunnel: tunnel,
+		nonce:  []byte(nonce),
+		guests: make(map[string]bool),
+	}
+}
+
+// punch handle hole punching package received by tunnel udp port
+func (r *rendezvous) punch(addr *net.UDPAddr, punchType utils.PunchType, data []byte) {
+
+	var err error
+
+	switch punchType {
+	case utils.PUNCH_HOST:
+		if len(r.nonce) == 0 || subtle.ConstantTimeCompare(data, r.nonce) != 1 {
+			loggerRendezvous.Warn("Refuse host endpoint ", addr.String(), " without nonce")
+			break
+		}
+
+		r.lock.Lock()
+		r.host = addr
+		r.lock.Unlock()
+
+		loggerRendezvous.Debug("Host endpoint ", addr.String())
+		err = r.tunnel.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PEER, []byte(addr.String())), addr)
+
+	case utils.PUNCH_GUEST:
+		host, tell := r.meet(addr, time.Now())
+
+		if host == nil {
+			// host not ready for direct connection or too many guests, guest stays on relay
+			err = r.tunnel.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PEER, nil), addr)
+			break
+		}
+
+		if tell {
+			loggerRendezvous.Debug("Guest endpoint ", addr.String(), " meet host ", host.String())
+			err = r.tunnel.WriteFrame(utils.RENDEZVOUS, []byte(addr.String()))
+			if err != nil {
+				break
+			}
+		}
+		err = r.tunnel.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PEER, []byte(host.String())), addr)
+
+	default:
+		loggerRendezvous.Warn("Invalid punch package from ", addr.String())
+	}
+
+	if err != nil {
+		loggerRendezvous.WithError(err).Warn("Send rendezvous data failed")
+	}
+}
+
+// meet return host endpoint for guest addr, nil if guest should stay on relay,
+// and whether addr is a new guest to tell host
+func (r *rendezvous) meet(addr *net.UDPAddr, now time.Time) (*net.UDPAddr, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.host == nil {
+		return nil, false
+	}
+	if r.guests[addr.String()] {
+		return r.host, false
+	}
+	if len(r.guests) >= rendezvousMax || now.Sub(r.last) < rendezvousInterval {
+		return nil, false
+	}
+
+	r.guests[addr.String()] = true
+	r.last = now
+
+	return r.host, true
+}
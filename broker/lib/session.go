@@ -0,0 +1,324 @@
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+)
+
+const (
+	sessionBackoffMin = time.Second      // first reconnect delay
+	sessionBackoffMax = 30 * time.Second // max reconnect delay
+	sessionIdle       = deadTimeout      // session without message closed
+)
+
+// sessionMsg first byte of NET_INFO_UPDATE frame in broker session,
+// followed by payload signed by federationAuth for hello and welcome, by sessionAuth for others
+type sessionMsg byte
+
+const (
+	sessionHello     sessionMsg = iota // self port 16bit, nonce 64bit, dialed address len, dialed address, advertised address; opens session
+	sessionWelcome                     // 64bit broker id, nonce 64bit, observed address len, observed address of session opener, advertised address
+	sessionHeartbeat                   // incarnation 32bit, heartbeat 32bit, answered with heartbeat of peer
+	sessionQuery                       // membership digest, asks for sessionUpdate
+	sessionUpdate                      // membership digest
+)
+
+// session long-lived connection to broker, opened by this broker.
+// this broker sends heartbeat and query, peer answers heartbeat and update on the same connection,
+// so a session without answer in sessionIdle is dead;
+// broken session reconnects on next send with exponential backoff
+type session struct {
+	lock  sync.Mutex
+	conn  net.Conn     // nil if not connected
+	auth  *sessionAuth // of conn
+	fails int
+	retry time.Time // no reconnect before
+}
+
+// newSessionFrame build NET_INFO_UPDATE frame of session message
+func newSessionFrame(auth messageAuth, msg sessionMsg, payload []byte) []byte {
+	return utils.NewDataFrame(utils.NET_INFO_UPDATE, append([]byte{byte(msg)}, auth.sign(byte(msg), payload)...))
+}
+
+// parseSessionFrame verify parsed NET_INFO_UPDATE frame, return session message and payload
+func parseSessionFrame(auth messageAuth, dataStream *utils.DataStream) (sessionMsg, []byte, error) {
+	if dataStream.Type() != utils.NET_INFO_UPDATE || dataStream.Len() < 1 {
+		return 0, nil, errors.New("invalid session frame")
+	}
+
+	data := dataStream.Data()
+	payload, err := auth.verify(data[0], data[1:])
+	return sessionMsg(data[0]), payload, err
+}
+
+// fail close connection and schedule reconnect, lock before call
+func (s *session) fail(conn net.Conn) {
+	if conn != s.conn {
+		return
+	}
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+
+	backoff := sessionBackoffMin << s.fails
+	if backoff > sessionBackoffMax || backoff <= 0 {
+		backoff = sessionBackoffMax
+	} else {
+		s.fails++
+	}
+	s.retry = time.Now().Add(backoff)
+}
+
+// close session
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// send message to broker at addr, open session if not connected
+func (m *membership) send(addr string, msg sessionMsg, payload []byte) error {
+
+	m.lock.Lock()
+	s, ok := m.sessions[addr]
+	if !ok {
+		s = &session{}
+		m.sessions[addr] = s
+	}
+	m.lock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		if time.Now().Before(s.retry) {
+			return errors.New("session to " + addr + " waiting for reconnect")
+		}
+
+		conn, auth, peer, err := m.open(addr)
+		if err != nil {
+			s.fail(nil)
+			return err
+		}
+		loggerMember.Info("Session to ", peer, " opened")
+		s.conn, s.auth, s.fails = conn, auth, 0
+		go m.read(s, conn, auth, peer)
+	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err := s.conn.Write(newSessionFrame(s.auth, msg, payload))
+	if err != nil {
+		loggerMember.WithError(err).Warn("Session to ", addr, " broken")
+		s.fail(s.conn)
+	}
+
+	return err
+}
+
+// open connect broker at addr and say hello,
+// return connection, its sessionAuth and address of broker in network
+func (m *membership) open(addr string) (net.Conn, *sessionAuth, string, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	remote := conn.RemoteAddr().String()
+	if !m.auth.allowed(remote) {
+		_ = conn.Close()
+		return nil, nil, "", errors.New("broker " + remote + " not allowed")
+	}
+
+	nonce := newAuthNonce()
+	hello := append([]byte{byte(m.port >> 8), byte(m.port)}, nonce...)
+	hello = append(hello, byte(len(addr)))
+	hello = append(hello, []byte(addr)...)
+	hello = append(hello, []byte(m.advertise)...)
+	_ = conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write(newSessionFrame(m.auth, sessionHello, hello))
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, "", err
+	}
+
+	dataStream := utils.NewDataStream()
+	err = readFrame(conn, dataStream, 2*time.Second)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, "", err
+	}
+	msg, welcome, err := parseSessionFrame(m.auth, dataStream)
+	if err == nil && (msg != sessionWelcome || len(welcome) < 17 || len(welcome) < 17+int(welcome[16])) {
+		err = errors.New("invalid session welcome")
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, "", err
+	}
+
+	// observed address in welcome is told by peer and not trusted,
+	// this broker only learns its own address by reaching itself
+	if binary.BigEndian.Uint64(welcome) == m.id {
+		m.knownAs(addr)
+		m.knownAs(remote)
+		_ = conn.Close()
+		return nil, nil, "", errors.New("talking to myself")
+	}
+
+	peer := remote
+	if advertise := string(welcome[17+int(welcome[16]):]); advertise != "" {
+		peer = advertise
+	}
+
+	return conn, newSessionAuth(m.auth, nonce, welcome[8:16], true), peer, nil
+}
+
+// read answers of broker at peer in session opened by this broker
+func (m *membership) read(s *session, conn net.Conn, auth *sessionAuth, peer string) {
+
+	dataStream := utils.NewDataStream()
+	direct := sameHost(peer, conn.RemoteAddr().String())
+
+	for {
+		err := readFrame(conn, dataStream, sessionIdle)
+		if err == nil {
+			var msg sessionMsg
+			var payload []byte
+			msg, payload, err = parseSessionFrame(auth, dataStream)
+			if err == nil && (msg == sessionUpdate || msg == sessionHeartbeat) {
+				err = m.merge(peer, payload, direct, time.Now())
+			}
+		}
+
+		if err != nil {
+			loggerMember.WithError(err).Debug("Session to ", peer, " closed")
+			s.lock.Lock()
+			s.fail(conn)
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// serve session opened by other broker, dataStream holds the first parsed frame
+func (m *membership) serve(conn net.Conn, dataStream *utils.DataStream) {
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !m.auth.allowed(host) {
+		loggerMember.Warn("Broker ", host, " not allowed")
+		return
+	}
+
+	var addr string
+	var direct bool               // addr is on host of conn
+	var auth messageAuth = m.auth // sessionAuth after hello
+	for {
+		msg, payload, err := parseSessionFrame(auth, dataStream)
+		if err != nil {
+			loggerMember.WithError(err).WithField("from", conn.RemoteAddr()).Warn("Invalid session message")
+			return
+		}
+
+		var resp []byte
+		switch {
+		case msg == sessionHello && addr == "" && len(payload) > 11 && len(payload) >= 11+int(payload[10]):
+			observed := net.JoinHostPort(host, strconv.Itoa(int(payload[0])<<8+int(payload[1])))
+			addr = observed
+			if advertise := string(payload[11+int(payload[10]):]); advertise != "" {
+				if !m.auth.allowed(advertise) {
+					loggerMember.Warn("Broker advertised address ", advertise, " not allowed")
+					return
+				}
+				addr = advertise
+			}
+			direct = sameHost(addr, conn.RemoteAddr().String())
+			// dialed address in hello is told by peer and not trusted, see open
+
+			nonce := newAuthNonce()
+			welcome := appendUint32(appendUint32(nil, uint32(m.id>>32)), uint32(m.id))
+			welcome = append(welcome, nonce...)
+			welcome = append(welcome, byte(len(observed)))
+			welcome = append(welcome, []byte(observed)...)
+			welcome = append(welcome, []byte(m.advertise)...)
+			resp = newSessionFrame(m.auth, sessionWelcome, welcome)
+			auth = newSessionAuth(m.auth, payload[2:10], nonce, false)
+			loggerMember.Debug("Session from ", addr, " opened")
+			defer loggerMember.Debug("Session from ", addr, " closed")
+
+		case addr == "":
+			loggerMember.WithField("from", conn.RemoteAddr()).Warn("Session not opened with hello")
+			return
+
+		case msg == sessionHeartbeat || msg == sessionQuery || msg == sessionUpdate:
+			m.lock.Lock()
+			self := m.self[addr]
+			m.lock.Unlock()
+			if !self {
+				err = m.merge(addr, payload, direct, time.Now())
+				if err != nil {
+					loggerMember.WithError(err).WithField("from", addr).Warn("Invalid membership digest")
+					return
+				}
+			}
+			switch msg {
+			case sessionHeartbeat:
+				resp = newSessionFrame(auth, sessionHeartbeat, m.beat())
+			case sessionQuery:
+				resp = newSessionFrame(auth, sessionUpdate, m.digest())
+			}
+
+		default:
+			loggerMember.WithField("from", addr).Warn("Invalid session message type ", msg)
+			return
+		}
+
+		if resp != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+			_, err = conn.Write(resp)
+			if err != nil {
+				loggerMember.WithError(err).Debug("Session from ", addr, " broken")
+				return
+			}
+		}
+
+		err = readFrame(conn, dataStream, sessionIdle)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sameHost check if broker address addr, may be host name, is on host of remote address
+func sameHost(addr string, remote string) bool {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	r, err := net.ResolveTCPAddr("tcp", remote)
+
+	return err == nil && a.IP.Equal(r.IP)
+}
+
+// knownAs record address this broker reached itself at
+func (m *membership) knownAs(addr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.self[addr] {
+		loggerMember.Info("Known as ", addr)
+		m.self[addr] = true
+		delete(m.members, addr)
+	}
+}
@@ -0,0 +1,293 @@
+package broker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerSpectate = logrus.WithField("broker", "spectate")
+
+const (
+	spectatorTimeout = 10 * time.Second // spectator without package forgotten
+	spectatorMax     = 64               // max spectators of one spectating server
+)
+
+// th12.3 package type used by spectating server
+const (
+	hello123             byte = 0x01
+	olleh123             byte = 0x03
+	chain123             byte = 0x04
+	initRequest123       byte = 0x05
+	initError123         byte = 0x07
+	quit123              byte = 0x0b
+	hostGame123          byte = 0x0d
+	clientGame123        byte = 0x0e
+	gameReplay123        byte = 0x09
+	gameReplayRequest123 byte = 0x0b
+)
+
+// spectateServer th12.3 spectating server on broker,
+// serve spectators with data pushed by host client with SPECTATE_CACHE frame
+type spectateServer struct {
+	lock sync.RWMutex
+
+	initSuccess []byte            // INIT_SUCCESS package
+	gameMatch   map[byte][]byte   // HOST_GAME GAME_MATCH package
+	replayData  map[byte][]uint16 // replay inputs, first one is garbage
+	replayEnd   map[byte]bool     // replay end
+	matchId     byte              // current match id
+	hostQuit    bool              // host client quit
+
+	spectators map[string]time.Time // spectator address and last package time
+	udpConn    *net.UDPConn
+}
+
+// newSpectateServer listen udp port for spectators
+func newSpectateServer() (*spectateServer, int, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", ":0")
+	if err != nil {
+		return nil, 0, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &spectateServer{
+		gameMatch:  make(map[byte][]byte),
+		replayData: make(map[byte][]uint16),
+		replayEnd:  make(map[byte]bool),
+		spectators: make(map[string]time.Time),
+		udpConn:    udpConn,
+	}, utils.AddrPort(udpConn.LocalAddr()), nil
+}
+
+// cacheFrame utils.FrameCallback receive SPECTATE_CACHE from host client
+func (s *spectateServer) cacheFrame(t utils.DataType, data []byte) {
+
+	if t != utils.SPECTATE_CACHE || len(data) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch utils.SpectateCacheType(data[0]) {
+	case utils.SPECTATE_INIT:
+		if len(data)-1 == 81 {
+			s.initSuccess = append([]byte{}, data[1:]...)
+			s.hostQuit = false
+		} else {
+			loggerSpectate.Warn("SPECTATE_INIT with strange length ", len(data)-1)
+		}
+
+	case utils.SPECTATE_MATCH:
+		if len(data)-1 == 99 {
+			s.matchId = data[99]
+			s.gameMatch[s.matchId] = append([]byte{}, data[1:]...)
+			s.replayData[s.matchId] = make([]uint16, 1)
+			s.replayEnd[s.matchId] = false
+			loggerSpectate.Info("Spectate cache new match ", s.matchId)
+		} else {
+			loggerSpectate.Warn("SPECTATE_MATCH with strange length ", len(data)-1)
+		}
+
+	case utils.SPECTATE_INPUT:
+		if len(data) >= 7 && (len(data)-7)%2 == 0 {
+			frameId := utils.LittleIndia2Int(data[2:6])
+			rep, ok := s.replayData[data[1]]
+			if !ok {
+				loggerSpectate.Warn("SPECTATE_INPUT with unknown match id ", data[1])
+				break
+			}
+			if frameId != len(rep) {
+				loggerSpectate.Warn("SPECTATE_INPUT start frame id ", frameId, " expect ", len(rep))
+				break
+			}
+			for i := 7; i < len(data); i += 2 {
+				rep = append(rep, uint16(data[i])<<8|uint16(data[i+1]))
+			}
+			s.replayData[data[1]] = rep
+			if data[6] != 0 {
+				s.replayEnd[data[1]] = true
+			}
+		} else {
+			loggerSpectate.Warn("SPECTATE_INPUT with strange length ", len(data))
+		}
+
+	case utils.SPECTATE_QUIT:
+		s.hostQuit = true
+
+	}
+}
+
+// serve answer spectator requests until udp connection closed
+func (s *spectateServer) serve() {
+
+	buf := make([]byte, utils.TransBufSize)
+
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			loggerSpectate.WithError(err).Debug("Spectate server read error")
+			break
+		}
+		if n == 0 {
+			continue
+		}
+
+		reply := s.handle(addr.String(), buf[:n])
+		if reply != nil {
+			_, err = s.udpConn.WriteToUDP(reply, addr)
+			if err != nil {
+				loggerSpectate.WithError(err).Warn("Spectate server write error")
+			}
+		}
+	}
+}
+
+// close stop spectating server
+func (s *spectateServer) close() {
+	_ = s.udpConn.Close()
+}
+
+// handle spectator package, return reply or nil
+func (s *spectateServer) handle(addr string, orig []byte) []byte {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ready := s.initSuccess != nil && s.matchId > 0
+
+	switch orig[0] {
+	case hello123:
+		if len(orig) == 37 && ready {
+			return []byte{olleh123}
+		}
+
+	case chain123:
+		if len(orig) == 5 && ready {
+			return []byte{chain123, 4, 0, 0, 0}
+		}
+
+	case initRequest123:
+		if len(orig) == 65 {
+			if orig[25] == 0x00 && ready {
+				if !s.watch(addr, time.Now()) {
+					loggerSpectate.Warn("Spectate cache too many spectators, refuse ", addr)
+					return []byte{initError123, 1, 0, 0, 0}
+				}
+				loggerSpectate.Info("Spectate cache new spectator ", addr)
+				return s.initSuccess
+			}
+			// game request or spectating not ready
+			return []byte{initError123, 1, 0, 0, 0}
+		}
+
+	case quit123:
+		delete(s.spectators, addr)
+
+	case clientGame123:
+		if len(orig) == 7 && orig[1] == gameReplayRequest123 && ready {
+			if !s.watch(addr, time.Now()) {
+				break
+			}
+
+			frameId := utils.LittleIndia2Int(orig[2:6])
+			if frameId == 0xffffffff {
+				return s.gameMatch[s.matchId]
+			} else if orig[6] < s.matchId {
+				// spectator is fetching earlier match, same as game host
+				// serve it from cache, or go to next cached match if not cached or finished
+				repData, ok := s.replayData[orig[6]]
+				if !ok || !s.replayEnd[orig[6]] || frameId >= len(repData)-1 {
+					nextId := orig[6] + 1
+					for ; nextId < s.matchId; nextId++ {
+						if _, ok := s.gameMatch[nextId]; ok {
+							break
+						}
+					}
+					return s.gameMatch[nextId]
+				}
+				return s.gameReplay(orig[6], frameId)
+			} else if orig[6] == s.matchId {
+				if s.hostQuit && s.replayEnd[s.matchId] && frameId >= len(s.replayData[s.matchId])-1 {
+					delete(s.spectators, addr)
+					return []byte{quit123}
+				}
+				return s.gameReplay(s.matchId, frameId)
+			}
+		}
+
+	}
+
+	return nil
+}
+
+// watch record package time of spectator at addr, silent spectators are forgotten before adding new one,
+// return false if there are too many spectators, lock before call
+func (s *spectateServer) watch(addr string, now time.Time) bool {
+
+	if _, ok := s.spectators[addr]; !ok {
+		for a, t := range s.spectators {
+			if now.Sub(t) > spectatorTimeout {
+				delete(s.spectators, a)
+			}
+		}
+		if len(s.spectators) >= spectatorMax {
+			return false
+		}
+	}
+	s.spectators[addr] = now
+
+	return true
+}
+
+// gameReplay make HOST_GAME GAME_REPLAY package of matchId after frameId, lock before call
+func (s *spectateServer) gameReplay(matchId byte, frameId int) []byte {
+
+	repData := s.replayData[matchId]
+	endFrameId := len(repData) - 1
+	sendFrameId := endFrameId
+	if frameId+60 < sendFrameId {
+		sendFrameId = frameId + 60
+	}
+
+	var gameInput []byte
+	for i := sendFrameId; i > frameId; i-- {
+		gameInput = append(gameInput, byte(repData[i]>>8), byte(repData[i]))
+	}
+
+	// frameId endFrameId matchId inputCount inputs
+	gameInput = append([]byte{matchId, byte(len(gameInput) >> 1)}, gameInput...)
+	if s.replayEnd[matchId] {
+		if frameId == 0 && matchId == s.matchId {
+			// spectator finish fetching data
+			gameInput = []byte{matchId, 0}
+			sendFrameId = 0
+		}
+		gameInput = append([]byte{byte(endFrameId), byte(endFrameId >> 8), byte(endFrameId >> 16), byte(endFrameId >> 24)}, gameInput...)
+	} else {
+		gameInput = append([]byte{0, 0, 0, 0}, gameInput...)
+	}
+	gameInput = append([]byte{byte(sendFrameId), byte(sendFrameId >> 8), byte(sendFrameId >> 16), byte(sendFrameId >> 24)}, gameInput...)
+
+	var zlibData bytes.Buffer
+	zlibw := zlib.NewWriter(&zlibData)
+	_, err := zlibw.Write(gameInput)
+	if err != nil {
+		loggerSpectate.WithError(err).Error("Spectate cache zlib compress error")
+	}
+	_ = zlibw.Close()
+
+	data := []byte{hostGame123, gameReplay123, byte(zlibData.Len())}
+	return append(data, zlibData.Bytes()...)
+}
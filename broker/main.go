@@ -3,16 +3,26 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	broker "github.com/weilinfox/youmu-thlink/broker/lib"
+	"github.com/weilinfox/youmu-thlink/utils"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 
-	listenHost := flag.String("s", "0.0.0.0:4646", "listen hostname")
-	upperHost := flag.String("u", "", "upper broker hostname")
+	listenHost := flag.String("s", ":4646", "listen hostname, all IPv4 and IPv6 addresses by default")
+	seedHosts := flag.String("u", "", "seed broker hostnames in thlink network, separated by comma")
+	advertise := flag.String("advertise", "", "public host:port of this broker for brokers and clients, if behind NAT or proxy")
+	secret := flag.String("k", os.Getenv("THLINK_SECRET"), "shared secret of thlink network signing broker messages, default $THLINK_SECRET")
+	allowHosts := flag.String("allow", "", "IP or CIDR of brokers allowed to join, separated by comma, empty allows all")
+	name := flag.String("name", "", "broker display name in network discovery")
+	region := flag.String("region", "", "broker region in network discovery, like cn-east")
+	contact := flag.String("contact", "", "operator contact in network discovery")
+	capacity := flag.Int("capacity", 0, "max tunnels, 0 for unlimited")
 	debug := flag.Bool("d", false, "debug mode")
 
 	flag.Parse()
@@ -23,9 +33,31 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 
-	broker.Main(*listenHost, *upperHost)
+	broker.Main(*listenHost, broker.Federation{
+		Seeds:     splitList(*seedHosts),
+		Advertise: *advertise,
+		Secret:    *secret,
+		Allow:     splitList(*allowHosts),
+		Meta: utils.BrokerMeta{
+			Name:     *name,
+			Region:   *region,
+			Contact:  *contact,
+			Capacity: *capacity,
+		},
+	})
 
 	fmt.Println("Enter to quit")
 	_, _ = fmt.Scanln()
 
 }
+
+// splitList split comma separated list, drop empty items
+func splitList(list string) []string {
+	var items []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
+	}
+	return items
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	client "github.com/weilinfox/youmu-thlink/client/lib"
+	"github.com/weilinfox/youmu-thlink/client/lib/config"
 	"github.com/weilinfox/youmu-thlink/glg-go"
 	"github.com/weilinfox/youmu-thlink/utils"
 
@@ -26,12 +28,15 @@ type status struct {
 	localPort  int
 	serverHost string
 	tunnelType string
+	game       string
+	direct     bool // try direct connection with guests
 
 	userConfigChange bool
 
-	client    *client.Client
-	plugin    interface{}
-	pluginNum int
+	client      *client.Client
+	plugin      interface{}
+	pluginNum   int
+	saveHistory bool // write match history, opt-in for this session
 
 	brokerTVersion byte
 	brokerVersion  string
@@ -61,6 +66,9 @@ var clientStatus = status{
 	pluginDelayShow:  false,
 }
 
+// clientConfig config file shared with command line client
+var clientConfig = config.New(config.DefaultPath())
+
 func main() {
 
 	logrus.SetLevel(logrus.DebugLevel)
@@ -76,6 +84,11 @@ func main() {
 		logger.WithError(err).Error("Get icon error")
 	}
 
+	clientConfig, err = config.Load(config.DefaultPath())
+	if err != nil {
+		logger.WithError(err).Error("Load config error")
+	}
+
 	app.Connect("activate", onAppActivate)
 
 	app.Run(os.Args)
@@ -131,8 +144,12 @@ func onAppActivate(app *gtk.Application) {
 	}
 	menu := glib.MenuNew()
 	menu.Append("Reset config", "app.reset")
+	menu.Append("Profiles", "app.profiles")
 	menu.Append("Network discovery", "app.net-disc")
+	menu.Append("Network diagnostics", "app.net-diag")
 	menu.Append("Tunnel status", "app.t-status")
+	menu.Append("Match history", "app.history")
+	menu.Append("Save match history", "app.save-history")
 	menu.Append("About thlink", "app.about")
 	menu.Append("Quit", "app.quit")
 	menuBtn.SetMenuModel(&menu.MenuModel)
@@ -209,7 +226,7 @@ func onAppActivate(app *gtk.Application) {
 		}
 
 		// once per second
-		switch p := clientStatus.plugin.(type) {
+		switch p := currentPlugin().(type) {
 		case *client.Hisoutensoku:
 			clientStatus.pluginDelayShow = true
 			if p.PeerStatus == client.BATTLE_123 {
@@ -314,6 +331,17 @@ func onAppActivate(app *gtk.Application) {
 		logger.WithError(err).Fatal("Could not create protocol radio button QUIC.")
 	}
 	protoRadioBox.Add(protoRadioQuic)
+	directCheck, err := gtk.CheckButtonNewWithLabel("Direct")
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create direct check button.")
+	}
+	directCheck.SetTooltipText("Try direct connection with guests joined with thlink guest command,\nbroker relay is used if hole punching failed")
+	directCheck.Connect("toggled", func(c *gtk.CheckButton) {
+		clientStatus.direct = c.GetActive()
+		clientStatus.userConfigChange = true
+		logger.Debug("Direct change to ", clientStatus.direct)
+	})
+	protoRadioBox.Add(directCheck)
 	protoRadioBox.SetHAlign(gtk.ALIGN_CENTER)
 
 	// plugin choose
@@ -339,6 +367,19 @@ func onAppActivate(app *gtk.Application) {
 		}
 	})
 	pluginRadioBox.Add(pluginRadioOff)
+	pluginRadio105, err := gtk.RadioButtonNewWithLabelFromWidget(pluginRadioOff, "TH105")
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create plugin radio button 105.")
+	}
+	pluginRadio105.Connect("toggled", func(r *gtk.RadioButton) {
+		if r.GetActive() {
+			clientStatus.pluginNum = 105
+			clientStatus.userConfigChange = true
+			localPortEntry.SetText(strconv.Itoa(catalogPort("th105")))
+			logger.Debug("Plugin change to 105")
+		}
+	})
+	pluginRadioBox.Add(pluginRadio105)
 	pluginRadio123, err := gtk.RadioButtonNewWithLabelFromWidget(pluginRadioOff, "TH123")
 	if err != nil {
 		logger.WithError(err).Fatal("Could not create plugin radio button 123.")
@@ -347,7 +388,7 @@ func onAppActivate(app *gtk.Application) {
 		if r.GetActive() {
 			clientStatus.pluginNum = 123
 			clientStatus.userConfigChange = true
-			localPortEntry.SetText(strconv.Itoa(client.DefaultLocalPort))
+			localPortEntry.SetText(strconv.Itoa(catalogPort("th123")))
 			logger.Debug("Plugin change to 123")
 		}
 	})
@@ -360,7 +401,7 @@ func onAppActivate(app *gtk.Application) {
 		if r.GetActive() {
 			clientStatus.pluginNum = 155
 			clientStatus.userConfigChange = true
-			localPortEntry.SetText(strconv.Itoa(client.DefaultLocalPort))
+			localPortEntry.SetText(strconv.Itoa(catalogPort("th155")))
 			logger.Debug("Plugin change to 155")
 		}
 	})
@@ -373,13 +414,101 @@ func onAppActivate(app *gtk.Application) {
 		if r.GetActive() {
 			clientStatus.pluginNum = 1
 			clientStatus.userConfigChange = true
-			localPortEntry.SetText("3010")
+			localPortEntry.SetText(strconv.Itoa(catalogPort("lakey")))
 			logger.Debug("Plugin change to 1")
 		}
 	})
 	pluginRadioBox.Add(pluginRadioLakey)
+	pluginRadioAuto, err := gtk.RadioButtonNewWithLabelFromWidget(pluginRadio123, "Auto")
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create plugin radio button auto.")
+	}
+	pluginRadioAuto.Connect("toggled", func(r *gtk.RadioButton) {
+		if r.GetActive() {
+			clientStatus.pluginNum = client.PluginAuto
+			clientStatus.userConfigChange = true
+			localPortEntry.SetText(strconv.Itoa(client.DefaultLocalPort))
+			logger.Debug("Plugin change to auto")
+		}
+	})
+	pluginRadioBox.Add(pluginRadioAuto)
 	pluginRadioBox.SetHAlign(gtk.ALIGN_CENTER)
 
+	// game choose
+	gameCombo, err := gtk.ComboBoxTextNew()
+	if err != nil {
+		logger.WithError(err).Fatal("Could not create game combo box.")
+	}
+	gameCombo.Append("", "Choose game")
+	for _, g := range client.Catalog {
+		gameCombo.Append(g.Id, g.Id+" "+g.Name)
+	}
+	gameCombo.SetActiveID("")
+	gameCombo.Connect("changed", func(c *gtk.ComboBoxText) {
+		clientStatus.game = c.GetActiveID()
+		g, ok := client.CatalogGame(clientStatus.game)
+		if !ok {
+			return
+		}
+
+		switch {
+		case g.Id == "lakey":
+			pluginRadioLakey.SetActive(true)
+		case g.Plugin == 105:
+			pluginRadio105.SetActive(true)
+		case g.Plugin == 123:
+			pluginRadio123.SetActive(true)
+		case g.Plugin == 155:
+			pluginRadio155.SetActive(true)
+		default:
+			pluginRadioOff.SetActive(true)
+		}
+		localPortEntry.SetText(strconv.Itoa(g.Port))
+		clientStatus.userConfigChange = true
+
+		tooltip := g.Transport
+		if len(g.Tools) > 0 {
+			tooltip += "\nHelper tools: " + strings.Join(g.Tools, ", ")
+		}
+		c.SetTooltipText(tooltip)
+
+		logger.Debug("Game change to ", g.Id)
+	})
+	gameCombo.SetMarginTop(10)
+
+	// applyProfile set up widgets with profile
+	applyProfile := func(p config.Profile) {
+		gameCombo.SetActiveID(p.Game)
+
+		plugin := p.Plugin
+		if strings.EqualFold(p.Game, "lakey") && plugin == 0 {
+			plugin = 1
+		}
+		switch plugin {
+		case 105:
+			pluginRadio105.SetActive(true)
+		case 123:
+			pluginRadio123.SetActive(true)
+		case 155:
+			pluginRadio155.SetActive(true)
+		case 1:
+			pluginRadioLakey.SetActive(true)
+		case client.PluginAuto:
+			pluginRadioAuto.SetActive(true)
+		default:
+			pluginRadioOff.SetActive(true)
+		}
+
+		if strings.ToLower(p.TunnelType) == "quic" {
+			protoRadioQuic.SetActive(true)
+		} else {
+			protoRadioTcp.SetActive(true)
+		}
+		directCheck.SetActive(p.Direct)
+		serverEntry.SetText(p.Server)
+		localPortEntry.SetText(strconv.Itoa(p.LocalPort))
+	}
+
 	// peer address label
 	peerLabel, err := gtk.LabelNew("Peer IP")
 	if err != nil {
@@ -412,6 +541,12 @@ func onAppActivate(app *gtk.Application) {
 			return
 		}
 
+		if clientStatus.direct && clientStatus.pluginNum != 0 {
+			// direct path bypasses plugin
+			showErrorDialog(appWindow, "Connect failed", errors.New("direct connection does not work with plugin"))
+			return
+		}
+
 		err := onConfigUpdate()
 		if err != nil {
 			logger.WithError(err).Error("Connect failed")
@@ -427,14 +562,35 @@ func onAppActivate(app *gtk.Application) {
 		}
 
 		addrLabel.SetText(clientStatus.client.PeerHost())
+		if code := clientStatus.client.RoomCode(); code != "" {
+			addrLabel.SetTooltipText("Room code " + code + "\nGuests can join with: client join -s " +
+				clientStatus.client.ServerHost() + " " + code)
+		} else {
+			addrLabel.SetTooltipText("")
+		}
+
+		if clientConfig.SetLastUsed(currentProfile("")) {
+			err = clientConfig.Save()
+			if err != nil {
+				logger.WithError(err).Error("Save config error")
+			}
+		}
 
 		go func() {
 			var err error
 
 			switch clientStatus.pluginNum {
+			case 105:
+				logger.Info("Append th10.5 scarlet weather rhapsody plugin")
+				h := client.NewScarletWeatherRhapsody()
+				h.SetMatchHistory(matchHistory())
+				clientStatus.plugin = h
+				err = clientStatus.client.Serve(h.ReadFunc, h.WriteFunc, h.GoroutineFunc, h.SetQuitFlag)
+
 			case 123:
 				logger.Info("Append th12.3 hisoutensoku plugin")
 				h := client.NewHisoutensoku()
+				h.SetMatchHistory(matchHistory())
 				clientStatus.plugin = h
 				err = clientStatus.client.Serve(h.ReadFunc, h.WriteFunc, h.GoroutineFunc, h.SetQuitFlag)
 
@@ -444,6 +600,17 @@ func onAppActivate(app *gtk.Application) {
 				clientStatus.plugin = h
 				err = clientStatus.client.Serve(h.ReadFunc, h.WriteFunc, h.GoroutineFunc, h.SetQuitFlag)
 
+			case client.PluginAuto:
+				logger.Info("Append game auto detection plugin")
+				a := client.NewAutoPlugin()
+				a.SetDetectFunc(func(_ int, p client.Plugin) {
+					if h, ok := p.(*client.Hisoutensoku); ok {
+						h.SetMatchHistory(matchHistory())
+					}
+				})
+				clientStatus.plugin = a
+				err = clientStatus.client.Serve(a.ReadFunc, a.WriteFunc, a.GoroutineFunc, a.SetQuitFlag)
+
 			default:
 				clientStatus.plugin = nil
 				err = clientStatus.client.Serve(nil, nil, nil, nil)
@@ -523,27 +690,192 @@ func onAppActivate(app *gtk.Application) {
 	// reset action
 	aReset := glib.SimpleActionNew("reset", nil)
 	aReset.Connect("activate", func() {
-		serverEntry.SetText(client.DefaultServerHost)
-		localPortEntry.SetText(strconv.Itoa(client.DefaultLocalPort))
-		protoRadioTcp.SetActive(true)
-		pluginRadioOff.SetActive(true)
+		applyProfile(config.DefaultProfile())
 	})
 	app.AddAction(aReset)
 
+	// profiles and favourite brokers action
+	aProfiles := glib.SimpleActionNew("profiles", nil)
+	aProfiles.Connect("activate", func() {
+
+		showProfilesDialog := func() error {
+
+			// setup dialog with button
+			dialog, err := gtk.DialogNew()
+			if err != nil {
+				return err
+			}
+			dialog.SetIcon(icon)
+			dialog.SetTitle("Profiles")
+			btn, err := dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+			if err != nil {
+				return err
+			}
+			btn.Connect("clicked", func() {
+				dialog.Destroy()
+			})
+
+			dialogBox, err := dialog.GetContentArea()
+			if err != nil {
+				return err
+			}
+			dialogBox.SetSpacing(10)
+			dialogBox.SetBorderWidth(10)
+
+			saveConfig := func() {
+				err := clientConfig.Save()
+				if err != nil {
+					showErrorDialog(appWindow, "Save config error", err)
+				}
+			}
+
+			// profiles
+			profileLabel, err := gtk.LabelNew("Profile")
+			if err != nil {
+				return err
+			}
+			profileLabel.SetHAlign(gtk.ALIGN_START)
+			profileCombo, err := gtk.ComboBoxTextNewWithEntry()
+			if err != nil {
+				return err
+			}
+			refreshProfiles := func() {
+				profileCombo.RemoveAll()
+				for _, name := range clientConfig.ProfileNames() {
+					profileCombo.AppendText(name)
+				}
+			}
+			refreshProfiles()
+
+			profileBtnBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 10)
+			if err != nil {
+				return err
+			}
+			loadBtn, err := gtk.ButtonNewWithLabel("Load")
+			if err != nil {
+				return err
+			}
+			loadBtn.Connect("clicked", func() {
+				name := profileCombo.GetActiveText()
+				p, ok := clientConfig.Profile(name)
+				if !ok {
+					showErrorDialog(appWindow, "Load profile error", errors.New("no such profile "+name))
+					return
+				}
+				applyProfile(p)
+				logger.Debug("Load profile ", name)
+			})
+			saveBtn, err := gtk.ButtonNewWithLabel("Save")
+			if err != nil {
+				return err
+			}
+			saveBtn.Connect("clicked", func() {
+				err := clientConfig.SetProfile(currentProfile(profileCombo.GetActiveText()))
+				if err != nil {
+					showErrorDialog(appWindow, "Save profile error", err)
+					return
+				}
+				saveConfig()
+				refreshProfiles()
+			})
+			deleteBtn, err := gtk.ButtonNewWithLabel("Delete")
+			if err != nil {
+				return err
+			}
+			deleteBtn.Connect("clicked", func() {
+				if clientConfig.DeleteProfile(profileCombo.GetActiveText()) {
+					saveConfig()
+					refreshProfiles()
+				}
+			})
+			profileBtnBox.Add(loadBtn)
+			profileBtnBox.Add(saveBtn)
+			profileBtnBox.Add(deleteBtn)
+			profileBtnBox.SetHAlign(gtk.ALIGN_CENTER)
+
+			// favourite brokers
+			favLabel, err := gtk.LabelNew("Favourite brokers")
+			if err != nil {
+				return err
+			}
+			favLabel.SetHAlign(gtk.ALIGN_START)
+			favLabel.SetMarginTop(10)
+			favCombo, err := gtk.ComboBoxTextNew()
+			if err != nil {
+				return err
+			}
+			refreshFavourites := func() {
+				favCombo.RemoveAll()
+				for _, f := range clientConfig.Favourites {
+					favCombo.AppendText(f)
+				}
+				favCombo.SetActive(0)
+			}
+			refreshFavourites()
+
+			favBtnBox, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 10)
+			if err != nil {
+				return err
+			}
+			useBtn, err := gtk.ButtonNewWithLabel("Use")
+			if err != nil {
+				return err
+			}
+			useBtn.Connect("clicked", func() {
+				if host := favCombo.GetActiveText(); host != "" {
+					serverEntry.SetText(host)
+				}
+			})
+			addBtn, err := gtk.ButtonNewWithLabel("Add current")
+			if err != nil {
+				return err
+			}
+			addBtn.Connect("clicked", func() {
+				clientConfig.AddFavourite(clientStatus.serverHost)
+				saveConfig()
+				refreshFavourites()
+			})
+			removeBtn, err := gtk.ButtonNewWithLabel("Remove")
+			if err != nil {
+				return err
+			}
+			removeBtn.Connect("clicked", func() {
+				if clientConfig.RemoveFavourite(favCombo.GetActiveText()) {
+					saveConfig()
+					refreshFavourites()
+				}
+			})
+			favBtnBox.Add(useBtn)
+			favBtnBox.Add(addBtn)
+			favBtnBox.Add(removeBtn)
+			favBtnBox.SetHAlign(gtk.ALIGN_CENTER)
+
+			dialogBox.Add(profileLabel)
+			dialogBox.Add(profileCombo)
+			dialogBox.Add(profileBtnBox)
+			dialogBox.Add(favLabel)
+			dialogBox.Add(favCombo)
+			dialogBox.Add(favBtnBox)
+
+			dialog.SetDefaultSize(320, 250)
+			dialog.ShowAll()
+
+			return nil
+		}
+
+		err = showProfilesDialog()
+		if err != nil {
+			showErrorDialog(appWindow, "Show profiles dialog error", err)
+		}
+	})
+	app.AddAction(aProfiles)
+
 	// net discover action
 	aNetDisc := glib.SimpleActionNew("net-disc", nil)
 	aNetDisc.Connect("activate", func() {
 
-		// showNetInfoDialog show network delay info dialog
-		showNetInfoDialog := func(infoMap map[int]string) error {
-			// prepare data
-			sortDelay := make([]int, len(infoMap))
-			i := 0
-			for k := range infoMap {
-				sortDelay[i] = k
-				i++
-			}
-			sort.Ints(sortDelay)
+		// showNetInfoDialog show ranked brokers dialog
+		showNetInfoDialog := func(brokers []client.BrokerProbe) error {
 
 			// setup dialog with button
 			dialog, err := gtk.DialogNew()
@@ -577,37 +909,59 @@ func onAppActivate(app *gtk.Application) {
 			if err != nil {
 				return err
 			}
-			serverColumn, err := gtk.TreeViewColumnNewWithAttribute("Server", cellRenderer, "text", 0)
-			if err != nil {
-				return err
-			}
-			delayColumn, err := gtk.TreeViewColumnNewWithAttribute("Delay", cellRenderer, "text", 1)
-			if err != nil {
-				return err
+			titles := []string{"Server", "Name", "Region", "Delay", "Jitter", "Loss", "Users"}
+			for i, title := range titles {
+				column, err := gtk.TreeViewColumnNewWithAttribute(title, cellRenderer, "text", i)
+				if err != nil {
+					return err
+				}
+				infoTreeView.AppendColumn(column)
 			}
-			infoListStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING)
+			// last column is metadata tooltip
+			infoListStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING,
+				glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
 			if err != nil {
 				return err
 			}
-			infoTreeView.AppendColumn(serverColumn)
-			infoTreeView.AppendColumn(delayColumn)
 			infoTreeView.SetModel(infoListStore)
+			infoTreeView.SetTooltipColumn(len(titles))
 			infoTreeView.Connect("row-activated", func(_ *gtk.TreeView, p *gtk.TreePath, _ *gtk.TreeViewColumn) {
 
 				i := p.GetIndices()[0]
 				logger.Debug("Net server selected ", i)
 
-				serverEntry.SetText(infoMap[sortDelay[i]])
+				serverEntry.SetText(brokers[i].Address)
 
 				dialog.Destroy()
 
 			})
 
-			// append data
-			for _, k := range sortDelay {
-				logger.Debug("Append server info ", infoMap[k], " delay ", k)
+			// append data, ranked
+			markupEscaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+			for _, b := range brokers {
+				logger.Debug("Append server info ", b.Address, " delay ", b.Median)
+				delay, jitter, users := "-", "-", "-"
+				if b.Reachable {
+					delay = fmt.Sprintf("%.3fms", float64(b.Median)/1000000)
+					jitter = fmt.Sprintf("%.3fms", float64(b.Jitter)/1000000)
+				}
+				if b.UserCount >= 0 {
+					users = strconv.Itoa(b.UserCount)
+				}
+				var name, region, tooltip string
+				if b.Meta != nil {
+					name, region = b.Meta.Name, b.Meta.Region
+					if b.Meta.Capacity > 0 {
+						users += "/" + strconv.Itoa(b.Meta.Capacity)
+					}
+					tooltip = "Version " + b.Meta.Version + ", transports " + strings.Join(b.Meta.Transports, ", ")
+					if b.Meta.Contact != "" {
+						tooltip += ", contact " + b.Meta.Contact
+					}
+				}
 				iter := infoListStore.Append()
-				err = infoListStore.Set(iter, []int{0, 1}, []interface{}{infoMap[k], fmt.Sprintf("%.3fms", float64(k)/1000000)})
+				err = infoListStore.Set(iter, []int{0, 1, 2, 3, 4, 5, 6, 7}, []interface{}{b.Address, name, region,
+					delay, jitter, fmt.Sprintf("%.0f%%", b.Loss*100), users, markupEscaper.Replace(tooltip)})
 				if err != nil {
 					return err
 				}
@@ -626,47 +980,162 @@ func onAppActivate(app *gtk.Application) {
 		}
 
 		go func() {
-			infoMap, err := client.NetBrokerDelay(client.DefaultServerHost)
+			brokers, err := client.RankNetBrokers(client.DefaultServerHost, clientConfig.RankPolicy)
 			if err != nil {
 				logger.WithError(err).Warn("Get network broker delay error")
 
-				userServer, err := serverEntry.GetText()
-				if err != nil {
-					logger.WithError(err).Warn("Get server entry text error")
-					return
-				}
-
-				infoMap, err = client.NetBrokerDelay(userServer)
-
+				brokers, err = client.RankNetBrokers(clientStatus.serverHost, clientConfig.RankPolicy)
 				if err != nil {
 					glib.IdleAdd(func() bool {
 						showErrorDialog(appWindow, "Net discovery Failed", err)
 						return false
 					})
+					return
 				}
 			}
 
 			// show net discovery dialog
-			infoMapCov := make(map[int]string)
-			for k, v := range infoMap {
-				infoMapCov[v] = k
+			logger.Debug("Show net discovery dialog")
+			glib.IdleAdd(func() bool {
+				err := showNetInfoDialog(brokers)
+				if err != nil {
+					showErrorDialog(appWindow, "Show info discovery dialog error", err)
+				}
+				return false
+			})
+		}()
+
+	})
+	app.AddAction(aNetDisc)
+
+	// network diagnostics
+	aNetDiag := glib.SimpleActionNew("net-diag", nil)
+	aNetDiag.Connect("activate", func() {
+
+		// showNetDiagDialog show NAT detection report dialog
+		showNetDiagDialog := func(report *client.NatReport) error {
+
+			// setup dialog with button
+			dialog, err := gtk.DialogNew()
+			if err != nil {
+				return err
+			}
+			dialog.SetIcon(icon)
+			dialog.SetTitle("Network diagnostics")
+			btn, err := dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+			if err != nil {
+				return err
 			}
-			if err == nil {
-				logger.Debug("Show net discovery dialog")
+			btn.Connect("clicked", func() {
+				dialog.Destroy()
+			})
 
-				glib.IdleAdd(func() bool {
-					err = showNetInfoDialog(infoMapCov)
+			dialogBox, err := dialog.GetContentArea()
+			if err != nil {
+				return err
+			}
+
+			// summary
+			summaryGrid, err := gtk.GridNew()
+			if err != nil {
+				return err
+			}
+			summaryGrid.SetColumnSpacing(20)
+			summaryGrid.SetMarginStart(10)
+			summaryGrid.SetMarginEnd(10)
+			summary := [][2]string{
+				{"NAT type", string(report.Type)},
+				{"Local address", report.LocalAddr},
+				{"Public address", report.PublicAddr},
+				{"Change port answer", strconv.FormatBool(report.ChangePort)},
+			}
+			for i, row := range summary {
+				for j, text := range row {
+					label, err := gtk.LabelNew(text)
 					if err != nil {
-						showErrorDialog(appWindow, "Show info discovery dialog error", err)
+						return err
 					}
+					label.SetHAlign(gtk.ALIGN_START)
+					summaryGrid.Attach(label, j, i, 1, 1)
+				}
+			}
+			dialogBox.Add(summaryGrid)
+
+			// mappings
+			infoTreeView, err := gtk.TreeViewNew()
+			if err != nil {
+				return err
+			}
+			cellRenderer, err := gtk.CellRendererTextNew()
+			if err != nil {
+				return err
+			}
+			titles := []string{"Broker", "Observed", "RTT"}
+			for i, title := range titles {
+				column, err := gtk.TreeViewColumnNewWithAttribute(title, cellRenderer, "text", i)
+				if err != nil {
+					return err
+				}
+				infoTreeView.AppendColumn(column)
+			}
+			infoListStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+			if err != nil {
+				return err
+			}
+			infoTreeView.SetModel(infoListStore)
+			for _, m := range report.Mappings {
+				mapped, rtt := "no answer", "-"
+				if m.Mapped != "" {
+					mapped = m.Mapped
+					rtt = fmt.Sprintf("%.3fms", m.RttMs)
+				}
+				iter := infoListStore.Append()
+				err = infoListStore.Set(iter, []int{0, 1, 2}, []interface{}{m.Target, mapped, rtt})
+				if err != nil {
+					return err
+				}
+			}
+			infoTreeView.SetMarginTop(10)
+			dialogBox.Add(infoTreeView)
+
+			hint := "Direct connection is unlikely to work, broker relay will be used"
+			if report.PunchFriendly() {
+				hint = "Direct connection is likely to work"
+			}
+			hintLabel, err := gtk.LabelNew(hint)
+			if err != nil {
+				return err
+			}
+			hintLabel.SetMarginTop(10)
+			dialogBox.Add(hintLabel)
+
+			dialog.ShowAll()
+
+			return nil
+		}
+
+		go func() {
+			report, err := client.DiagnoseNat(clientStatus.serverHost)
+			if err != nil {
+				glib.IdleAdd(func() bool {
+					showErrorDialog(appWindow, "Network diagnostics failed", err)
 					return false
 				})
-
+				return
 			}
+
+			logger.Debug("Show network diagnostics dialog")
+			glib.IdleAdd(func() bool {
+				err := showNetDiagDialog(report)
+				if err != nil {
+					showErrorDialog(appWindow, "Show network diagnostics dialog error", err)
+				}
+				return false
+			})
 		}()
 
 	})
-	app.AddAction(aNetDisc)
+	app.AddAction(aNetDiag)
 
 	// tunnel status
 	aTStatus := glib.SimpleActionNew("t-status", nil)
@@ -710,7 +1179,7 @@ func onAppActivate(app *gtk.Application) {
 					float64(clientStatus.delay[pos].Nanoseconds())/1000000)
 
 				if clientStatus.pluginDelayShow {
-					switch p := clientStatus.plugin.(type) {
+					switch p := currentPlugin().(type) {
 					case *client.Hisoutensoku:
 						if p.PeerStatus == client.BATTLE_123 {
 							glg.GlgLineGraphDataSeriesAddValue(1, float64(p.GetReplayDelay().Nanoseconds())/1000000)
@@ -761,6 +1230,109 @@ func onAppActivate(app *gtk.Application) {
 	})
 	app.AddAction(aTStatus)
 
+	// match history
+	aHistory := glib.SimpleActionNew("history", nil)
+	aHistory.Connect("activate", func() {
+
+		showHistoryDialog := func() error {
+
+			records, err := client.ReadMatchHistory(client.DefaultHistoryPath())
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			// setup dialog with button
+			dialog, err := gtk.DialogNew()
+			if err != nil {
+				return err
+			}
+			dialog.SetIcon(icon)
+			dialog.SetTitle("Match history")
+			btn, err := dialog.AddButton("Close", gtk.RESPONSE_CLOSE)
+			if err != nil {
+				return err
+			}
+			btn.Connect("clicked", func() {
+				dialog.Destroy()
+			})
+
+			historyTreeView, err := gtk.TreeViewNew()
+			if err != nil {
+				return err
+			}
+			scrolledWindow, err := gtk.ScrolledWindowNew(nil, nil)
+			if err != nil {
+				return err
+			}
+			scrolledWindow.SetVExpand(true)
+			scrolledWindow.Add(historyTreeView)
+
+			// setup dialog with TreeView
+			dialogBox, err := dialog.GetContentArea()
+			if err != nil {
+				return err
+			}
+			dialogBox.Add(scrolledWindow)
+
+			// setup TreeView
+			cellRenderer, err := gtk.CellRendererTextNew()
+			if err != nil {
+				return err
+			}
+			titles := []string{"Time", "Host", "Client", "Stage", "Frames", "Ended", "Spectators"}
+			for i, title := range titles {
+				column, err := gtk.TreeViewColumnNewWithAttribute(title, cellRenderer, "text", i)
+				if err != nil {
+					return err
+				}
+				historyTreeView.AppendColumn(column)
+			}
+			historyListStore, err := gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING,
+				glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_STRING)
+			if err != nil {
+				return err
+			}
+			historyTreeView.SetModel(historyListStore)
+
+			// append data, latest first
+			for i := len(records) - 1; i >= 0; i-- {
+				r := records[i]
+				iter := historyListStore.Append()
+				err = historyListStore.Set(iter, []int{0, 1, 2, 3, 4, 5, 6}, []interface{}{
+					r.Time.Local().Format("2006-01-02 15:04"),
+					r.Host.Profile + " (" + r.Host.CharacterName + ")",
+					r.Client.Profile + " (" + r.Client.CharacterName + ")",
+					strconv.Itoa(r.StageId),
+					strconv.Itoa(r.FrameCount),
+					strconv.FormatBool(r.Ended),
+					strconv.Itoa(r.Spectators)})
+				if err != nil {
+					return err
+				}
+			}
+
+			dialog.SetDefaultSize(600, 400)
+			dialog.ShowAll()
+
+			return nil
+		}
+
+		err = showHistoryDialog()
+		if err != nil {
+			showErrorDialog(appWindow, "Show match history dialog error", err)
+		}
+	})
+	app.AddAction(aHistory)
+
+	// match history opt-in, takes effect on next connect
+	aSaveHistory := glib.SimpleActionNewStateful("save-history", nil, glib.VariantFromBoolean(clientStatus.saveHistory))
+	aSaveHistory.Connect("activate", func() {
+		clientStatus.saveHistory = !aSaveHistory.GetState().GetBoolean()
+		aSaveHistory.SetState(glib.VariantFromBoolean(clientStatus.saveHistory))
+		logger.Info("Save match history: ", clientStatus.saveHistory)
+	})
+	app.AddAction(aSaveHistory)
+
 	// add items to grid
 	mainGrid.Add(serverLabel)
 	mainGrid.Add(serverEntry)
@@ -770,11 +1342,15 @@ func onAppActivate(app *gtk.Application) {
 	mainGrid.Add(protoRadioBox)
 	mainGrid.Add(pluginLabel)
 	mainGrid.Add(pluginRadioBox)
+	mainGrid.Add(gameCombo)
 	mainGrid.Add(peerLabel)
 	mainGrid.Add(addrLabel)
 	mainGrid.Add(ctlBtnBox)
 	mainGrid.Add(statusLabel)
 
+	// restore last used settings
+	applyProfile(clientConfig.LastUsed)
+
 	// tray icon
 	onStatusIconSetup(appWindow)
 
@@ -804,6 +1380,7 @@ func onAppActivate(app *gtk.Application) {
 					// once per second
 					switch clientStatus.client.TunnelStatus() {
 					case utils.STATUS_CONNECTED:
+						peerLabel.SetText("Peer IP (" + clientStatus.client.TunnelPath() + ")")
 						delay := clientStatus.client.TunnelDelay()
 						if delay == pingRec {
 							pingSameCnt++
@@ -830,6 +1407,7 @@ func onAppActivate(app *gtk.Application) {
 						addrLabel.SetText("Tunnel closed")
 					}
 				} else {
+					peerLabel.SetText("Peer IP")
 					// once each two second
 					if !pingDelay {
 						setPingLabel(clientStatus.client.Ping())
@@ -849,14 +1427,19 @@ func onAppActivate(app *gtk.Application) {
 
 				if clientStatus.plugin != nil {
 
-					switch p := clientStatus.plugin.(type) {
+					switch p := currentPlugin().(type) {
 
 					case *client.Hisoutensoku:
+						gameName := "th12.3"
+						if p.GetGame() == 105 {
+							gameName = "th10.5"
+						}
+
 						switch p.PeerStatus {
 
 						case client.SUCCESS_123:
 							glib.IdleAdd(func() bool {
-								statusLabel.SetText("th12.3 game loaded")
+								statusLabel.SetText(gameName + " game loaded")
 								return false
 							})
 
@@ -866,14 +1449,17 @@ func onAppActivate(app *gtk.Application) {
 								if delay > 9999 {
 									delay = 9999
 								}
-								statusLabel.SetText("th12.3 game ongoing | Delay " +
-									fmt.Sprintf("%.2f ms", delay))
+								text := gameName + " game ongoing | Delay " + fmt.Sprintf("%.2f ms", delay)
+								if sr := p.GetSokuRoll(); sr.Enabled {
+									text += " | SokuRoll"
+								}
+								statusLabel.SetText(text)
 								return false
 							})
 
 						case client.BATTLE_WAIT_ANOTHER_123:
 							glib.IdleAdd(func() bool {
-								statusLabel.SetText(fmt.Sprintf("th12.3 game waiting | %d spectator(s)", p.GetSpectatorCount()))
+								statusLabel.SetText(fmt.Sprintf("%s game waiting | %d spectator(s)", gameName, p.GetSpectatorCount()))
 								return false
 							})
 
@@ -881,7 +1467,7 @@ func onAppActivate(app *gtk.Application) {
 							glib.IdleAdd(func() bool {
 								tv, _, _ := clientStatus.client.Version()
 								if tv == clientStatus.brokerTVersion {
-									statusLabel.SetText("th12.3 game not started")
+									statusLabel.SetText(gameName + " game not started")
 								} else {
 									statusLabel.SetText("Plugin alert! Server is v" + clientStatus.brokerVersion + "-" + strconv.Itoa(int(clientStatus.brokerTVersion)))
 								}
@@ -934,6 +1520,17 @@ func onAppActivate(app *gtk.Application) {
 							})
 						}
 
+					case *client.AutoPlugin:
+						glib.IdleAdd(func() bool {
+							tv, _, _ := clientStatus.client.Version()
+							if tv == clientStatus.brokerTVersion {
+								statusLabel.SetText("Detecting game")
+							} else {
+								statusLabel.SetText("Plugin alert! Server is v" + clientStatus.brokerVersion + "-" + strconv.Itoa(int(clientStatus.brokerTVersion)))
+							}
+							return false
+						})
+
 					}
 
 				} else {
@@ -997,6 +1594,7 @@ func onConfigUpdate() error {
 		logger.Debugf("New client %d %s %s", clientStatus.localPort, clientStatus.serverHost, clientStatus.tunnelType)
 		clientStatus.userConfigChange = false
 	}
+	clientStatus.client.SetDirect(clientStatus.direct)
 
 	return nil
 }
@@ -1006,6 +1604,54 @@ func onUpdatePing() time.Duration {
 	return clientStatus.client.Ping()
 }
 
+// catalogPort get default port of game in catalog
+func catalogPort(id string) int {
+	if g, ok := client.CatalogGame(id); ok {
+		return g.Port
+	}
+	return client.DefaultLocalPort
+}
+
+// currentPlugin get plugin in use, detected plugin for auto plugin
+func currentPlugin() interface{} {
+	if a, ok := clientStatus.plugin.(*client.AutoPlugin); ok {
+		if p := a.Plugin(); p != nil {
+			return p
+		}
+	}
+	return clientStatus.plugin
+}
+
+// matchHistory match history sink if enabled, or nil
+func matchHistory() *client.MatchHistory {
+	if !clientStatus.saveHistory {
+		return nil
+	}
+	return client.NewMatchHistory(client.DefaultHistoryPath())
+}
+
+// currentProfile make profile with current settings
+func currentProfile(name string) config.Profile {
+	p := config.Profile{
+		Name:       name,
+		Server:     clientStatus.serverHost,
+		TunnelType: clientStatus.tunnelType,
+		LocalPort:  clientStatus.localPort,
+		Plugin:     clientStatus.pluginNum,
+		AutoSelect: clientConfig.LastUsed.AutoSelect,
+		Game:       clientStatus.game,
+		Direct:     clientStatus.direct,
+	}
+
+	// lakey has no plugin
+	if p.Plugin == 1 {
+		p.Plugin = 0
+		p.Game = "lakey"
+	}
+
+	return p
+}
+
 // showErrorDialog show error dialog
 func showErrorDialog(appWin *gtk.ApplicationWindow, msg string, err error) {
 	dialog := gtk.MessageDialogNew(appWin, gtk.DIALOG_DESTROY_WITH_PARENT, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE, "%s", err)
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	client "github.com/weilinfox/youmu-thlink/client/lib"
+	"github.com/weilinfox/youmu-thlink/client/lib/config"
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// command subcommand of client
+type command struct {
+	run  func(name string, args []string)
+	help string
+}
+
+// commands all subcommands, set in init to avoid initialization loop with printUsage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":     {runPing, "ping broker"},
+		"status":   {runStatus, "show broker version and user count"},
+		"version":  {runVersion, "show client version"},
+		"discover": {runDiscover, "list brokers in network with delay"},
+		"connect":  {runConnect, "connect tunnel and serve without plugin"},
+		"serve":    {runServe, "connect tunnel and serve with plugin (default without command)"},
+		"nat":      {runNat, "detect NAT type with brokers in network"},
+		"guest":    {runGuest, "join host address as guest, talk with host directly if possible"},
+		"join":     {runJoin, "join host address or room code as guest over QUIC/TCP tunnel"},
+	}
+}
+
+// printUsage print commands and flags of fs
+func printUsage(fs *flag.FlagSet) {
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := fs.Output()
+	_, _ = fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, name := range names {
+		_, _ = fmt.Fprintf(out, "  %-10s %s\n", name, commands[name].help)
+	}
+	_, _ = fmt.Fprintf(out, "\nRun %s <command> -h for flags of command.\n\nFlags without command:\n", filepath.Base(os.Args[0]))
+	fs.PrintDefaults()
+}
+
+// newFlagSet flag set of subcommand with -d debug flag
+func newFlagSet(name string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0])+" "+name, flag.ExitOnError)
+	debug := fs.Bool("d", false, "debug mode")
+	return fs, debug
+}
+
+// setLogLevel set log level with debug flag
+func setLogLevel(debug bool) {
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+}
+
+// printJSON print v as one JSON line on stdout
+func printJSON(v interface{}) {
+	err := json.NewEncoder(os.Stdout).Encode(v)
+	if err != nil {
+		logger.WithError(err).Error("Print JSON failed")
+	}
+}
+
+func runPing(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	server := fs.String("s", client.DefaultServerHost, "hostname of server")
+	jsonOutput := fs.Bool("json", false, "print result as JSON")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	c, err := client.New(client.DefaultLocalPort, *server, client.DefaultTunnelType)
+	if err != nil {
+		logger.WithError(err).Fatal("Start client error")
+	}
+
+	// Ping returns 1s on failure
+	delay := c.Ping()
+	reachable := delay < time.Second
+
+	if *jsonOutput {
+		printJSON(map[string]interface{}{
+			"server":    *server,
+			"delay_ms":  float64(delay.Nanoseconds()) / 1000000,
+			"reachable": reachable,
+		})
+	} else if reachable {
+		fmt.Printf("%s %.3fms\n", *server, float64(delay.Nanoseconds())/1000000)
+	} else {
+		fmt.Printf("%s unreachable\n", *server)
+	}
+
+	if !reachable {
+		os.Exit(1)
+	}
+}
+
+func runStatus(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	server := fs.String("s", client.DefaultServerHost, "hostname of server")
+	jsonOutput := fs.Bool("json", false, "print result as JSON")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	c, err := client.New(client.DefaultLocalPort, *server, client.DefaultTunnelType)
+	if err != nil {
+		logger.WithError(err).Fatal("Start client error")
+	}
+
+	tunnelVersion, _, _ := c.Version()
+	brokerTVersion, brokerVersion := c.BrokerVersion()
+	bStatus := c.BrokerStatus()
+
+	if *jsonOutput {
+		printJSON(map[string]interface{}{
+			"server":         *server,
+			"version":        brokerVersion,
+			"tunnel_version": brokerTVersion,
+			"compatible":     brokerTVersion == tunnelVersion,
+			"users":          bStatus.UserCount,
+		})
+		return
+	}
+
+	fmt.Printf("Broker:  %s\n", *server)
+	fmt.Printf("Version: v%s with tunnel version %d\n", brokerVersion, brokerTVersion)
+	if brokerTVersion != tunnelVersion {
+		fmt.Printf("         not compatible with client tunnel version %d\n", tunnelVersion)
+	}
+	if bStatus.UserCount < 0 {
+		fmt.Printf("Users:   unknown\n")
+	} else {
+		fmt.Printf("Users:   %d\n", bStatus.UserCount)
+	}
+}
+
+func runVersion(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	jsonOutput := fs.Bool("json", false, "print result as JSON")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	if *jsonOutput {
+		printJSON(map[string]interface{}{
+			"version":        utils.Version,
+			"channel":        utils.Channel,
+			"tunnel_version": utils.TunnelVersion,
+		})
+		return
+	}
+
+	version := utils.Version
+	if utils.Channel != "" {
+		version += "-" + utils.Channel
+	}
+	fmt.Printf("thlink client v%s with tunnel version %d\n", version, utils.TunnelVersion)
+}
+
+func runDiscover(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	server := fs.String("s", client.DefaultServerHost, "hostname of server")
+	configPath := fs.String("config", config.DefaultPath(), "config file path, rank brokers with its rank_policy")
+	jsonOutput := fs.Bool("json", false, "print result as JSON")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.WithError(err).Warn("Load config failed, use default")
+	}
+
+	brokers, err := client.RankNetBrokers(*server, cfg.RankPolicy)
+	if err != nil {
+		logger.WithError(err).Fatal("Get broker delay in network failed")
+	}
+
+	if *jsonOutput {
+		printJSON(brokers)
+		return
+	}
+
+	fmt.Printf("%10s %10s %5s %9s %-10s %-24s %s\n", "MEDIAN", "JITTER", "LOSS", "USERS", "VERSION", "NAME", "BROKER")
+	for _, b := range brokers {
+		name := "-"
+		if b.Meta != nil && b.Meta.Name != "" {
+			name = b.Meta.Name
+		}
+		if b.Meta != nil && b.Meta.Region != "" {
+			name += " [" + b.Meta.Region + "]"
+		}
+		if !b.Reachable {
+			fmt.Printf("%10s %10s %5s %9s %-10s %-24s %s\n", "-", "-", "100%", "-", "-", name, b.Address)
+			continue
+		}
+		users := "-"
+		if b.UserCount >= 0 {
+			users = strconv.Itoa(b.UserCount)
+		}
+		if b.Meta != nil && b.Meta.Capacity > 0 {
+			users += "/" + strconv.Itoa(b.Meta.Capacity)
+		}
+		version := b.Version
+		if version == "" {
+			version = "-"
+		} else if !b.Compatible() {
+			version += "!"
+		}
+		fmt.Printf("%8.3fms %8.3fms %4.0f%% %9s %-10s %-24s %s\n", float64(b.Median)/1000000, float64(b.Jitter)/1000000,
+			b.Loss*100, users, version, name, b.Address)
+	}
+}
+
+func runNat(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	server := fs.String("s", client.DefaultServerHost, "hostname of server")
+	jsonOutput := fs.Bool("json", false, "print result as JSON")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	report, err := client.DiagnoseNat(*server)
+	if err != nil {
+		logger.WithError(err).Fatal("Detect NAT type failed")
+	}
+
+	if *jsonOutput {
+		printJSON(report)
+		return
+	}
+
+	fmt.Printf("NAT type     %s\n", report.Type)
+	fmt.Printf("Local        %s\n", report.LocalAddr)
+	fmt.Printf("Public       %s\n", report.PublicAddr)
+	fmt.Printf("Change port  %t\n", report.ChangePort)
+	for _, m := range report.Mappings {
+		if m.Mapped == "" {
+			fmt.Printf("  %-24s no answer\n", m.Target)
+			continue
+		}
+		fmt.Printf("  %-24s %-24s %.3fms\n", m.Target, m.Mapped, m.RttMs)
+	}
+	if report.PunchFriendly() {
+		fmt.Println("Direct connection (-direct) is likely to work")
+	} else {
+		fmt.Println("Direct connection (-direct) is unlikely to work, broker relay will be used")
+	}
+}
+
+func runConnect(name string, args []string) {
+	runTunnel(flag.NewFlagSet(filepath.Base(os.Args[0])+" "+name, flag.ExitOnError), args, false)
+}
+
+func runServe(name string, args []string) {
+	runTunnel(flag.NewFlagSet(filepath.Base(os.Args[0])+" "+name, flag.ExitOnError), args, true)
+}
+
+func runGuest(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	localPort := fs.Int("p", client.DefaultLocalPort, "local port game connects to")
+	peer := fs.String("s", "", "peer address given by host")
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	if *peer == "" {
+		logger.Fatal("Peer address required, set with -s")
+	}
+
+	g, err := client.NewGuest(*localPort, *peer)
+	if err != nil {
+		logger.WithError(err).Fatal("Start guest error")
+	}
+	defer g.Close()
+
+	err = g.Connect()
+	if err != nil {
+		logger.WithError(err).Fatal("Guest connect error")
+	}
+
+	err = g.Serve()
+	if err != nil {
+		logger.WithError(err).Fatal("Serve guest error")
+	}
+}
+
+func runJoin(name string, args []string) {
+
+	fs, debug := newFlagSet(name)
+	localPort := fs.Int("p", client.DefaultLocalPort, "local port game connects to")
+	server := fs.String("s", client.DefaultServerHost, "hostname of server, needed for room code")
+	tunnelType := fs.String("t", client.DefaultTunnelType, "tunnel type, support tcp and quic")
+	autoSelect := fs.Bool("a", false, "join through broker with lowest latency in network of host broker")
+	via := fs.String("via", "", "join through this broker in network of host broker (override -a)")
+	configPath := fs.String("config", config.DefaultPath(), "config file path, rank brokers with its rank_policy")
+	jsonOutput := fs.Bool("json", false, "print tunnel status as JSON lines on stdout")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s [flags] <peer host or room code>\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	setLogLevel(*debug)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := client.NewJoin(*localPort, *server, *tunnelType, fs.Arg(0))
+	if err != nil {
+		logger.WithError(err).Fatal("Start client error")
+	}
+	defer c.Close()
+
+	if *via == "" && *autoSelect {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			logger.WithError(err).Warn("Load config failed, use default")
+		}
+
+		brokers, err := client.RankNetBrokers(c.ServerHost(), cfg.RankPolicy)
+		if err != nil {
+			logger.WithError(err).Fatal("Get broker delay in network failed")
+		}
+		if len(brokers) > 0 && brokers[0].Reachable {
+			*via = brokers[0].Address
+			logger.Infof("Nearest broker %s %.3fms", *via, float64(brokers[0].Median)/1000000)
+		}
+	}
+	c.SetJoinVia(*via)
+
+	err = c.Connect()
+	if err != nil {
+		logger.WithError(err).Fatal("Client join error")
+	}
+
+	if *jsonOutput {
+		printJSON(client.NewTunnelInfo(0, c, nil))
+	}
+	err = c.Serve(nil, nil, nil, nil)
+	if *jsonOutput {
+		printJSON(client.NewTunnelInfo(0, c, nil))
+	}
+	if err != nil {
+		logger.WithError(err).Fatal("Serve client error")
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import "strings"
+
+// Game a title could be played with thlink
+type Game struct {
+	Id        string   // short name used in command line
+	Name      string   // title
+	Port      int      // default port of host
+	Transport string   // transport notes
+	Plugin    int      // spectating plugin id, 0 for no plugin
+	Tools     []string // helper tools required
+}
+
+// Catalog all titles supported, see README for details
+var Catalog = []Game{
+	{
+		Id:        "th09",
+		Name:      "Phantasmagoria of Flower View",
+		Port:      DefaultLocalPort,
+		Transport: "DirectPlay over UDP, use port adonis2 prompts",
+		Tools:     []string{"Adonis2"},
+	},
+	{
+		Id:        "th105",
+		Name:      "Scarlet Weather Rhapsody",
+		Port:      DefaultLocalPort,
+		Transport: "UDP",
+		Plugin:    105,
+	},
+	{
+		Id:        "th123",
+		Name:      "Hisoutensoku",
+		Port:      DefaultLocalPort,
+		Transport: "UDP, SokuRoll supported",
+		Plugin:    123,
+	},
+	{
+		Id:        "th135",
+		Name:      "Hopeless Masquerade",
+		Port:      DefaultLocalPort,
+		Transport: "UDP",
+	},
+	{
+		Id:        "th145",
+		Name:      "Urban Legend in Limbo",
+		Port:      DefaultLocalPort,
+		Transport: "UDP",
+	},
+	{
+		Id:        "th155",
+		Name:      "Antinomy of Common Flowers",
+		Port:      DefaultLocalPort,
+		Transport: "UDP",
+		Plugin:    155,
+	},
+	{
+		Id:        "lakey",
+		Name:      "Lakey",
+		Port:      3010,
+		Transport: "UDP, add peer address to hosts in lakey.ini",
+	},
+}
+
+// CatalogGame find game in Catalog with id, case insensitive
+func CatalogGame(id string) (Game, bool) {
+
+	for _, g := range Catalog {
+		if strings.EqualFold(g.Id, id) {
+			return g, true
+		}
+	}
+
+	return Game{}, false
+}
+
+// CatalogIds ids of all games in Catalog
+func CatalogIds() []string {
+
+	ids := make([]string, len(Catalog))
+	for i, g := range Catalog {
+		ids[i] = g.Id
+	}
+
+	return ids
+}
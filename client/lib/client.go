@@ -1,10 +1,12 @@
 package client
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/weilinfox/youmu-thlink/utils"
@@ -29,7 +31,19 @@ type Client struct {
 
 	serving bool
 
-	peerHost string
+	peerHost      string
+	spectateCache bool   // ask broker for th12.3 spectate cache
+	spectatorHost string // broker spectate cache address
+	roomCode      string // room code of tunnel guests can join with
+
+	join    string // join target, peer host or room code, empty for host
+	joinVia string // broker forwarding guest tunnel to host broker
+
+	direct     bool                   // try direct connection with guests
+	punchLock  sync.Mutex             // lock of punchConn and punchPeers
+	punchConn  *net.UDPConn           // direct path, nil if not available
+	punchPeers map[string]*directPeer // guests told by broker
+	punchNonce []byte                 // nonce from TUNNEL response, carried by PUNCH_HOST
 }
 
 type BrokerStatus struct {
@@ -221,6 +235,10 @@ func (c *Client) BrokerVersion() (byte, string) {
 // Connect ask new tunnel and connect
 func (c *Client) Connect() error {
 
+	if c.join != "" {
+		return c.connectJoin()
+	}
+
 	logger.Info("Will connect to local port ", c.localPort)
 	logger.Info("Will connect to broker address ", c.serverHost)
 
@@ -238,7 +256,14 @@ func (c *Client) Connect() error {
 		return err
 	}
 
-	_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, []byte{'u', c.tunnelType[0]}))
+	cmd := []byte{'u', c.tunnelType[0]}
+	if c.spectateCache {
+		cmd = append(cmd, 's')
+	}
+	if c.direct {
+		cmd = append(cmd, 'd')
+	}
+	_, err = conn.Write(utils.NewDataFrame(utils.TUNNEL, cmd))
 	if err != nil {
 		return err
 	}
@@ -264,7 +289,7 @@ func (c *Client) Connect() error {
 
 	// Set up tunnel
 	config := utils.TunnelConfig{
-		Address0: host + ":" + strconv.Itoa(port1),
+		Address0: net.JoinHostPort(host, strconv.Itoa(port1)),
 		Address1: "localhost:" + strconv.Itoa(c.localPort),
 	}
 	switch c.tunnelType[0] {
@@ -279,11 +304,50 @@ func (c *Client) Connect() error {
 		return err
 	}
 
+	// advertised host of broker after room code, or address client connected to,
+	// then nonce for registering host endpoint
 	hostIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	c.peerHost = hostIP + ":" + strconv.Itoa(port2)
+	c.roomCode = ""
+	c.punchNonce = nil
+	if dataStream.Len() > 6 {
+		fields := bytes.SplitN(dataStream.Data()[6:], []byte{0}, 3)
+		c.roomCode = string(fields[0])
+		if len(fields) > 1 && len(fields[1]) > 0 {
+			hostIP = string(fields[1])
+		}
+		if len(fields) > 2 {
+			c.punchNonce = append([]byte{}, fields[2]...)
+		}
+	}
+	c.peerHost = net.JoinHostPort(hostIP, strconv.Itoa(port2))
 
 	logger.Infof("Tunnel established for remote " + c.peerHost)
 
+	c.spectatorHost = ""
+	if c.spectateCache {
+		port3 := 0
+		if dataStream.Len() >= 6 {
+			port3 = int(dataStream.Data()[4])<<8 + int(dataStream.Data()[5])
+		}
+		if port3 > 0 {
+			c.spectatorHost = net.JoinHostPort(hostIP, strconv.Itoa(port3))
+			logger.Info("Spectate cache established for spectators " + c.spectatorHost)
+		} else {
+			logger.Warn("Broker may not support spectate cache")
+		}
+	}
+
+	if c.roomCode != "" {
+		logger.Info("Guests can join with room code " + c.roomCode)
+	}
+
+	if c.direct {
+		err = c.startDirect(c.peerHost)
+		if err != nil {
+			logger.WithError(err).Warn("Direct connection not available, use relay")
+		}
+	}
+
 	return nil
 }
 
@@ -291,6 +355,10 @@ func (c *Client) Serve(readFunc, writeFunc utils.PluginCallback, plRoutine utils
 	if c.serving {
 		return errors.New("already serving")
 	}
+	if c.direct && (readFunc != nil || writeFunc != nil) {
+		// game data on direct path never goes through plugin
+		return errors.New("direct connection does not work with plugin")
+	}
 	c.serving = true
 	return c.tunnel.Serve(readFunc, writeFunc, plRoutine, plQuit)
 }
@@ -300,6 +368,7 @@ func (c *Client) Close() {
 	if c.tunnel != nil {
 		c.tunnel.Close()
 	}
+	c.stopDirect()
 	c.serving = false
 }
 
@@ -333,112 +402,204 @@ func (c *Client) PeerHost() string {
 	return c.peerHost
 }
 
+// SetSpectateCache ask broker to serve th12.3 spectators with cache in next Connect
+func (c *Client) SetSpectateCache(spectateCache bool) {
+	c.spectateCache = spectateCache
+}
+
+// RoomCode get room code guests can join with, empty if broker does not support
+func (c *Client) RoomCode() string {
+	return c.roomCode
+}
+
+// SpectatorHost get broker spectate cache address, empty if not available
+func (c *Client) SpectatorHost() string {
+	return c.spectatorHost
+}
+
 func (c *Client) Serving() bool {
 	return c.serving
 }
 
-// NetBrokerDelay broker delay nanoseconds in network
-func NetBrokerDelay(server string) (map[string]int, error) {
+// NetBroker broker in network with metadata
+type NetBroker struct {
+	Address string
+	Meta    *utils.BrokerMeta // nil if broker does not send metadata
+}
 
-	// ask for net info
-	logger.Info("Get broker list")
-	tcpAddr, err := net.ResolveTCPAddr("tcp", server)
+// NetBrokers get addresses of brokers in network, server itself first
+func NetBrokers(server string) ([]string, error) {
+
+	brokers, err := NetBrokerList(server)
 	if err != nil {
 		return nil, err
 	}
 
-	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return nil, err
+	serverList := make([]string, len(brokers))
+	for i, b := range brokers {
+		serverList[i] = b.Address
 	}
-	defer tcpConn.Close()
 
-	_, err = tcpConn.Write(utils.NewDataFrame(utils.NET_INFO, []byte{0, 0}))
-	if err != nil {
-		return nil, err
+	return serverList, nil
+}
+
+// NetBrokerList get brokers in network with metadata page by page, server itself first;
+// fall back to addresses only if server does not support metadata
+func NetBrokerList(server string) ([]NetBroker, error) {
+
+	logger.Info("Get broker list")
+	brokers, err := netBrokerPages(server)
+	if err == nil {
+		return brokers, nil
 	}
+	logger.WithError(err).Debug("Get broker list with metadata failed")
 
-	buf := make([]byte, utils.TransBufSize)
-	n, err := tcpConn.Read(buf)
+	data, err := netInfo(server, []byte{0, 0})
 	if err != nil {
 		return nil, err
 	}
 
-	// parse broker list
-	dataStream := utils.NewDataStream()
-	dataStream.Append(buf[:n])
-	if !dataStream.Parse() {
-		logger.Fatal("Parse net info response failed")
-	}
-
-	serverList := make([]string, utils.BrokersCntMax+1)
-	serverList[0] = server // NET_INFO return brokers except itself
-	serverListCnt := 1
-	for i := 0; i < dataStream.Len() && serverListCnt < utils.BrokersCntMax+1; i++ {
-		l := int(dataStream.Data()[i])
+	brokers = []NetBroker{{Address: server}} // NET_INFO return brokers except itself
+	for i := 0; i < len(data) && len(brokers) < utils.BrokersCntMax+1; i++ {
+		l := int(data[i])
+		if i+1+l > len(data) {
+			return nil, errors.New("parse net info response failed")
+		}
 
-		serverList[serverListCnt] = string(dataStream.Data()[i+1 : i+1+l])
-		serverListCnt++
+		brokers = append(brokers, NetBroker{Address: string(data[i+1 : i+1+l])})
 		i += l
 	}
 
-	// ping every broker *5
-	logger.Info("Ping broker delay")
-	const pingTimes = 5
-	serverDelay := make([]time.Time, utils.BrokersCntMax+1)
-	for j := 0; j < pingTimes; j++ {
-		for i := 0; i < serverListCnt; i++ {
+	return brokers, nil
+}
 
-			// dial port
-			conn, err := net.DialTimeout("tcp", serverList[i], time.Millisecond*500)
-			if err != nil {
-				logger.WithError(err).Warn("Cannot connect to broker")
-				serverDelay[i] = serverDelay[i].Add(time.Second)
-				continue
-			}
+// netBrokerPages get brokers with metadata from all NET_INFO pages
+func netBrokerPages(server string) ([]NetBroker, error) {
 
-			// send ping
-			timeSend := time.Now()
-			_ = conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 500))
-			_, err = conn.Write(utils.NewDataFrame(utils.PING, nil))
-			_ = conn.SetWriteDeadline(time.Time{})
-			if err != nil {
-				_ = conn.Close()
-				logger.WithError(err).Warn("Send ping failed")
-				serverDelay[i] = serverDelay[i].Add(time.Second)
-				continue
+	var brokers []NetBroker
+	for total := 1; len(brokers) < total; {
+		data, err := netInfo(server, []byte{0, 0, 'm', byte(len(brokers) >> 8), byte(len(brokers))})
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 2 {
+			return nil, errors.New("parse net info response failed")
+		}
+		total = int(data[0])<<8 + int(data[1])
+
+		count := len(brokers)
+		for i := 2; i < len(data); {
+			l := int(data[i])
+			if i+1+l+2 > len(data) {
+				return nil, errors.New("parse net info response failed")
 			}
-			_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
-			n, err := conn.Read(buf)
-			_ = conn.SetReadDeadline(time.Time{})
+			addr := string(data[i+1 : i+1+l])
+			i += 1 + l
+			ml := int(data[i])<<8 + int(data[i+1])
+			if i+2+ml > len(data) {
+				return nil, errors.New("parse net info response failed")
+			}
+			meta, err := utils.DecodeBrokerMeta(data[i+2 : i+2+ml])
 			if err != nil {
-				_ = conn.Close()
-				logger.WithError(err).Warn("Get ping response failed")
-				serverDelay[i] = serverDelay[i].Add(time.Second)
-				continue
+				return nil, err
 			}
-			_ = conn.Close()
-			timeResp := time.Now()
-
-			// parse response
-			dataStream = utils.NewDataStream()
-			dataStream.Append(buf[:n])
-			if !dataStream.Parse() || dataStream.Type() != utils.PING {
-				logger.Debug("Invalid PING response from server")
-				serverDelay[i] = serverDelay[i].Add(time.Second)
-				continue
+			i += 2 + ml
+
+			if addr == "" {
+				// the server itself
+				addr = server
 			}
+			brokers = append(brokers, NetBroker{Address: addr, Meta: &meta})
+		}
+		if len(brokers) == count {
+			// brokers gone while paging
+			break
+		}
+	}
+
+	return brokers, nil
+}
+
+// netInfo send NET_INFO request to server and return response data
+func netInfo(server string, request []byte) ([]byte, error) {
+
+	tcpConn, err := net.DialTimeout("tcp", server, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	_ = tcpConn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	_, err = tcpConn.Write(utils.NewDataFrame(utils.NET_INFO, request))
+	if err != nil {
+		return nil, err
+	}
 
-			serverDelay[i] = serverDelay[i].Add(timeResp.Sub(timeSend))
+	dataStream := utils.NewDataStream()
+	buf := make([]byte, utils.TransBufSize)
+	for !dataStream.Parse() {
+		n, err := tcpConn.Read(buf)
+		if err != nil {
+			return nil, err
 		}
+		dataStream.Append(buf[:n])
+	}
+	if dataStream.Type() != utils.NET_INFO {
+		return nil, errors.New("parse net info response failed")
+	}
+
+	return dataStream.Data(), nil
+}
+
+// NetBrokerDelay broker delay nanoseconds in network,
+// mean of 5 pings and lost ping counts 1s
+func NetBrokerDelay(server string) (map[string]int, error) {
+
+	serverList, err := NetBrokers(server)
+	if err != nil {
+		return nil, err
 	}
 
+	logger.Info("Ping broker delay")
+	probes := ProbeBrokers(serverList, DefaultProbeOptions())
+
 	// make ping delay map
 	serverDelayMap := make(map[string]int)
-	for i := 0; i < serverListCnt; i++ {
-		serverDelayMap[serverList[i]] = serverDelay[i].Nanosecond() / pingTimes
+	for _, p := range probes {
+		if p.Sent == 0 {
+			continue
+		}
+		total := p.Mean*time.Duration(p.Received) + time.Second*time.Duration(p.Sent-p.Received)
+		serverDelayMap[p.Address] = int(total / time.Duration(p.Sent))
 	}
 
 	return serverDelayMap, nil
 
 }
+
+// RankNetBrokers probe brokers in network of server and rank them with policy
+func RankNetBrokers(server string, policy RankPolicy) ([]BrokerProbe, error) {
+
+	brokers, err := NetBrokerList(server)
+	if err != nil {
+		return nil, err
+	}
+
+	serverList := make([]string, len(brokers))
+	for i, b := range brokers {
+		serverList[i] = b.Address
+	}
+
+	logger.Info("Probe ", len(serverList), " broker(s)")
+
+	probes := ProbeBrokers(serverList, DefaultProbeOptions())
+	for i := range probes {
+		for _, b := range brokers {
+			if b.Address == probes[i].Address {
+				probes[i].Meta = b.Meta
+			}
+		}
+	}
+
+	return RankBrokers(probes, policy), nil
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	client "github.com/weilinfox/youmu-thlink/client/lib"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.WithField("Config", "internal")
+
+// LastProfile profile name refers to last used settings
+const LastProfile = "last"
+
+// Profile saved client settings
+type Profile struct {
+	Name       string `json:"name"`
+	Server     string `json:"server"`      // broker address
+	TunnelType string `json:"tunnel_type"` // tcp or quic
+	LocalPort  int    `json:"local_port"`
+	Plugin     int    `json:"plugin"`           // plugin id, see client.NewPlugin
+	AutoSelect bool   `json:"auto_select"`      // select broker with lowest latency in network
+	Game       string `json:"game,omitempty"`   // game id in client.Catalog
+	Direct     bool   `json:"direct,omitempty"` // try direct connection with guests
+}
+
+// Config client config file shared by command line and gtk3 client
+type Config struct {
+	path string
+
+	Profiles   []Profile         `json:"profiles"`
+	LastUsed   Profile           `json:"last_used"`
+	Favourites []string          `json:"favourite_brokers"`
+	RankPolicy client.RankPolicy `json:"rank_policy"` // broker ranking policy of auto select and discovery
+}
+
+// DefaultPath config file in user config directory, $XDG_CONFIG_HOME/thlink/config.json on linux
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "thlink", "config.json")
+}
+
+// DefaultProfile profile with client default settings
+func DefaultProfile() Profile {
+	return Profile{
+		Server:     client.DefaultServerHost,
+		TunnelType: client.DefaultTunnelType,
+		LocalPort:  client.DefaultLocalPort,
+		AutoSelect: true,
+	}
+}
+
+// UnmarshalJSON fields missing in data keep client default settings,
+// so hand-written or older profiles without auto_select still select broker automatically
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	type profile Profile // without UnmarshalJSON
+	v := profile(DefaultProfile())
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*p = Profile(v)
+	return nil
+}
+
+// New empty config saved to path
+func New(path string) *Config {
+	return &Config{
+		path:       path,
+		Profiles:   []Profile{},
+		LastUsed:   DefaultProfile(),
+		Favourites: []string{},
+		RankPolicy: client.DefaultRankPolicy(),
+	}
+}
+
+// Load read config file, return empty config if file not exist
+func Load(path string) (*Config, error) {
+
+	c := New(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Debug("Config file ", path, " not exist, use default")
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return New(path), err
+	}
+
+	c.LastUsed = c.LastUsed.withDefault()
+	for i := range c.Profiles {
+		c.Profiles[i] = c.Profiles[i].withDefault()
+	}
+
+	return c, nil
+}
+
+// Path get config file path
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Save write config file, replace old file after fully written
+func (c *Config) Save() error {
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// Profile get profile with name, LastProfile for last used settings
+func (c *Config) Profile(name string) (Profile, bool) {
+
+	if name == LastProfile {
+		return c.LastUsed, true
+	}
+
+	for _, p := range c.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return Profile{}, false
+}
+
+// ProfileNames names of all saved profiles
+func (c *Config) ProfileNames() []string {
+
+	names := make([]string, len(c.Profiles))
+	for i, p := range c.Profiles {
+		names[i] = p.Name
+	}
+
+	return names
+}
+
+// SetProfile add profile or replace profile with the same name
+func (c *Config) SetProfile(p Profile) error {
+
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || p.Name == LastProfile {
+		return errors.New("invalid profile name \"" + p.Name + "\"")
+	}
+
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == p.Name {
+			c.Profiles[i] = p
+			return nil
+		}
+	}
+	c.Profiles = append(c.Profiles, p)
+
+	return nil
+}
+
+// DeleteProfile delete profile with name, return false if not found
+func (c *Config) DeleteProfile(name string) bool {
+
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			c.Profiles = append(c.Profiles[:i], c.Profiles[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetLastUsed record last used settings, return true if changed
+func (c *Config) SetLastUsed(p Profile) bool {
+	p.Name = ""
+	if c.LastUsed == p {
+		return false
+	}
+	c.LastUsed = p
+	return true
+}
+
+// IsFavourite check if broker is favourite
+func (c *Config) IsFavourite(broker string) bool {
+
+	for _, f := range c.Favourites {
+		if f == broker {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddFavourite add broker to favourites
+func (c *Config) AddFavourite(broker string) {
+	if broker != "" && !c.IsFavourite(broker) {
+		c.Favourites = append(c.Favourites, broker)
+	}
+}
+
+// RemoveFavourite remove broker from favourites, return false if not found
+func (c *Config) RemoveFavourite(broker string) bool {
+
+	for i, f := range c.Favourites {
+		if f == broker {
+			c.Favourites = append(c.Favourites[:i], c.Favourites[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// withDefault fill empty fields of profile with client default settings
+func (p Profile) withDefault() Profile {
+
+	d := DefaultProfile()
+	if p.Server == "" {
+		p.Server = d.Server
+	}
+	if p.TunnelType == "" {
+		p.TunnelType = d.TunnelType
+	}
+	if p.LocalPort == 0 {
+		p.LocalPort = d.LocalPort
+	}
+
+	return p
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thlink", "config.json")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal("Load not exist config error: ", err)
+	}
+	if c.LastUsed != DefaultProfile() || len(c.Profiles) != 0 {
+		t.Fatal("Not exist config should be default: ", c)
+	}
+
+	p := DefaultProfile()
+	p.Name = "soku"
+	p.Plugin = 123
+	p.Game = "th123"
+	if err = c.SetProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetProfile(Profile{Name: LastProfile}); err == nil {
+		t.Error("Profile name " + LastProfile + " should be reserved")
+	}
+	p.LocalPort = 10801
+	if !c.SetLastUsed(p) || c.SetLastUsed(p) {
+		t.Error("SetLastUsed should only report real changes")
+	}
+	c.AddFavourite("broker:4646")
+	c.AddFavourite("broker:4646")
+
+	if err = c.Save(); err != nil {
+		t.Fatal("Save config error: ", err)
+	}
+
+	c, err = Load(path)
+	if err != nil {
+		t.Fatal("Load config error: ", err)
+	}
+	if s, ok := c.Profile("soku"); !ok || s.Plugin != 123 || s.Game != "th123" {
+		t.Error("Profile not saved: ", s)
+	}
+	if l, ok := c.Profile(LastProfile); !ok || l.LocalPort != 10801 || l.Name != "" {
+		t.Error("Last used settings not saved: ", l)
+	}
+	if len(c.Favourites) != 1 || !c.IsFavourite("broker:4646") {
+		t.Error("Favourite brokers not saved: ", c.Favourites)
+	}
+
+	if !c.DeleteProfile("soku") || c.DeleteProfile("soku") || !c.RemoveFavourite("broker:4646") {
+		t.Error("Delete profile or favourite failed")
+	}
+}
+
+func TestProfileDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"profiles": [{"name": "soku", "plugin": 123}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal("Load config error: ", err)
+	}
+	s, ok := c.Profile("soku")
+	if !ok || s.Plugin != 123 || !s.AutoSelect || s.Server != DefaultProfile().Server {
+		t.Error("Missing profile fields should be default: ", s)
+	}
+}
@@ -0,0 +1,863 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerControl = logrus.WithField("Control", "internal")
+
+// DefaultControlAddr default listen address of control API
+const DefaultControlAddr = "127.0.0.1:4647"
+
+// TunnelRequest POST /tunnels body
+type TunnelRequest struct {
+	LocalPort  int    `json:"local_port"`  // local port, default DefaultLocalPort or port of game
+	Server     string `json:"server"`      // broker address, default DefaultServerHost
+	TunnelType string `json:"tunnel_type"` // tcp or quic, default DefaultTunnelType
+	Plugin     int    `json:"plugin"`      // plugin id, see NewPlugin
+	Game       string `json:"game"`        // game id in Catalog, set default port and plugin
+	AutoSelect bool   `json:"auto_select"` // select broker with lowest latency in network of Server
+	Spectate   bool   `json:"spectate"`    // let broker serve th12.3 spectators with cache
+	Direct     bool   `json:"direct"`      // try direct connection with guests, no plugin
+	Join       string `json:"join"`        // join as guest with peer host or room code, no plugin,
+	// with AutoSelect, join through broker with lowest latency in network of host broker
+}
+
+// PluginStatus plugin status in TunnelInfo
+type PluginStatus struct {
+	Game          int             `json:"game"`                      // game number, 0 if not detected
+	Status        string          `json:"status"`                    // PeerStatus of th10.5/th12.3, MatchStatus of th15.5
+	Spectators    int             `json:"spectators"`                // spectator count
+	ReplayDelayMs float64         `json:"replay_delay_ms,omitempty"` // th10.5/th12.3 replay request delay
+	SokuRoll      *SokuRollStatus `json:"sokuroll,omitempty"`        // th12.3 SokuRoll status
+}
+
+// TunnelInfo tunnel status returned by control API
+type TunnelInfo struct {
+	Id            int           `json:"id"`
+	LocalPort     int           `json:"local_port"`
+	Server        string        `json:"server"`
+	TunnelType    string        `json:"tunnel_type"`
+	PeerHost      string        `json:"peer_host"`
+	SpectatorHost string        `json:"spectator_host,omitempty"`
+	RoomCode      string        `json:"room_code,omitempty"`
+	Join          string        `json:"join,omitempty"`
+	JoinVia       string        `json:"join_via,omitempty"`
+	Status        string        `json:"status"`
+	DelayMs       float64       `json:"delay_ms"`
+	Path          string        `json:"path"` // PathRelay or PathDirect
+	Serving       bool          `json:"serving"`
+	Plugin        *PluginStatus `json:"plugin,omitempty"`
+}
+
+var tunnelStatusNames = map[utils.TunnelStatus]string{
+	utils.STATUS_INIT:      "init",
+	utils.STATUS_CONNECTED: "connected",
+	utils.STATUS_CLOSED:    "closed",
+	utils.STATUS_FAILED:    "failed",
+}
+
+var status123Names = map[Status123peer]string{
+	INACTIVE_123:            "inactive",
+	SUCCESS_123:             "success",
+	BATTLE_123:              "battle",
+	BATTLE_WAIT_ANOTHER_123: "battle_wait_another",
+}
+
+var status155Names = map[match155status]string{
+	MATCH_WAIT_155:          "wait",
+	MATCH_ACCEPT_155:        "accept",
+	MATCH_SPECT_ACK_155:     "spectate_ack",
+	MATCH_SPECT_INIT_155:    "spectate_init",
+	MATCH_SPECT_SUCCESS_155: "spectate_success",
+	MATCH_SPECT_ERROR_155:   "spectate_error",
+}
+
+type controlTunnel struct {
+	id     int
+	client *Client
+	plugin Plugin
+	status []byte // last status sent in tunnel_status event
+}
+
+// ControlServer headless client driven by local HTTP/JSON API.
+// every request needs per-session token in "Authorization: Bearer <token>" header,
+// GET requests may carry it as ?token=<token> for browser sources instead;
+// Host header must be an IP address, localhost or listen host to stop DNS rebinding,
+// and POST body must be application/json
+//
+//	GET    /status        client version and tunnel count
+//	GET    /brokers       ranked brokers in network with probing result, ?server=host:port
+//	GET    /tunnels       all tunnels
+//	POST   /tunnels       new tunnel with TunnelRequest
+//	GET    /tunnels/<id>  tunnel status
+//	DELETE /tunnels/<id>  close tunnel
+//	GET    /events        server-sent events of Event, ?tunnel=<id> for one tunnel,
+//	                      starting with tunnel_status of current tunnels
+//	GET    /overlay       HTML overlay page for streaming software
+type ControlServer struct {
+	lock    sync.Mutex
+	tunnels map[int]*controlTunnel
+	nextId  int
+
+	events *EventBus
+
+	rankPolicy RankPolicy // broker ranking policy of auto select and GET /brokers
+
+	token     string // bearer token of this session
+	host      string // listen host name allowed in Host header besides IP address and localhost
+	checkHost bool   // check Host header, not needed on unix socket
+
+	server   *http.Server
+	quitFlag bool
+}
+
+// tunnelError error of NewTunnel with HTTP status code of control API
+type tunnelError struct {
+	code int
+	err  error
+}
+
+func (e *tunnelError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tunnelError) Unwrap() error {
+	return e.err
+}
+
+// badRequest error caused by invalid TunnelRequest
+func badRequest(err error) error {
+	return &tunnelError{code: http.StatusBadRequest, err: err}
+}
+
+// badGateway error talking to broker
+func badGateway(err error) error {
+	return &tunnelError{code: http.StatusBadGateway, err: err}
+}
+
+// NewControlServer new control API server
+func NewControlServer() *ControlServer {
+	s := &ControlServer{
+		tunnels:    make(map[int]*controlTunnel),
+		nextId:     1,
+		events:     NewEventBus(),
+		rankPolicy: DefaultRankPolicy(),
+		token:      newControlToken(),
+		checkHost:  true,
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	return s
+}
+
+// newControlToken random token of control API session
+func newControlToken() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		loggerControl.WithError(err).Fatal("Generate control API token error")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// DefaultControlTokenPath file in user config directory control API token is saved to
+func DefaultControlTokenPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "thlink", "control.token")
+}
+
+// SetRankPolicy set broker ranking policy of auto select and GET /brokers
+func (s *ControlServer) SetRankPolicy(policy RankPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rankPolicy = policy
+}
+
+// getRankPolicy get broker ranking policy
+func (s *ControlServer) getRankPolicy() RankPolicy {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.rankPolicy
+}
+
+// Token get bearer token of control API
+func (s *ControlServer) Token() string {
+	return s.token
+}
+
+// SaveToken write bearer token to path readable by current user only
+func (s *ControlServer) SaveToken(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(s.token+"\n"), 0600)
+}
+
+// NewOverlayServer new read-only server of live events and overlay page for streaming software,
+// serve GET /events and GET /overlay only, without token
+func NewOverlayServer() *ControlServer {
+	s := NewControlServer()
+	s.server.Handler = s.OverlayHandler()
+	return s
+}
+
+// Handler http handler of control API
+func (s *ControlServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/brokers", s.handleBrokers)
+	mux.HandleFunc("/tunnels", s.handleTunnels)
+	mux.HandleFunc("/tunnels/", s.handleTunnel)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/overlay", s.handleOverlay)
+	return s.authorize(mux)
+}
+
+// OverlayHandler read-only http handler of live events and overlay page
+func (s *ControlServer) OverlayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/overlay", s.handleOverlay)
+	return s.localHost(mux)
+}
+
+// localHost check Host header before serving request
+func (s *ControlServer) localHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.checkHost && !allowedHost(r.Host, s.host) {
+			writeJSONError(w, http.StatusForbidden, errors.New("host "+r.Host+" not allowed"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize check Host header, token and content type before serving request
+func (s *ControlServer) authorize(next http.Handler) http.Handler {
+	return s.localHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		} else if r.Method == http.MethodGet {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// allowedHost check if Host header is an IP address, localhost or listen host name
+func allowedHost(hostport string, listenHost string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	return host != "" && (net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") ||
+		listenHost != "" && strings.EqualFold(host, listenHost))
+}
+
+// ListenAndServe serve control API on tcp address or unix socket with unix:/path
+func (s *ControlServer) ListenAndServe(addr string) error {
+
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		_ = os.Remove(path)
+		listener, err = net.Listen("unix", path)
+		s.checkHost = false
+	} else {
+		listener, err = net.Listen("tcp", addr)
+		s.host, _, _ = net.SplitHostPort(addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	loggerControl.Info("Control API listen at ", listener.Addr().String())
+
+	go s.watch()
+
+	err = s.server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stop control API and close all tunnels
+func (s *ControlServer) Close() {
+
+	s.lock.Lock()
+	s.quitFlag = true
+	for _, t := range s.tunnels {
+		t.client.Close()
+	}
+	s.lock.Unlock()
+
+	_ = s.server.Close()
+}
+
+// NewTunnel connect new tunnel and serve it in background
+func (s *ControlServer) NewTunnel(req TunnelRequest) (*TunnelInfo, error) {
+
+	if req.Game != "" {
+		g, ok := CatalogGame(req.Game)
+		if !ok {
+			return nil, badRequest(errors.New("no such game " + req.Game))
+		}
+		if req.LocalPort == 0 {
+			req.LocalPort = g.Port
+		}
+		if req.Plugin == 0 {
+			req.Plugin = g.Plugin
+		}
+	}
+	if req.LocalPort == 0 {
+		req.LocalPort = DefaultLocalPort
+	}
+	if req.Server == "" {
+		req.Server = DefaultServerHost
+	}
+	if req.TunnelType == "" {
+		req.TunnelType = DefaultTunnelType
+	}
+	if req.Join != "" {
+		req.Plugin = 0
+	}
+	if req.Direct && req.Plugin != 0 {
+		return nil, badRequest(errors.New("direct connection does not work with plugin"))
+	}
+	p, err := NewPlugin(req.Plugin)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	var c *Client
+	if req.Join != "" {
+		c, err = NewJoin(req.LocalPort, req.Server, req.TunnelType, req.Join)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+
+		if req.AutoSelect {
+			via, err := bestBroker(c.ServerHost(), s.getRankPolicy())
+			if err != nil {
+				return nil, badGateway(err)
+			}
+			c.SetJoinVia(via)
+		}
+	} else {
+		// check request before asking brokers
+		c, err = New(req.LocalPort, req.Server, req.TunnelType)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+
+		if req.AutoSelect {
+			req.Server, err = bestBroker(req.Server, s.getRankPolicy())
+			if err != nil {
+				return nil, badGateway(err)
+			}
+			c, err = New(req.LocalPort, req.Server, req.TunnelType)
+			if err != nil {
+				return nil, badGateway(err)
+			}
+		}
+	}
+
+	if req.Spectate && (req.Plugin == 123 || req.Plugin == PluginAuto) {
+		c.SetSpectateCache(true)
+	}
+	c.SetDirect(req.Direct)
+
+	err = c.Connect()
+	if err != nil {
+		c.Close()
+		return nil, badGateway(err)
+	}
+
+	// enable spectate cache in plugin if broker accepted it
+	setupPlugin := func(p Plugin) {
+		if h, ok := p.(*Hisoutensoku); ok && c.SpectatorHost() != "" {
+			h.SetSpectateCache(true)
+		}
+	}
+	if a, ok := p.(*AutoPlugin); ok {
+		a.SetDetectFunc(func(_ int, p Plugin) {
+			setupPlugin(p)
+		})
+	} else {
+		setupPlugin(p)
+	}
+
+	id := s.Attach(c, p)
+
+	go func() {
+		var err error
+		if p != nil {
+			err = c.Serve(p.ReadFunc, p.WriteFunc, p.GoroutineFunc, p.SetQuitFlag)
+		} else {
+			err = c.Serve(nil, nil, nil, nil)
+		}
+		if err != nil {
+			loggerControl.WithError(err).Error("Tunnel ", id, " serve error")
+		}
+
+		c.Close()
+		s.Detach(id, err)
+	}()
+
+	return s.Tunnel(id), nil
+}
+
+// bestBroker select broker with lowest latency in network of server
+func bestBroker(server string, policy RankPolicy) (string, error) {
+
+	brokers, err := RankNetBrokers(server, policy)
+	if err != nil {
+		return "", err
+	}
+	if len(brokers) == 0 || !brokers[0].Reachable {
+		return "", errors.New("no broker reachable in network of " + server)
+	}
+	loggerControl.Info("Select broker ", brokers[0].Address)
+
+	return brokers[0].Address, nil
+}
+
+// Attach add connected tunnel served by caller, plugin events are published with tunnel id,
+// call Detach after serving
+func (s *ControlServer) Attach(c *Client, p Plugin) int {
+
+	s.lock.Lock()
+	t := &controlTunnel{id: s.nextId, client: c, plugin: p}
+	s.tunnels[t.id] = t
+	s.nextId++
+	s.lock.Unlock()
+
+	eventFunc := func(e Event) {
+		e.TunnelId = t.id
+		s.events.Publish(e)
+	}
+	setEventFunc := func(p Plugin) {
+		switch h := p.(type) {
+		case *Hisoutensoku:
+			h.SetEventFunc(eventFunc)
+		case *Hyouibana:
+			h.SetEventFunc(eventFunc)
+		}
+	}
+	if a, ok := p.(*AutoPlugin); ok {
+		if ap := a.Plugin(); ap != nil {
+			setEventFunc(ap)
+		} else {
+			detectFunc := a.detectFunc
+			a.SetDetectFunc(func(game int, p Plugin) {
+				if detectFunc != nil {
+					detectFunc(game, p)
+				}
+				setEventFunc(p)
+			})
+		}
+	} else {
+		setEventFunc(p)
+	}
+
+	s.events.Publish(Event{Type: EventTunnelCreated, TunnelId: t.id, Tunnel: t.info()})
+
+	return t.id
+}
+
+// Detach remove tunnel attached, err is serve error or nil
+func (s *ControlServer) Detach(id int, err error) {
+
+	s.lock.Lock()
+	t, ok := s.tunnels[id]
+	delete(s.tunnels, id)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		s.events.Publish(Event{Type: EventTunnelError, TunnelId: id, Tunnel: t.info(), Error: err.Error()})
+	}
+	s.events.Publish(Event{Type: EventTunnelClosed, TunnelId: id, Tunnel: t.info()})
+}
+
+// Tunnel status of tunnel with id, nil if not found
+func (s *ControlServer) Tunnel(id int) *TunnelInfo {
+
+	s.lock.Lock()
+	t, ok := s.tunnels[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return t.info()
+}
+
+// CloseTunnel close tunnel with id
+func (s *ControlServer) CloseTunnel(id int) error {
+
+	s.lock.Lock()
+	t, ok := s.tunnels[id]
+	s.lock.Unlock()
+	if !ok {
+		return errors.New("no such tunnel " + strconv.Itoa(id))
+	}
+
+	t.client.Close()
+
+	return nil
+}
+
+// Tunnels status of all tunnels sorted by id
+func (s *ControlServer) Tunnels() []*TunnelInfo {
+
+	s.lock.Lock()
+	tunnels := make([]*controlTunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].id < tunnels[j].id
+	})
+
+	infos := make([]*TunnelInfo, len(tunnels))
+	for i, t := range tunnels {
+		infos[i] = t.info()
+	}
+
+	return infos
+}
+
+// Events event bus of all tunnels
+func (s *ControlServer) Events() *EventBus {
+	return s.events
+}
+
+// watch publish delay samples, and tunnel_status event when tunnel status changed
+func (s *ControlServer) watch() {
+
+	for {
+		s.lock.Lock()
+		quit := s.quitFlag
+		tunnels := make([]*controlTunnel, 0, len(s.tunnels))
+		for _, t := range s.tunnels {
+			tunnels = append(tunnels, t)
+		}
+		s.lock.Unlock()
+
+		if quit {
+			break
+		}
+
+		for _, t := range tunnels {
+			info := t.info()
+			if info.Status == tunnelStatusNames[utils.STATUS_CONNECTED] {
+				s.events.Publish(Event{Type: EventDelay, TunnelId: t.id, DelayMs: info.DelayMs})
+			}
+
+			// delay changes every second, not a status change
+			cmp := *info
+			cmp.DelayMs = 0
+			if cmp.Plugin != nil {
+				p := *cmp.Plugin
+				p.ReplayDelayMs = 0
+				p.SokuRoll = nil
+				cmp.Plugin = &p
+			}
+			status, _ := json.Marshal(&cmp)
+			if string(status) != string(t.status) {
+				t.status = status
+				s.events.Publish(Event{Type: EventTunnelStatus, TunnelId: t.id, Tunnel: info})
+			}
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// info make TunnelInfo of tunnel
+func (t *controlTunnel) info() *TunnelInfo {
+	return NewTunnelInfo(t.id, t.client, t.plugin)
+}
+
+// NewTunnelInfo make TunnelInfo of connected client c with plugin p, p may be nil
+func NewTunnelInfo(id int, c *Client, p Plugin) *TunnelInfo {
+
+	info := &TunnelInfo{
+		Id:            id,
+		LocalPort:     c.LocalPort(),
+		Server:        c.ServerHost(),
+		TunnelType:    c.TunnelType(),
+		PeerHost:      c.PeerHost(),
+		SpectatorHost: c.SpectatorHost(),
+		RoomCode:      c.RoomCode(),
+		Join:          c.Join(),
+		JoinVia:       c.JoinVia(),
+		Status:        tunnelStatusNames[c.TunnelStatus()],
+		DelayMs:       float64(c.TunnelDelay().Nanoseconds()) / 1000000,
+		Path:          c.TunnelPath(),
+		Serving:       c.Serving(),
+	}
+
+	if a, ok := p.(*AutoPlugin); ok {
+		p = a.Plugin()
+		if p == nil {
+			info.Plugin = &PluginStatus{Status: "detecting"}
+		}
+	}
+
+	switch h := p.(type) {
+	case *Hisoutensoku:
+		sokuRoll := h.GetSokuRoll()
+		info.Plugin = &PluginStatus{
+			Game:          h.GetGame(),
+			Status:        status123Names[h.PeerStatus],
+			Spectators:    h.GetSpectatorCount(),
+			ReplayDelayMs: float64(h.GetReplayDelay().Nanoseconds()) / 1000000,
+		}
+		if sokuRoll.Enabled {
+			info.Plugin.SokuRoll = &sokuRoll
+		}
+	case *Hyouibana:
+		info.Plugin = &PluginStatus{
+			Game:       155,
+			Status:     status155Names[h.MatchStatus],
+			Spectators: h.GetSpectatorCount(),
+		}
+	}
+
+	return info
+}
+
+func (s *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	s.lock.Lock()
+	count := len(s.tunnels)
+	s.lock.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":        utils.Version,
+		"channel":        utils.Channel,
+		"tunnel_version": utils.TunnelVersion,
+		"tunnels":        count,
+	})
+}
+
+func (s *ControlServer) handleBrokers(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	server := r.URL.Query().Get("server")
+	if server == "" {
+		server = DefaultServerHost
+	}
+
+	brokers, err := RankNetBrokers(server, s.getRankPolicy())
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, brokers)
+}
+
+func (s *ControlServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Tunnels())
+
+	case http.MethodPost:
+		var req TunnelRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		info, err := s.NewTunnel(req)
+		if err != nil {
+			code := http.StatusInternalServerError
+			var te *tunnelError
+			if errors.As(err, &te) {
+				code = te.code
+			}
+			writeJSONError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *ControlServer) handleTunnel(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/tunnels/"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("invalid tunnel id"))
+		return
+	}
+
+	s.lock.Lock()
+	t, ok := s.tunnels[id]
+	s.lock.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such tunnel "+strconv.Itoa(id)))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, t.info())
+
+	case http.MethodDelete:
+		t.client.Close()
+		writeJSON(w, http.StatusOK, t.info())
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *ControlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	tunnelId := 0
+	if q := r.URL.Query().Get("tunnel"); q != "" {
+		var err error
+		tunnelId, err = strconv.Atoi(q)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.New("invalid tunnel id"))
+			return
+		}
+	}
+
+	ch := s.events.Subscribe()
+	defer s.events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(e Event) error {
+		if tunnelId != 0 && e.TunnelId != tunnelId {
+			return nil
+		}
+		data, err := json.Marshal(&e)
+		if err != nil {
+			loggerControl.WithError(err).Error("Marshal event error")
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		return err
+	}
+
+	// current tunnels first, so subscriber needs no GET /tunnels
+	for _, info := range s.Tunnels() {
+		if writeEvent(Event{Type: EventTunnelStatus, Time: time.Now(), TunnelId: info.Id, Tunnel: info}) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-ch:
+			if writeEvent(e) != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *ControlServer) handleOverlay(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(overlayPage)
+}
+
+// writeJSON write v as JSON response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		loggerControl.WithError(err).Warn("Write response error")
+	}
+}
+
+// writeJSONError write {"error": err} as JSON response
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+	s := NewControlServer()
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	do := func(method, path, contentType, body string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.Token())
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/status", "", "", nil)
+	var status map[string]interface{}
+	err := json.NewDecoder(resp.Body).Decode(&status)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || status["tunnels"] != float64(0) {
+		t.Fatal("Get status failed: ", resp.StatusCode, status)
+	}
+
+	resp = do(http.MethodGet, "/tunnels", "", "", nil)
+	var tunnels []TunnelInfo
+	err = json.NewDecoder(resp.Body).Decode(&tunnels)
+	_ = resp.Body.Close()
+	if err != nil || len(tunnels) != 0 {
+		t.Fatal("Tunnel list should be empty: ", tunnels)
+	}
+
+	resp = do(http.MethodDelete, "/tunnels/1", "", "", nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Close unknown tunnel should be 404: ", resp.StatusCode)
+	}
+
+	for _, body := range []string{"{", `{"game": "th999"}`, `{"plugin": 1}`, `{"local_port": 70000}`} {
+		resp = do(http.MethodPost, "/tunnels", "application/json", body, nil)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error("Bad tunnel request ", body, " should be 400: ", resp.StatusCode)
+		}
+	}
+
+	// broker not reachable
+	resp = do(http.MethodPost, "/tunnels", "application/json", `{"server": "127.0.0.1:1"}`, nil)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Tunnel request to unreachable broker should be 502: ", resp.StatusCode)
+	}
+
+	// cross-site requests
+	for _, c := range []struct {
+		method, contentType string
+		header              map[string]string
+		code                int
+	}{
+		{http.MethodPost, "application/json", map[string]string{"Authorization": ""}, http.StatusUnauthorized},
+		{http.MethodPost, "application/json", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{http.MethodPost, "text/plain", nil, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "application/x-www-form-urlencoded", nil, http.StatusUnsupportedMediaType},
+		{http.MethodGet, "", map[string]string{"Host": "evil.example:4647"}, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(c.method, ts.URL+"/tunnels", strings.NewReader(`{"game": "th123"}`))
+		req.Header.Set("Authorization", "Bearer "+s.Token())
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		for k, v := range c.header {
+			if k == "Host" {
+				req.Host = v
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Error("Request ", c, " should be ", c.code, ": ", resp.StatusCode)
+		}
+	}
+
+	// browser source passes token in query
+	resp, err = http.Get(ts.URL + "/status?token=" + s.Token())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("GET with token in query should be 200: ", resp.StatusCode)
+	}
+}
+
+func TestOverlayServer(t *testing.T) {
+	s := NewOverlayServer()
+	ts := httptest.NewServer(s.OverlayHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Overlay page should be 200: ", resp.StatusCode)
+	}
+
+	// no control routes
+	resp, err = http.Post(ts.URL+"/tunnels", "application/json", strings.NewReader(`{"game": "th123"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Overlay server should not serve POST /tunnels: ", resp.StatusCode)
+	}
+	for _, path := range []string{"/tunnels", "/tunnels/1", "/brokers", "/status"} {
+		resp, err = http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("Overlay server should not serve ", path, ": ", resp.StatusCode)
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus()
+	ch := b.Subscribe()
+
+	h := NewHisoutensoku()
+	h.SetEventFunc(func(e Event) {
+		e.TunnelId = 1
+		b.Publish(e)
+	})
+	h.WriteFunc(th123InitSuccess(0, NOSPECTATE_123, "host", "client"))
+	h.flush()
+
+	e := <-ch
+	if e.Type != EventPlayers || e.TunnelId != 1 || e.Game != 123 || e.Time.IsZero() {
+		t.Fatal("Players event not published: ", e)
+	}
+	if e.Host == nil || e.Host.Profile != "host" || e.Client == nil || e.Client.Profile != "client" {
+		t.Error("Players event with wrong profiles: ", e.Host, e.Client)
+	}
+
+	b.Unsubscribe(ch)
+	b.Publish(Event{Type: EventDelay})
+	select {
+	case e = <-ch:
+		t.Error("Event sent after unsubscribe: ", e)
+	default:
+	}
+}
@@ -0,0 +1,531 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerDirect = logrus.WithField("Direct", "internal")
+
+// path of game data between host and guest
+const (
+	PathRelay  = "relay"  // forwarded by broker
+	PathDirect = "direct" // udp between host and guest after hole punching
+)
+
+const (
+	punchTries    = 30                     // hole punching pings before give up
+	punchPeerMax  = 16                     // guests trying hole punching with host
+	punchInterval = time.Millisecond * 100 // hole punching ping interval
+	directTimeout = time.Second * 5        // direct path is broken if nothing received in it
+)
+
+// directPeer guest talking with host client directly
+type directPeer struct {
+	addr *net.UDPAddr // observed endpoint of guest
+	game *net.UDPConn // dial to local game, nil before hole punching succeeded
+	last time.Time    // last package from guest
+}
+
+// registerEndpoint send register package carrying nonce from conn to broker udp port and wait for PUNCH_PEER,
+// return its data or error if broker does not answer
+func registerEndpoint(conn *net.UDPConn, relayAddr *net.UDPAddr, punchType utils.PunchType, nonce []byte) ([]byte, error) {
+
+	buf := make([]byte, utils.CmdBufSize)
+
+	for i := 0; i < 3; i++ {
+		_, err := conn.WriteToUDP(utils.NewPunchPackage(punchType, nonce), relayAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		n, addr, err := conn.ReadFromUDP(buf)
+		_ = conn.SetReadDeadline(time.Time{})
+		if err != nil || addr.String() != relayAddr.String() {
+			continue
+		}
+
+		t, data, ok := utils.ParsePunchPackage(buf[:n])
+		if ok && t == utils.PUNCH_PEER {
+			return append([]byte{}, data...), nil
+		}
+	}
+
+	return nil, errors.New("broker may not support rendezvous")
+}
+
+// SetDirect try direct connection with guests after next Connect,
+// guests need to join with Guest, others stay on relay. Plugins are not supported,
+// Serve refuses plugin callbacks when direct connection is enabled
+func (c *Client) SetDirect(direct bool) {
+	c.direct = direct
+}
+
+// Direct get whether direct connection is enabled
+func (c *Client) Direct() bool {
+	return c.direct
+}
+
+// TunnelPath get path of game data, PathDirect if any guest talks with host directly
+func (c *Client) TunnelPath() string {
+	c.punchLock.Lock()
+	defer c.punchLock.Unlock()
+
+	for _, p := range c.punchPeers {
+		if p.game != nil && time.Since(p.last) < directTimeout {
+			return PathDirect
+		}
+	}
+
+	return PathRelay
+}
+
+// startDirect register host endpoint to broker udp port relayAddr and wait for guests
+func (c *Client) startDirect(relayAddr string) error {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+
+	data, err := registerEndpoint(conn, udpAddr, utils.PUNCH_HOST, c.punchNonce)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	loggerDirect.Info("Host endpoint observed by broker ", string(data))
+
+	c.punchLock.Lock()
+	c.punchConn = conn
+	c.punchPeers = make(map[string]*directPeer)
+	c.punchLock.Unlock()
+
+	c.tunnel.SetFrameCallback(func(t utils.DataType, data []byte) {
+		if t != utils.RENDEZVOUS {
+			return
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", string(data))
+		if err != nil {
+			loggerDirect.WithError(err).Warn("Invalid guest endpoint")
+			return
+		}
+		go c.punchGuest(conn, addr)
+	})
+	go c.servePunch(conn)
+
+	return nil
+}
+
+// punchGuest send hole punching pings to guest until it answers
+func (c *Client) punchGuest(conn *net.UDPConn, addr *net.UDPAddr) {
+
+	c.punchLock.Lock()
+	if _, ok := c.punchPeers[addr.String()]; ok || len(c.punchPeers) >= punchPeerMax {
+		// already punching or too many guests
+		c.punchLock.Unlock()
+		return
+	}
+	peer := &directPeer{addr: addr}
+	c.punchPeers[addr.String()] = peer
+	c.punchLock.Unlock()
+
+	loggerDirect.Info("Try hole punching with guest ", addr.String())
+
+	for i := 0; i < punchTries; i++ {
+		c.punchLock.Lock()
+		done := peer.game != nil
+		c.punchLock.Unlock()
+		if done {
+			return
+		}
+
+		_, err := conn.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PING, nil), addr)
+		if err != nil {
+			loggerDirect.WithError(err).Warn("Send hole punching package failed")
+			return
+		}
+		time.Sleep(punchInterval)
+	}
+
+	loggerDirect.Info("Hole punching with guest ", addr.String(), " failed, stay on relay")
+}
+
+// servePunch receive packages from guests on direct path and forward to local game
+func (c *Client) servePunch(conn *net.UDPConn) {
+
+	buf := make([]byte, utils.TransBufSize)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			loggerDirect.WithError(err).Debug("Direct path closed")
+			break
+		}
+
+		var game *net.UDPConn
+		c.punchLock.Lock()
+		peer, ok := c.punchPeers[addr.String()]
+		if ok {
+			peer.last = time.Now()
+			game = peer.game
+		}
+		c.punchLock.Unlock()
+		if !ok {
+			// only guests told by broker
+			continue
+		}
+
+		if t, _, ok := utils.ParsePunchPackage(buf[:n]); ok {
+			if t == utils.PUNCH_PING {
+				_, _ = conn.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PONG, nil), addr)
+			}
+			if game == nil {
+				c.directGuest(conn, peer)
+			}
+			continue
+		}
+
+		if game != nil {
+			_, _ = game.Write(buf[:n])
+		}
+	}
+}
+
+// directGuest connect local game for guest on direct path
+func (c *Client) directGuest(conn *net.UDPConn, peer *directPeer) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(c.localPort))
+	if err != nil {
+		loggerDirect.WithError(err).Error("Resolve local game address failed")
+		return
+	}
+	game, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		loggerDirect.WithError(err).Error("Dial local game failed")
+		return
+	}
+
+	c.punchLock.Lock()
+	peer.game = game
+	c.punchLock.Unlock()
+
+	loggerDirect.Info("Direct path established with guest ", peer.addr.String())
+
+	go func() {
+		buf := make([]byte, utils.TransBufSize)
+
+		for {
+			n, err := game.Read(buf)
+			if err != nil {
+				break
+			}
+			_, err = conn.WriteToUDP(buf[:n], peer.addr)
+			if err != nil {
+				break
+			}
+		}
+	}()
+}
+
+// stopDirect close direct path
+func (c *Client) stopDirect() {
+	c.punchLock.Lock()
+	defer c.punchLock.Unlock()
+
+	if c.punchConn != nil {
+		_ = c.punchConn.Close()
+		c.punchConn = nil
+	}
+	for _, p := range c.punchPeers {
+		if p.game != nil {
+			_ = p.game.Close()
+		}
+	}
+	c.punchPeers = nil
+}
+
+// Guest guest side of direct connection, local game connects to it instead of the relay address
+// given by host. Game data goes to host directly after hole punching succeeded, or to relay otherwise
+type Guest struct {
+	lock sync.Mutex
+
+	localPort int
+	peerHost  string // relay address on broker
+
+	conn      *net.UDPConn // local game connects to it
+	punchConn *net.UDPConn // talk with host and relay
+	relayAddr *net.UDPAddr
+	hostAddr  *net.UDPAddr // observed endpoint of host, nil if broker does not know
+	gameAddr  *net.UDPAddr // local game address
+
+	direct     bool      // game data goes to host directly, decided before local game connects
+	lastDirect time.Time // last package from host on direct path
+	serving    bool
+}
+
+// NewGuest set up guest forwarding localPort to relay address peerHost
+func NewGuest(localPort int, peerHost string) (*Guest, error) {
+
+	if localPort <= 0 || localPort > 65535 {
+		return nil, errors.New("Invalid port " + strconv.Itoa(localPort))
+	}
+
+	_, _, err := net.SplitHostPort(peerHost)
+	if err != nil {
+		return nil, errors.New("Invalid hostname " + peerHost)
+	}
+
+	return &Guest{
+		localPort: localPort,
+		peerHost:  peerHost,
+	}, nil
+}
+
+// Connect listen local port and ask broker for host endpoint
+func (g *Guest) Connect() error {
+
+	var err error
+
+	g.relayAddr, err = net.ResolveUDPAddr("udp", g.peerHost)
+	if err != nil {
+		return err
+	}
+
+	g.conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: g.localPort})
+	if err != nil {
+		return err
+	}
+	g.punchConn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = g.conn.Close()
+		return err
+	}
+
+	loggerDirect.Info("Local game can connect to port ", g.localPort)
+
+	data, err := registerEndpoint(g.punchConn, g.relayAddr, utils.PUNCH_GUEST, nil)
+	if err != nil {
+		loggerDirect.WithError(err).Warn("Rendezvous failed, use relay")
+		return nil
+	}
+	if len(data) == 0 {
+		loggerDirect.Info("Host does not accept direct connection, use relay")
+		return nil
+	}
+
+	g.hostAddr, err = net.ResolveUDPAddr("udp", string(data))
+	if err != nil {
+		loggerDirect.WithError(err).Warn("Invalid host endpoint, use relay")
+		return nil
+	}
+	loggerDirect.Info("Try hole punching with host ", g.hostAddr.String())
+
+	// host game sees relay and direct path as different peers,
+	// so path is decided here before local game connects and never switched to direct later
+	direct := g.punchHost()
+	g.lock.Lock()
+	g.direct = direct
+	g.lastDirect = time.Now()
+	g.lock.Unlock()
+	if direct {
+		loggerDirect.Info("Use ", PathDirect, " path")
+	} else {
+		loggerDirect.Info("Hole punching with host failed, use relay")
+	}
+
+	return nil
+}
+
+// punchHost send hole punching pings to host until it answers, return false if host never answers
+func (g *Guest) punchHost() bool {
+
+	buf := make([]byte, utils.CmdBufSize)
+
+	for i := 0; i < punchTries; i++ {
+		_, err := g.punchConn.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PING, nil), g.hostAddr)
+		if err != nil {
+			return false
+		}
+
+		deadline := time.Now().Add(punchInterval)
+		for {
+			_ = g.punchConn.SetReadDeadline(deadline)
+			n, addr, err := g.punchConn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if addr.String() != g.hostAddr.String() {
+				continue
+			}
+			if _, _, ok := utils.ParsePunchPackage(buf[:n]); ok {
+				_ = g.punchConn.SetReadDeadline(time.Time{})
+				return true
+			}
+		}
+	}
+	_ = g.punchConn.SetReadDeadline(time.Time{})
+
+	return false
+}
+
+// Serve forward data between local game and host, return when closed
+func (g *Guest) Serve() error {
+
+	if g.conn == nil {
+		return errors.New("not connected")
+	}
+	g.lock.Lock()
+	g.serving = true
+	direct := g.direct
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		g.serving = false
+		g.lock.Unlock()
+	}()
+
+	if direct {
+		go g.keepDirect()
+	}
+	go g.servePunch()
+
+	buf := make([]byte, utils.TransBufSize)
+
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		g.lock.Lock()
+		g.gameAddr = addr
+		g.lock.Unlock()
+
+		dst := g.relayAddr
+		if g.Path() == PathDirect {
+			dst = g.hostAddr
+		}
+		_, _ = g.punchConn.WriteToUDP(buf[:n], dst)
+	}
+}
+
+// keepDirect send pings to host on direct path, which also keep NAT mapping alive,
+// fall back to relay for good if host stops answering
+func (g *Guest) keepDirect() {
+
+	for {
+		g.lock.Lock()
+		serving := g.serving
+		g.lock.Unlock()
+		if !serving {
+			break
+		}
+
+		_, err := g.punchConn.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PING, nil), g.hostAddr)
+		if err != nil {
+			break
+		}
+
+		if g.Path() == PathRelay {
+			g.lock.Lock()
+			g.direct = false
+			g.lock.Unlock()
+			// host game sees a new peer on relay, game needs to connect again
+			loggerDirect.Warn("Direct path with host broken, use relay, game may need to reconnect")
+			break
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// servePunch forward data from host or relay to local game
+func (g *Guest) servePunch() {
+
+	buf := make([]byte, utils.TransBufSize)
+
+	for {
+		n, addr, err := g.punchConn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		fromHost := g.hostAddr != nil && addr.String() == g.hostAddr.String()
+		if !fromHost && addr.String() != g.relayAddr.String() {
+			continue
+		}
+
+		if t, _, ok := utils.ParsePunchPackage(buf[:n]); ok {
+			if fromHost {
+				g.lock.Lock()
+				g.lastDirect = time.Now()
+				g.lock.Unlock()
+
+				if t == utils.PUNCH_PING {
+					_, _ = g.punchConn.WriteToUDP(utils.NewPunchPackage(utils.PUNCH_PONG, nil), addr)
+				}
+			}
+			continue
+		}
+
+		g.lock.Lock()
+		if fromHost {
+			g.lastDirect = time.Now()
+		}
+		gameAddr := g.gameAddr
+		g.lock.Unlock()
+
+		if gameAddr != nil {
+			_, _ = g.conn.WriteToUDP(buf[:n], gameAddr)
+		}
+	}
+}
+
+// Path get path of game data
+func (g *Guest) Path() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.direct && time.Since(g.lastDirect) < directTimeout {
+		return PathDirect
+	}
+
+	return PathRelay
+}
+
+// LocalPort get local port game connects to
+func (g *Guest) LocalPort() int {
+	return g.localPort
+}
+
+// PeerHost get relay address on broker
+func (g *Guest) PeerHost() string {
+	return g.peerHost
+}
+
+// Close stop guest
+func (g *Guest) Close() {
+	g.lock.Lock()
+	g.serving = false
+	g.lock.Unlock()
+
+	if g.conn != nil {
+		_ = g.conn.Close()
+	}
+	if g.punchConn != nil {
+		_ = g.punchConn.Close()
+	}
+}
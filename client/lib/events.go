@@ -0,0 +1,96 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerEvent = logrus.WithField("Event", "internal")
+
+// EventType type of Event
+type EventType string
+
+const (
+	EventTunnelCreated EventType = "tunnel_created" // tunnel connected, Tunnel set
+	EventTunnelStatus  EventType = "tunnel_status"  // tunnel or plugin status changed, Tunnel set
+	EventTunnelError   EventType = "tunnel_error"   // tunnel serve error, Tunnel and Error set
+	EventTunnelClosed  EventType = "tunnel_closed"  // tunnel closed, Tunnel set
+	EventDelay         EventType = "delay"          // tunnel delay sample, DelayMs set
+	EventPlayers       EventType = "players"        // peer connected, Host and Client profiles set
+	EventMatchStart    EventType = "match_start"    // new match, MatchId and players set if known
+	EventMatchEnd      EventType = "match_end"      // match end, MatchId set
+	EventSpectatorJoin EventType = "spectator_join" // new spectator, Spectators set
+)
+
+// event channel buffer of subscriber
+const eventSubscriberSize = 64
+
+// Event client event published to EventBus
+type Event struct {
+	Type       EventType    `json:"type"`
+	Time       time.Time    `json:"time"`
+	TunnelId   int          `json:"tunnel_id,omitempty"`
+	Tunnel     *TunnelInfo  `json:"tunnel,omitempty"`
+	DelayMs    float64      `json:"delay_ms,omitempty"`
+	Game       int          `json:"game,omitempty"`
+	MatchId    int          `json:"match_id,omitempty"`
+	Spectators int          `json:"spectators,omitempty"`
+	Host       *MatchPlayer `json:"host,omitempty"`
+	Client     *MatchPlayer `json:"client,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// EventFunc plugin event callback
+type EventFunc func(Event)
+
+// EventBus publish events to subscribers
+type EventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+// NewEventBus new event bus
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+// Subscribe get channel of events, call Unsubscribe when done
+func (b *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, eventSubscriberSize)
+
+	b.lock.Lock()
+	b.subscribers[ch] = true
+	b.lock.Unlock()
+
+	return ch
+}
+
+// Unsubscribe stop sending event to ch
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.lock.Lock()
+	delete(b.subscribers, ch)
+	b.lock.Unlock()
+}
+
+// Publish send event to all subscribers, slow subscriber drops event
+func (b *EventBus) Publish(e Event) {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			loggerEvent.Debug("Drop event ", e.Type, " for slow subscriber")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/weilinfox/youmu-thlink/utils"
@@ -69,29 +70,65 @@ type hisoutensokuData struct {
 	// PeerAddr    [6]byte  // appear in HELLO
 	// TargetAddr  [6]byte  // appear in HELLO
 	// GameID      [16]byte // appear in INIT_REQUEST
-	InitSuccessPkg [81]byte // copy from INIT_SUCCESS
-	ClientProf     string   // parse from INIT_SUCCESS
-	HostProf       string   // parse from INIT_SUCCESS
-	Spectator      bool     // parse from INIT_SUCCESS
-	SwrDisabled    bool     // parse from INIT_SUCCESS
-
-	HostInfo    [45]byte          // parse from HOST_GAME GAME_MATCH
-	ClientInfo  [45]byte          // parse from HOST_GAME GAME_MATCH
+	InitSuccessPkg []byte // copy from INIT_SUCCESS
+	ClientProf     string // parse from INIT_SUCCESS
+	HostProf       string // parse from INIT_SUCCESS
+	Spectator      bool   // parse from INIT_SUCCESS
+	SwrDisabled    bool   // parse from INIT_SUCCESS, th12.3 only
+
+	HostInfo    []byte            // parse from HOST_GAME GAME_MATCH
+	ClientInfo  []byte            // parse from HOST_GAME GAME_MATCH
 	StageId     byte              // parse from HOST_GAME GAME_MATCH
 	MusicId     byte              // parse from HOST_GAME GAME_MATCH
 	RandomSeeds [4]byte           // parse from HOST_GAME GAME_MATCH
 	MatchId     byte              // parse from HOST_GAME GAME_MATCH
+	GameMatch   map[byte][]byte   // copy from HOST_GAME GAME_MATCH
 	ReplayData  map[byte][]uint16 // parse from HOST_GAME GAME_REPLAY
 	ReplayEnd   map[byte]bool     // parse from HOST_GAME GAME_REPLAY
 }
 
 func newHisoutensokuData() *hisoutensokuData {
 	return &hisoutensokuData{
+		GameMatch:  make(map[byte][]byte),
 		ReplayData: make(map[byte][]uint16),
 		ReplayEnd:  make(map[byte]bool),
 	}
 }
 
+// spectator123 replay fetching progress of a spectator
+type spectator123 struct {
+	matchId byte // match id spectator is fetching
+	frameId int  // last frame id sent to spectator
+}
+
+// SokuRollStatus SokuRoll status seen in current session,
+// negotiated delay and rollback frames are not known as payload layouts have no capture at hand
+type SokuRollStatus struct {
+	Enabled    bool          // SokuRoll package seen in current session
+	Negotiated bool          // SOKUROLL_SETTINGS acknowledged with SOKUROLL_SETTINGS_ACK
+	TimeDelay  time.Duration // delay between SOKUROLL_TIME from local game and SOKUROLL_TIME_ACK from peer
+}
+
+// swrProfile netplay protocol differences between th12.3 and th10.5,
+// th12.3 appends swr disabled flag to INIT_SUCCESS and button flag to player info
+type swrProfile struct {
+	game            int              // game number, 123 or 105
+	initSuccessLen  int              // INIT_SUCCESS length
+	playerInfoLen   int              // player info length in HOST_GAME GAME_MATCH
+	gameMatchLen    int              // HOST_GAME GAME_MATCH length
+	requestInterval time.Duration    // GAME_REPLAY_REQUEST interval
+	characterName   func(int) string // character name of character id
+}
+
+// th10.5 lengths are th12.3 ones without the appended flags and its request interval is th12.3 one,
+// none of them is checked against a th10.5 capture yet
+var (
+	swrProfile123 = &swrProfile{game: 123, initSuccessLen: 81, playerInfoLen: 45, gameMatchLen: 99,
+		requestInterval: time.Millisecond * 66, characterName: Th123CharacterName}
+	swrProfile105 = &swrProfile{game: 105, initSuccessLen: 77, playerInfoLen: 44, gameMatchLen: 97,
+		requestInterval: time.Millisecond * 66, characterName: Th105CharacterName}
+)
+
 type status123req byte
 
 const (
@@ -103,14 +140,39 @@ const (
 )
 
 type Hisoutensoku struct {
-	peerId         byte              // current host/client peer id (udp mutex id)
-	PeerStatus     Status123peer     // current peer status
-	peerData       *hisoutensokuData // current peer data record
-	gameId         map[byte][16]byte // game id record
-	repReqStatus   status123req      // GAME_REPLAY_REQUEST send status
-	repReqTime     time.Time         // request send time
-	repReqDelay    time.Duration     // delay between GAME_REPLAY_REQUEST and GAME_REPLAY package
-	spectatorCount int               // spectator counter
+	profile *swrProfile // game protocol profile
+
+	// WriteFunc, ReadFunc and GoroutineFunc run in different goroutines,
+	// lock guards peer data, spectators and status they share
+	lock sync.Mutex
+
+	peerId          byte                   // current host/client peer id (udp mutex id)
+	PeerStatus      Status123peer          // current peer status
+	peerData        *hisoutensokuData      // current peer data record
+	gameId          map[byte][16]byte      // game id record
+	repReqStatus    status123req           // GAME_REPLAY_REQUEST send status
+	repReqTime      time.Time              // request send time
+	repReqDelay     time.Duration          // delay between GAME_REPLAY_REQUEST and GAME_REPLAY package
+	spectatorIds    map[byte]bool          // spectators in current session
+	matchSpectators map[byte]bool          // spectators watching current match
+	spectators      map[byte]*spectator123 // spectator replay progress
+	spectatorChain  bool                   // local game is a spectator serving spectator peer
+
+	spectateCache   bool // push spectating data to broker spectate cache
+	cacheInit       bool // INIT_SUCCESS pushed to broker
+	cacheMatchId    byte // match id pushed to broker
+	cacheFrameId    int  // last frame id pushed to broker
+	cacheMatchEnded bool // match end pushed to broker
+
+	history        *MatchHistory // match history sink
+	historyMatchId byte          // last match id written into history
+
+	eventFunc EventFunc      // event callback, nil to disable
+	events    []Event        // events waiting for delivery in plugin goroutine
+	records   []*MatchRecord // match history waiting for writing in plugin goroutine
+
+	sokuRoll         SokuRollStatus // SokuRoll status of current session
+	sokuRollTimeSent time.Time      // send time of last SOKUROLL_TIME from local game
 
 	quitFlag bool // plugin quit flag
 }
@@ -119,14 +181,27 @@ var logger123 = logrus.WithField("Hisoutensoku", "internal")
 
 // NewHisoutensoku new Hisoutensoku spectating server
 func NewHisoutensoku() *Hisoutensoku {
+	return newSwr(swrProfile123)
+}
+
+// NewScarletWeatherRhapsody new th10.5 spectating server, which shares Hisoutensoku protocol
+func NewScarletWeatherRhapsody() *Hisoutensoku {
+	return newSwr(swrProfile105)
+}
+
+func newSwr(profile *swrProfile) *Hisoutensoku {
 	return &Hisoutensoku{
-		PeerStatus:     INACTIVE_123,
-		peerData:       newHisoutensokuData(),
-		gameId:         make(map[byte][16]byte),
-		repReqStatus:   INIT_123,
-		repReqDelay:    time.Second,
-		spectatorCount: 0,
-		quitFlag:       false,
+		profile:         profile,
+		PeerStatus:      INACTIVE_123,
+		peerData:        newHisoutensokuData(),
+		gameId:          make(map[byte][16]byte),
+		repReqStatus:    INIT_123,
+		repReqDelay:     time.Second,
+		spectatorIds:    make(map[byte]bool),
+		matchSpectators: make(map[byte]bool),
+		spectators:      make(map[byte]*spectator123),
+		spectatorChain:  false,
+		quitFlag:        false,
 	}
 }
 
@@ -134,39 +209,59 @@ func NewHisoutensoku() *Hisoutensoku {
 // orig: original data leads with 1 byte of client id
 func (h *Hisoutensoku) WriteFunc(orig []byte) (bool, []byte) {
 
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	switch type123pkg(orig[1]) {
 	case INIT_SUCCESS_123:
-		if len(orig)-1 == 81 {
+		if len(orig)-1 == h.profile.initSuccessLen {
 
 			switch spectate123type(orig[6]) {
 			case NOSPECTATE_123, SPECTATE_123:
 				// init success
-				h.peerData.Spectator = spectate123type(orig[6]) == SPECTATE_123
-				for i := 14; i <= 46; i++ {
-					if orig[i] == 0x00 || i == 46 {
-						h.peerData.HostProf = string(orig[14:i])
-						break
-					}
-				}
-				for i := 46; i <= 78; i++ {
-					if orig[i] == 0x00 || i == 78 {
-						h.peerData.ClientProf = string(orig[46:i])
-						break
-					}
-				}
-				h.peerData.SwrDisabled = (int(orig[78]) | int(orig[79])<<8 | int(80)<<16 | int(81)<<24) != 0
-
-				logger123.Debug("INIT_SUCCESS with host profile ", h.peerData.HostProf, " client profile ",
-					h.peerData.ClientProf, " swr disabled ", h.peerData.SwrDisabled)
+				h.parseInitSuccess(orig)
 
+				h.recordHistory()
 				h.peerId = orig[0]
 				h.PeerStatus = SUCCESS_123
 				h.peerData.MatchId = 0
+				h.historyMatchId = 0
+				h.sokuRoll = SokuRollStatus{}
+				h.spectatorChain = false
+				h.resetSpectators()
 
 				logger123.Info("Th123 peer init success: spectator=", h.peerData.Spectator)
+				h.emit(Event{Type: EventPlayers, Host: &MatchPlayer{Profile: h.peerData.HostProf}, Client: &MatchPlayer{Profile: h.peerData.ClientProf}})
 
 			case SPECTATE_FOR_SPECTATOR_123:
-				logger123.Warn("INIT_SUCCESS type SPECTATE_FOR_SPECTATOR appears here?")
+				if h.PeerStatus != INACTIVE_123 && orig[0] != h.peerId {
+					// another spectator of local spectator, local game is serving it
+					if h.spectatorJoin(orig[0]) {
+						logger123.Info("New spectator join local spectator")
+						h.emit(Event{Type: EventSpectatorJoin})
+					}
+					break
+				}
+
+				// local game is a spectator and this peer spectates it,
+				// record data local game sends and serve other spectators
+				h.recordHistory()
+				h.parseInitSuccess(orig)
+				h.peerData.InitSuccessPkg = append([]byte{}, orig[1:]...)
+
+				h.peerId = orig[0]
+				h.PeerStatus = BATTLE_123
+				h.peerData.MatchId = 0
+				h.historyMatchId = 0
+				h.sokuRoll = SokuRollStatus{}
+				h.spectatorChain = true
+				h.resetSpectators()
+				h.spectatorJoin(orig[0])
+
+				logger123.Info("Th123 spectator chain init success")
+				h.emit(Event{Type: EventPlayers, Host: &MatchPlayer{Profile: h.peerData.HostProf}, Client: &MatchPlayer{Profile: h.peerData.ClientProf}})
+				h.emit(Event{Type: EventSpectatorJoin})
+
 			default:
 				logger123.Warn("INIT_SUCCESS spectacle type cannot recognize")
 			}
@@ -180,6 +275,7 @@ func (h *Hisoutensoku) WriteFunc(orig []byte) (bool, []byte) {
 			logger123.Info("Th123 peer quit")
 			if orig[0] == h.peerId {
 				h.PeerStatus = INACTIVE_123
+				h.recordHistory()
 			}
 		} else {
 			logger123.Warn("QUIT with strange length ", len(orig)-1)
@@ -188,6 +284,11 @@ func (h *Hisoutensoku) WriteFunc(orig []byte) (bool, []byte) {
 	case CLIENT_GAME_123:
 		logger123.Warn("CLIENT_GAME should not appear here right? ", orig[1:])
 
+	case SOKUROLL_TIME, SOKUROLL_TIME_ACK, SOKUROLL_STATE, SOKUROLL_SETTINGS, SOKUROLL_SETTINGS_ACK:
+		if h.PeerStatus != INACTIVE_123 && orig[0] == h.peerId {
+			h.parseSokuRoll(orig, false)
+		}
+
 	case HOST_GAME_123:
 		switch data123pkg(orig[2]) {
 		case GAME_LOADED_ACK_123:
@@ -195,6 +296,22 @@ func (h *Hisoutensoku) WriteFunc(orig []byte) (bool, []byte) {
 				logger123.Info("Th123 battle loaded")
 				h.PeerStatus = BATTLE_123
 			}
+
+		case GAME_MATCH_123:
+			// spectator chain: local spectator sends match data to its spectator
+			if h.spectatorChain && orig[0] == h.peerId {
+				if len(orig)-1 == h.profile.gameMatchLen {
+					h.parseGameMatch(orig)
+				} else if len(orig)-1 != 59 {
+					logger123.Warn("HOST_GAME GAME_MATCH with strange length ", len(orig)-1)
+				}
+			}
+
+		case GAME_REPLAY_123:
+			// spectator chain: local spectator sends replay data to its spectator
+			if h.spectatorChain && orig[0] == h.peerId {
+				h.parseGameReplay(orig)
+			}
 		}
 	}
 
@@ -205,6 +322,9 @@ func (h *Hisoutensoku) WriteFunc(orig []byte) (bool, []byte) {
 // orig: original data leads with 1 byte of client id
 func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	switch type123pkg(orig[1]) {
 	case HELLO_123:
 		if len(orig)-1 == 37 {
@@ -247,7 +367,7 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 				} else if orig[26] == 0x00 && h.peerData.MatchId > 0 {
 					// replay request and match started
 					logger123.Info("Th123 spectacle int request from spectator")
-					return true, append([]byte{orig[0]}, h.peerData.InitSuccessPkg[:]...)
+					return true, append([]byte{orig[0]}, h.peerData.InitSuccessPkg...)
 				}
 			}
 
@@ -256,10 +376,10 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 		}
 
 	case INIT_SUCCESS_123:
-		if len(orig)-1 == 81 {
+		if len(orig)-1 == h.profile.initSuccessLen {
 			switch spectate123type(orig[6]) {
 			case SPECTATE_FOR_SPECTATOR_123:
-				copy(h.peerData.InitSuccessPkg[:], orig[1:])
+				h.peerData.InitSuccessPkg = append([]byte{}, orig[1:]...)
 				h.repReqStatus = SEND_123
 				logger123.Info("Th123 spectacle INIT_SUCCESS")
 
@@ -269,13 +389,31 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 			logger123.Warn("INIT_SUCCESS with strange length ", len(orig)-1)
 		}
 
+	case SOKUROLL_TIME, SOKUROLL_TIME_ACK, SOKUROLL_STATE, SOKUROLL_SETTINGS, SOKUROLL_SETTINGS_ACK:
+		if h.PeerStatus != INACTIVE_123 {
+			if orig[0] != h.peerId {
+				// spectators are served by plugin with vanilla spectating protocol and rollback
+				// only runs between players, so SokuRoll of spectator game gets no answer.
+				// spectator game still spectates, SokuRoll of peer game never sees these packages
+				logger123.Debug("Drop SokuRoll package from spectator ", orig[0])
+				return false, nil
+			}
+			h.parseSokuRoll(orig, true)
+		}
+
 	case QUIT_123:
 		if len(orig)-1 == 1 {
 			logger123.Info("Th123 peer quit")
 			if orig[0] == h.peerId {
 				h.PeerStatus = INACTIVE_123
 				h.repReqStatus = INIT_123
+				h.recordHistory()
 			} else {
+				h.spectatorQuit(orig[0])
+				if h.spectatorChain {
+					// local game is serving it
+					return false, orig
+				}
 				return false, nil
 			}
 		} else {
@@ -285,22 +423,13 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 	case HOST_GAME_123:
 		switch data123pkg(orig[2]) {
 		case GAME_MATCH_123:
-			if len(orig)-1 == 99 {
-				if orig[0] == h.peerId {
+			if len(orig)-1 == h.profile.gameMatchLen {
+				if orig[0] == h.peerId && !h.spectatorChain {
 					// game match data
-					copy(h.peerData.HostInfo[:], orig[3:48])
-					copy(h.peerData.ClientInfo[:], orig[48:93])
-					h.peerData.StageId = orig[93]
-					h.peerData.MusicId = orig[94]
-					copy(h.peerData.RandomSeeds[:], orig[95:99])
-					h.peerData.MatchId = orig[99]
-					h.peerData.ReplayData[orig[99]] = make([]uint16, 1) // 填充一个 garbage
-					h.peerData.ReplayEnd[orig[99]] = false
+					h.parseGameMatch(orig)
 
 					h.repReqStatus = SEND_123
 
-					logger123.Info("Th123 new match ", orig[99])
-
 					return false, nil
 				}
 			} else if len(orig)-1 != 59 {
@@ -308,68 +437,14 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 			}
 
 		case GAME_REPLAY_123:
-			if orig[0] == h.peerId {
+			if orig[0] == h.peerId && !h.spectatorChain {
 				// game replay data
-				if len(orig) > 4 && len(orig)-4 == int(orig[3]) {
-					timeDelay := time.Now().Sub(h.repReqTime)
-
-					r, err := zlib.NewReader(bytes.NewBuffer(orig[4:]))
-					if err != nil {
-						logger123.WithError(err).Error("Th123 new zlib reader error")
-					} else {
-						ans := make([]byte, utils.TransBufSize)
-						n, err := r.Read(ans)
-						_ = r.Close()
-
-						if err == io.EOF {
-							//   game_inputs_count 60 MAX
-							if n >= 10 && n-10 == int(ans[9])*2 {
-								frameId := int(ans[0]) | int(ans[1])<<8 | int(ans[2])<<16 | int(ans[3])<<24
-								endFrameId := int(ans[4]) | int(ans[5])<<8 | int(ans[6])<<16 | int(ans[7])<<24
-
-								data := h.peerData.ReplayData[ans[8]]
-								getDataLen := len(data) - 1
-								if getDataLen == -1 {
-									logger123.Error("Th123 no such match: ", ans[8])
-								} else if frameId-getDataLen <= int(ans[9]) {
-									newDataLen := frameId - getDataLen
-
-									if newDataLen > 0 {
-										newData := make([]uint16, newDataLen)
-
-										for i := 0; i < newDataLen; i++ {
-											newData[newDataLen-1-i] = uint16(ans[10+i*2])<<8 | uint16(ans[11+i*2])
-										}
-
-										h.peerData.ReplayData[ans[8]] = append(data, newData...)
-
-										if len(h.peerData.ReplayData[ans[8]])-1 != frameId {
-											logger123.Error("Th123 replay data not match after append new data")
-										}
-									}
-
-									if endFrameId != 0 && endFrameId == frameId && !h.peerData.ReplayEnd[ans[8]] {
-										logger123.Info("Th123 match end: ", ans[8])
-										h.peerData.ReplayEnd[ans[8]] = true
-										h.PeerStatus = BATTLE_WAIT_ANOTHER_123
-									}
-
-									h.repReqTime = time.Time{}
-									h.repReqDelay = timeDelay
-									h.repReqStatus = SEND_123
-								} else {
-									logger123.Warn("Replay data package drop: frame id ", frameId, " length ", ans[9])
-								}
-							} else {
-								logger123.Error("Replay data content invalid")
-							}
-						} else {
-							logger123.WithError(err).Error("Zlib decode error")
-						}
-						// fmt.Println(err == io.EOF, err, ans[:n])
-					}
-				} else {
-					logger123.Warn("Th123 replay data invalid")
+				timeDelay := time.Now().Sub(h.repReqTime)
+
+				if h.parseGameReplay(orig) {
+					h.repReqTime = time.Time{}
+					h.repReqDelay = timeDelay
+					h.repReqStatus = SEND_123
 				}
 			}
 
@@ -385,75 +460,61 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 			}
 
 		case GAME_REPLAY_REQUEST_123:
+			if h.spectatorChain && orig[0] == h.peerId {
+				// spectator of local spectator, let local game answer it
+				return false, orig
+			}
+
 			if len(orig)-1 == 7 {
 
 				// game replay request from spectator
 				frameId := int(orig[3]) | int(orig[4])<<8 | int(orig[5])<<16 | int(orig[6])<<24
-				if frameId == 0xffffffff || orig[7] < h.peerData.MatchId {
-					data := []byte{orig[0], byte(HOST_GAME_123), byte(GAME_MATCH_123)}
-					data = append(data, h.peerData.HostInfo[:]...)
-					data = append(data, h.peerData.ClientInfo[:]...)
-					data = append(data, h.peerData.StageId)
-					data = append(data, h.peerData.MusicId)
-					data = append(data, h.peerData.RandomSeeds[:]...)
-					data = append(data, h.peerData.MatchId)
-
+				spec, ok := h.spectators[orig[0]]
+				if frameId == 0xffffffff || !ok {
 					logger123.Debug("GAME_REPLAY_REQUEST reply with GAME_MATCH")
-					logger123.Info("New spectator join")
-					h.spectatorCount++
+					if h.spectatorJoin(orig[0]) {
+						logger123.Info("New spectator join")
+						h.emit(Event{Type: EventSpectatorJoin})
+					}
 
-					return true, data
+					h.spectators[orig[0]] = &spectator123{matchId: h.peerData.MatchId, frameId: 0}
 
-				} else if orig[7] == h.peerData.MatchId {
+					return true, h.gameMatchData(orig[0], h.peerData.MatchId)
 
-					data := []byte{orig[0], byte(HOST_GAME_123), byte(GAME_REPLAY_123)}
-
-					// replay data
-					repData := h.peerData.ReplayData[h.peerData.MatchId]
-					endFrameId := len(repData) - 1
-					sendFrameId := int(math.Min(float64(endFrameId), float64(frameId+60)))
-					var gameInput []byte
-					if frameId <= endFrameId {
-						// send 60 max
-						for i := sendFrameId; i > frameId; i-- {
-							gameInput = append(gameInput, []byte{byte(repData[i] >> 8), byte(repData[i])}...)
-						}
-					}
-					if len(gameInput)%4 != 0 {
-						logger123.Warn("Th123 game input is not time of 4 ?")
-					}
+				} else if orig[7] < h.peerData.MatchId {
 
-					// append addition data (frameId endFrameId matchId inputCount inputs)
-					gameInput = append([]byte{h.peerData.MatchId, byte(len(gameInput) >> 1)}, gameInput...)
-					if h.peerData.ReplayEnd[h.peerData.MatchId] {
-						if frameId == 0 {
-							// when some spectator finish fetching data,
-							// it will send 0 frame id, which lead to strange bug
-							gameInput = []byte{h.peerData.MatchId, 0}
-							sendFrameId = 0
+					// spectator is fetching earlier match
+					repData, ok := h.peerData.ReplayData[orig[7]]
+					if !ok || !h.peerData.ReplayEnd[orig[7]] ||
+						(spec.matchId == orig[7] && spec.frameId > 0 && frameId == 0) || frameId >= len(repData)-1 {
+						// earlier match not recorded or finished fetching, go to next match
+						nextId := orig[7] + 1
+						for ; nextId < h.peerData.MatchId; nextId++ {
+							if _, ok := h.peerData.GameMatch[nextId]; ok {
+								break
+							}
 						}
-						gameInput = append([]byte{byte(endFrameId), byte(endFrameId >> 8), byte(endFrameId >> 16), byte(endFrameId >> 24)}, gameInput...)
-					} else {
-						gameInput = append([]byte{0, 0, 0, 0}, gameInput...)
-					}
-					gameInput = append([]byte{byte(sendFrameId), byte(sendFrameId >> 8), byte(sendFrameId >> 16), byte(sendFrameId >> 24)}, gameInput...)
-
-					// zlib compress
-					var zlibData bytes.Buffer
-					zlibw := zlib.NewWriter(&zlibData)
-					_, err := zlibw.Write(gameInput)
-					if err != nil {
-						logger123.WithError(err).Error("Th123 zlib compress error")
+
+						logger123.Debug("GAME_REPLAY_REQUEST reply with GAME_MATCH ", nextId)
+						spec.matchId, spec.frameId = nextId, 0
+
+						return true, h.gameMatchData(orig[0], nextId)
 					}
-					_ = zlibw.Close()
 
-					// make data (0x09 size data)
-					data = append(data, byte(zlibData.Len()))
-					data = append(data, zlibData.Bytes()...)
+					data, sendFrameId := h.gameReplayData(orig[0], orig[7], frameId)
+					spec.matchId, spec.frameId = orig[7], sendFrameId
+
+					return true, data
+
+				} else if orig[7] == h.peerData.MatchId {
+
+					data, sendFrameId := h.gameReplayData(orig[0], orig[7], frameId)
+					spec.matchId, spec.frameId = orig[7], sendFrameId
 
-					if endFrameId == sendFrameId && h.PeerStatus == INACTIVE_123 {
+					if sendFrameId == len(h.peerData.ReplayData[orig[7]])-1 && h.PeerStatus == INACTIVE_123 {
 						// let spectator quit
 						logger123.Info("Th123 quit spectator")
+						h.spectatorQuit(orig[0])
 						return true, []byte{orig[0], byte(QUIT_123)}
 					}
 					return true, data
@@ -470,81 +531,557 @@ func (h *Hisoutensoku) ReadFunc(orig []byte) (bool, []byte) {
 	return false, orig
 }
 
+// parseInitSuccess parse profiles from INIT_SUCCESS package
+func (h *Hisoutensoku) parseInitSuccess(orig []byte) {
+
+	h.peerData.Spectator = spectate123type(orig[6]) != NOSPECTATE_123
+	for i := 14; i <= 46; i++ {
+		if i == 46 || orig[i] == 0x00 {
+			h.peerData.HostProf = string(orig[14:i])
+			break
+		}
+	}
+	for i := 46; i <= 78; i++ {
+		if i == 78 || orig[i] == 0x00 {
+			h.peerData.ClientProf = string(orig[46:i])
+			break
+		}
+	}
+	if len(orig) >= 82 {
+		h.peerData.SwrDisabled = utils.LittleIndia2Int(orig[78:82]) != 0
+	}
+
+	logger123.Debug("INIT_SUCCESS with host profile ", h.peerData.HostProf, " client profile ",
+		h.peerData.ClientProf, " swr disabled ", h.peerData.SwrDisabled)
+}
+
+// parseGameMatch parse HOST_GAME GAME_MATCH package and start recording new match
+func (h *Hisoutensoku) parseGameMatch(orig []byte) {
+
+	// last match may not end normally
+	h.recordHistory()
+
+	p := 3 + h.profile.playerInfoLen*2
+	h.peerData.HostInfo = append([]byte{}, orig[3:3+h.profile.playerInfoLen]...)
+	h.peerData.ClientInfo = append([]byte{}, orig[3+h.profile.playerInfoLen:p]...)
+	h.peerData.StageId = orig[p]
+	h.peerData.MusicId = orig[p+1]
+	copy(h.peerData.RandomSeeds[:], orig[p+2:p+6])
+	matchId := orig[p+6]
+	h.peerData.MatchId = matchId
+	h.peerData.GameMatch[matchId] = append([]byte{}, orig[1:p+7]...)
+	h.peerData.ReplayData[matchId] = make([]uint16, 1) // 填充一个 garbage
+	h.peerData.ReplayEnd[matchId] = false
+
+	// spectators still here watch the new match
+	h.matchSpectators = make(map[byte]bool, len(h.spectatorIds))
+	for id := range h.spectatorIds {
+		h.matchSpectators[id] = true
+	}
+
+	logger123.Info("Th", h.profile.game, " new match ", matchId)
+
+	host := parseTh123Player(h.peerData.HostProf, h.peerData.HostInfo, h.profile.characterName)
+	client := parseTh123Player(h.peerData.ClientProf, h.peerData.ClientInfo, h.profile.characterName)
+	h.emit(Event{Type: EventMatchStart, MatchId: int(matchId), Host: &host, Client: &client})
+}
+
+// parseGameReplay parse HOST_GAME GAME_REPLAY package and append replay data,
+// return true if data accepted
+func (h *Hisoutensoku) parseGameReplay(orig []byte) bool {
+
+	if len(orig) <= 4 || len(orig)-4 != int(orig[3]) {
+		logger123.Warn("Th123 replay data invalid")
+		return false
+	}
+
+	r, err := zlib.NewReader(bytes.NewBuffer(orig[4:]))
+	if err != nil {
+		logger123.WithError(err).Error("Th123 new zlib reader error")
+		return false
+	}
+
+	ans := make([]byte, utils.TransBufSize)
+	n, err := r.Read(ans)
+	_ = r.Close()
+
+	if err != io.EOF {
+		logger123.WithError(err).Error("Zlib decode error")
+		return false
+	}
+
+	//   game_inputs_count 60 MAX
+	if n < 10 || n-10 != int(ans[9])*2 {
+		logger123.Error("Replay data content invalid")
+		return false
+	}
+
+	frameId := int(ans[0]) | int(ans[1])<<8 | int(ans[2])<<16 | int(ans[3])<<24
+	endFrameId := int(ans[4]) | int(ans[5])<<8 | int(ans[6])<<16 | int(ans[7])<<24
+
+	data := h.peerData.ReplayData[ans[8]]
+	getDataLen := len(data) - 1
+	if getDataLen == -1 {
+		logger123.Error("Th123 no such match: ", ans[8])
+		return false
+	} else if frameId-getDataLen > int(ans[9]) {
+		logger123.Warn("Replay data package drop: frame id ", frameId, " length ", ans[9])
+		return false
+	}
+
+	newDataLen := frameId - getDataLen
+
+	if newDataLen > 0 {
+		newData := make([]uint16, newDataLen)
+
+		for i := 0; i < newDataLen; i++ {
+			newData[newDataLen-1-i] = uint16(ans[10+i*2])<<8 | uint16(ans[11+i*2])
+		}
+
+		h.peerData.ReplayData[ans[8]] = append(data, newData...)
+
+		if len(h.peerData.ReplayData[ans[8]])-1 != frameId {
+			logger123.Error("Th123 replay data not match after append new data")
+		}
+	}
+
+	if endFrameId != 0 && endFrameId == frameId && !h.peerData.ReplayEnd[ans[8]] {
+		logger123.Info("Th123 match end: ", ans[8])
+		h.peerData.ReplayEnd[ans[8]] = true
+		if ans[8] == h.peerData.MatchId {
+			h.PeerStatus = BATTLE_WAIT_ANOTHER_123
+			h.recordHistory()
+			h.emit(Event{Type: EventMatchEnd, MatchId: int(ans[8])})
+		}
+	}
+
+	return true
+}
+
+// parseSokuRoll parse SokuRoll package, fromPeer is true if it comes from peer.
+// Payload layouts are not documented by SokuRoll and no capture is at hand,
+// so only package types are used and negotiated delay and rollback are not read
+func (h *Hisoutensoku) parseSokuRoll(orig []byte, fromPeer bool) {
+
+	if !h.sokuRoll.Enabled {
+		logger123.Info("Th123 SokuRoll detected")
+		h.sokuRoll.Enabled = true
+	}
+
+	switch type123pkg(orig[1]) {
+	case SOKUROLL_TIME:
+		if !fromPeer {
+			h.sokuRollTimeSent = time.Now()
+		}
+
+	case SOKUROLL_TIME_ACK:
+		if fromPeer && !h.sokuRollTimeSent.IsZero() {
+			h.sokuRoll.TimeDelay = time.Now().Sub(h.sokuRollTimeSent)
+			h.sokuRollTimeSent = time.Time{}
+		}
+
+	case SOKUROLL_SETTINGS:
+		h.sokuRoll.Negotiated = false
+
+	case SOKUROLL_SETTINGS_ACK:
+		if !h.sokuRoll.Negotiated {
+			logger123.Info("Th123 SokuRoll settings negotiated")
+			h.sokuRoll.Negotiated = true
+		}
+
+	}
+}
+
+// recordHistory queue current match for match history once, lock before call
+func (h *Hisoutensoku) recordHistory() {
+
+	if h.history == nil || h.peerData.MatchId == 0 || h.historyMatchId == h.peerData.MatchId {
+		return
+	}
+	h.historyMatchId = h.peerData.MatchId
+
+	r := &MatchRecord{
+		Time:       time.Now(),
+		Game:       h.profile.game,
+		MatchId:    int(h.peerData.MatchId),
+		Host:       parseTh123Player(h.peerData.HostProf, h.peerData.HostInfo[:], h.profile.characterName),
+		Client:     parseTh123Player(h.peerData.ClientProf, h.peerData.ClientInfo[:], h.profile.characterName),
+		StageId:    int(h.peerData.StageId),
+		MusicId:    int(h.peerData.MusicId),
+		FrameCount: len(h.peerData.ReplayData[h.peerData.MatchId]) - 1,
+		Ended:      h.peerData.ReplayEnd[h.peerData.MatchId],
+		Spectators: len(h.matchSpectators),
+	}
+	if r.FrameCount < 0 {
+		r.FrameCount = 0
+	}
+
+	h.records = append(h.records, r)
+}
+
+// flush write queued match history and deliver queued events, call without lock
+func (h *Hisoutensoku) flush() {
+
+	h.lock.Lock()
+	history, records := h.history, h.records
+	eventFunc, events := h.eventFunc, h.events
+	h.records, h.events = nil, nil
+	h.lock.Unlock()
+
+	for _, r := range records {
+		if history == nil {
+			break
+		}
+		err := history.Write(r)
+		if err != nil {
+			loggerHistory.WithError(err).Error("Th123 write match history error")
+			continue
+		}
+		logger123.Info("Th123 match ", r.MatchId, " written into history: ", r.Host.CharacterName, " vs ", r.Client.CharacterName)
+	}
+
+	for _, e := range events {
+		if eventFunc == nil {
+			break
+		}
+		eventFunc(e)
+	}
+}
+
+// gameMatchData make HOST_GAME GAME_MATCH package of matchId for spectator id
+func (h *Hisoutensoku) gameMatchData(id byte, matchId byte) []byte {
+
+	if match, ok := h.peerData.GameMatch[matchId]; ok {
+		return append([]byte{id}, match...)
+	}
+
+	data := []byte{id, byte(HOST_GAME_123), byte(GAME_MATCH_123)}
+	data = append(data, h.peerData.HostInfo...)
+	data = append(data, h.peerData.ClientInfo...)
+	data = append(data, h.peerData.StageId)
+	data = append(data, h.peerData.MusicId)
+	data = append(data, h.peerData.RandomSeeds[:]...)
+	data = append(data, h.peerData.MatchId)
+
+	return data
+}
+
+// gameReplayData make HOST_GAME GAME_REPLAY package of matchId after frameId for spectator id,
+// return package and last frame id in package
+func (h *Hisoutensoku) gameReplayData(id byte, matchId byte, frameId int) ([]byte, int) {
+
+	data := []byte{id, byte(HOST_GAME_123), byte(GAME_REPLAY_123)}
+
+	// replay data
+	repData := h.peerData.ReplayData[matchId]
+	endFrameId := len(repData) - 1
+	sendFrameId := int(math.Min(float64(endFrameId), float64(frameId+60)))
+	var gameInput []byte
+	if frameId <= endFrameId {
+		// send 60 max
+		for i := sendFrameId; i > frameId; i-- {
+			gameInput = append(gameInput, []byte{byte(repData[i] >> 8), byte(repData[i])}...)
+		}
+	}
+	if len(gameInput)%4 != 0 {
+		logger123.Warn("Th123 game input is not time of 4 ?")
+	}
+
+	// append addition data (frameId endFrameId matchId inputCount inputs)
+	gameInput = append([]byte{matchId, byte(len(gameInput) >> 1)}, gameInput...)
+	if h.peerData.ReplayEnd[matchId] {
+		if frameId == 0 && matchId == h.peerData.MatchId {
+			// when some spectator finish fetching data,
+			// it will send 0 frame id, which lead to strange bug
+			gameInput = []byte{matchId, 0}
+			sendFrameId = 0
+		}
+		gameInput = append([]byte{byte(endFrameId), byte(endFrameId >> 8), byte(endFrameId >> 16), byte(endFrameId >> 24)}, gameInput...)
+	} else {
+		gameInput = append([]byte{0, 0, 0, 0}, gameInput...)
+	}
+	gameInput = append([]byte{byte(sendFrameId), byte(sendFrameId >> 8), byte(sendFrameId >> 16), byte(sendFrameId >> 24)}, gameInput...)
+
+	// zlib compress
+	var zlibData bytes.Buffer
+	zlibw := zlib.NewWriter(&zlibData)
+	_, err := zlibw.Write(gameInput)
+	if err != nil {
+		logger123.WithError(err).Error("Th123 zlib compress error")
+	}
+	_ = zlibw.Close()
+
+	// make data (0x09 size data)
+	data = append(data, byte(zlibData.Len()))
+	data = append(data, zlibData.Bytes()...)
+
+	return data, sendFrameId
+}
+
 func (h *Hisoutensoku) GoroutineFunc(tunnelConn interface{}, _ *net.UDPConn) {
 	logger123.Info("Th123 plugin goroutine start")
 	defer logger123.Info("Th123 plugin goroutine quit")
 
-bigLoop:
-	for {
-		if h.PeerStatus == BATTLE_123 {
-			switch h.repReqStatus {
-			case INIT_123:
-				if h.peerData.Spectator {
-					gameId := h.gameId[h.peerId]
-					requestData := append([]byte{h.peerId, byte(INIT_REQUEST_123)}, gameId[:]...) // INIT_REQUEST and game id
-					requestData = append(requestData, make([]byte, 8)...)                         // garbage
-					requestData = append(requestData, 0x00)                                       // spectacle request
-					requestData = append(requestData, 0x00)                                       //  data length 0
-					requestData = append(requestData, make([]byte, 38)...)                        // make it 65 bytes long
-
-					var err error
-					switch conn := tunnelConn.(type) {
-					case quic.Stream:
-						_, err = conn.Write(utils.NewDataFrame(utils.DATA, requestData))
-					case *net.TCPConn:
-						_, err = conn.Write(utils.NewDataFrame(utils.DATA, requestData))
-					}
-					if err != nil {
-						logger123.WithError(err).Error("Th123 send INIT_REQUEST error")
-						break
-					}
-					logger123.Info("Th123 send spectacle INIT_REQUEST")
-				}
+	for h.serveRound(tunnelConn) {
+		time.Sleep(h.profile.requestInterval)
+	}
+}
 
-			case SEND_123, SEND_AGAIN_123:
-				getId := len(h.peerData.ReplayData[h.peerData.MatchId]) - 1
+// tunnelFrame data frame waiting to be written to tunnel
+type tunnelFrame struct {
+	t    utils.DataType
+	data []byte
+}
 
-				requestData := []byte{h.peerId, byte(CLIENT_GAME_123), byte(GAME_REPLAY_REQUEST_123),
-					byte(getId), byte(getId >> 8), byte(getId >> 16), byte(getId >> 24), h.peerData.MatchId}
+// serveRound send GAME_REPLAY_REQUEST, push spectate cache and deliver events once, return false to quit.
+// frames are built with plugin locked and written after unlock, so slow tunnel never blocks game data
+func (h *Hisoutensoku) serveRound(tunnelConn interface{}) bool {
 
-				h.repReqTime = time.Now()
+	h.lock.Lock()
+	frames := h.requestFrames()
+	if h.spectateCache {
+		frames = append(frames, h.spectateCacheFrames()...)
+	}
+	quit := h.quitFlag
+	h.lock.Unlock()
+
+	for _, f := range frames {
+		err := writeTunnelFrame(tunnelConn, f.t, f.data)
+		if err != nil {
+			logger123.WithError(err).Error("Th123 write tunnel error")
+			return false
+		}
+	}
 
-				var err error
-				switch conn := tunnelConn.(type) {
-				case quic.Stream:
-					_, err = conn.Write(utils.NewDataFrame(utils.DATA, requestData))
-				case *net.TCPConn:
-					_, err = conn.Write(utils.NewDataFrame(utils.DATA, requestData))
-				}
-				if err != nil {
-					logger123.WithError(err).Error("Th123 send GAME_REPLAY_REQUEST error")
-					break bigLoop
-				}
+	h.flush()
+
+	return !quit
+}
 
-				h.repReqStatus = SENT0_123
+// requestFrames make INIT_REQUEST or GAME_REPLAY_REQUEST to fetch spectating data, lock before call
+func (h *Hisoutensoku) requestFrames() []tunnelFrame {
 
-			case SENT0_123, SENT1_123:
-				h.repReqStatus++
-			}
+	// in spectator chain local game is the data source, no need to fetch
+	if h.PeerStatus != BATTLE_123 || h.spectatorChain {
+		return nil
+	}
+
+	switch h.repReqStatus {
+	case INIT_123:
+		if h.peerData.Spectator {
+			gameId := h.gameId[h.peerId]
+			requestData := append([]byte{h.peerId, byte(INIT_REQUEST_123)}, gameId[:]...) // INIT_REQUEST and game id
+			requestData = append(requestData, make([]byte, 8)...)                         // garbage
+			requestData = append(requestData, 0x00)                                       // spectacle request
+			requestData = append(requestData, 0x00)                                       //  data length 0
+			requestData = append(requestData, make([]byte, 38)...)                        // make it 65 bytes long
+
+			logger123.Info("Th123 send spectacle INIT_REQUEST")
+			return []tunnelFrame{{utils.DATA, requestData}}
 		}
 
-		if h.quitFlag {
-			break
+	case SEND_123, SEND_AGAIN_123:
+		getId := len(h.peerData.ReplayData[h.peerData.MatchId]) - 1
+
+		requestData := []byte{h.peerId, byte(CLIENT_GAME_123), byte(GAME_REPLAY_REQUEST_123),
+			byte(getId), byte(getId >> 8), byte(getId >> 16), byte(getId >> 24), h.peerData.MatchId}
+
+		h.repReqTime = time.Now()
+		h.repReqStatus = SENT0_123
+
+		return []tunnelFrame{{utils.DATA, requestData}}
+
+	case SENT0_123, SENT1_123:
+		h.repReqStatus++
+	}
+
+	return nil
+}
+
+// spectateCacheFrames make new INIT_SUCCESS, GAME_MATCH and replay data for broker spectate cache, lock before call
+func (h *Hisoutensoku) spectateCacheFrames() []tunnelFrame {
+
+	var frames []tunnelFrame
+
+	if h.PeerStatus == INACTIVE_123 {
+		if h.cacheInit {
+			// flush the rest and let broker quit spectators
+			frames = h.spectateReplayFrames()
+			frames = append(frames, tunnelFrame{utils.SPECTATE_CACHE, []byte{byte(utils.SPECTATE_QUIT)}})
+			h.cacheInit = false
+			h.cacheMatchId = 0
+			logger123.Info("Th123 spectate cache quit")
+		}
+		return frames
+	}
+
+	if !h.cacheInit {
+		if h.PeerStatus != BATTLE_123 || !h.peerData.Spectator || len(h.peerData.InitSuccessPkg) == 0 {
+			return nil
+		}
+		// InitSuccessPkg is INIT_SUCCESS host game sends to spectator, forward it as is
+		data := append([]byte{byte(utils.SPECTATE_INIT)}, h.peerData.InitSuccessPkg...)
+		frames = append(frames, tunnelFrame{utils.SPECTATE_CACHE, data})
+		h.cacheInit = true
+		logger123.Info("Th123 spectate cache init")
+	}
+
+	if h.peerData.MatchId != h.cacheMatchId {
+		// finish last match first
+		frames = append(frames, h.spectateReplayFrames()...)
+
+		match, ok := h.peerData.GameMatch[h.peerData.MatchId]
+		if !ok {
+			return frames
 		}
+		frames = append(frames, tunnelFrame{utils.SPECTATE_CACHE, append([]byte{byte(utils.SPECTATE_MATCH)}, match...)})
+		h.cacheMatchId = h.peerData.MatchId
+		h.cacheFrameId = 0
+		h.cacheMatchEnded = false
+	}
+
+	return append(frames, h.spectateReplayFrames()...)
+}
+
+// spectateReplayFrames make replay data of cacheMatchId not pushed yet, 60 frames per frame, lock before call
+func (h *Hisoutensoku) spectateReplayFrames() []tunnelFrame {
 
-		// 15 request per second
-		time.Sleep(time.Millisecond * 66)
+	if h.cacheMatchId == 0 {
+		return nil
 	}
+
+	var frames []tunnelFrame
+	repData := h.peerData.ReplayData[h.cacheMatchId]
+	ended := h.peerData.ReplayEnd[h.cacheMatchId]
+	for h.cacheFrameId < len(repData)-1 || (ended && !h.cacheMatchEnded) {
+		first := h.cacheFrameId + 1
+		last := len(repData) - 1
+		if last-first >= 60 {
+			last = first + 59
+		}
+
+		var end byte
+		if ended && last == len(repData)-1 {
+			end = 1
+		}
+		data := []byte{byte(utils.SPECTATE_INPUT), h.cacheMatchId,
+			byte(first), byte(first >> 8), byte(first >> 16), byte(first >> 24), end}
+		for i := first; i <= last; i++ {
+			data = append(data, byte(repData[i]>>8), byte(repData[i]))
+		}
+
+		frames = append(frames, tunnelFrame{utils.SPECTATE_CACHE, data})
+		h.cacheFrameId = last
+		h.cacheMatchEnded = end != 0
+	}
+
+	return frames
+}
+
+// writeTunnelFrame write data frame to quic stream or tcp connection
+func writeTunnelFrame(tunnelConn interface{}, t utils.DataType, data []byte) error {
+
+	var err error
+	switch conn := tunnelConn.(type) {
+	case quic.Stream:
+		_, err = conn.Write(utils.NewDataFrame(t, data))
+	case *net.TCPConn:
+		_, err = conn.Write(utils.NewDataFrame(t, data))
+	}
+
+	return err
 }
 
 func (h *Hisoutensoku) GetReplayDelay() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	return h.repReqDelay
 }
 
+// GetGame get game number of plugin profile, 123 or 105
+func (h *Hisoutensoku) GetGame() int {
+	return h.profile.game
+}
+
+// GetSokuRoll get SokuRoll status of current session
+func (h *Hisoutensoku) GetSokuRoll() SokuRollStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.sokuRoll
+}
+
+// GetSpectatorCount get count of spectators in current session
 func (h *Hisoutensoku) GetSpectatorCount() int {
-	return h.spectatorCount
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.spectatorIds)
+}
+
+// spectatorJoin count spectator id, return true if it is new in current session, lock before call
+func (h *Hisoutensoku) spectatorJoin(id byte) bool {
+	h.matchSpectators[id] = true
+	if h.spectatorIds[id] {
+		return false
+	}
+	h.spectatorIds[id] = true
+	return true
+}
+
+// spectatorQuit forget spectator id, lock before call
+func (h *Hisoutensoku) spectatorQuit(id byte) {
+	delete(h.spectatorIds, id)
+	delete(h.spectators, id)
+}
+
+// resetSpectators forget spectators of last session, lock before call
+func (h *Hisoutensoku) resetSpectators() {
+	h.spectatorIds = make(map[byte]bool)
+	h.matchSpectators = make(map[byte]bool)
+	h.spectators = make(map[byte]*spectator123)
+}
+
+// SetEventFunc set callback receiving players, match and spectator events,
+// callback is called in plugin goroutine without plugin locked
+func (h *Hisoutensoku) SetEventFunc(eventFunc EventFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.eventFunc = eventFunc
+}
+
+// emit queue event with game and spectator count filled, lock before call
+func (h *Hisoutensoku) emit(e Event) {
+	if h.eventFunc == nil {
+		return
+	}
+	e.Game = h.profile.game
+	e.Spectators = len(h.spectatorIds)
+	h.events = append(h.events, e)
+}
+
+// SetMatchHistory write record of every match into history, nil to disable
+func (h *Hisoutensoku) SetMatchHistory(history *MatchHistory) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.history = history
+}
+
+// SetSpectateCache push spectating data to broker spectate cache,
+// broker should be asked with Client.SetSpectateCache, th12.3 only
+func (h *Hisoutensoku) SetSpectateCache(spectateCache bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.spectateCache = spectateCache && h.profile.game == 123
 }
 
 func (h *Hisoutensoku) SetQuitFlag() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	h.quitFlag = true
 }
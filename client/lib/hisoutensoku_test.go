@@ -0,0 +1,274 @@
+package client
+
+import (
+	"bytes"
+	"compress/zlib"
+	"path/filepath"
+	"testing"
+)
+
+// th123InitSuccess make INIT_SUCCESS package with spectate type and profiles
+func th123InitSuccess(id byte, spectate spectate123type, host, client string) []byte {
+	data := make([]byte, 82)
+	data[0] = id
+	data[1] = byte(INIT_SUCCESS_123)
+	data[6] = byte(spectate)
+	copy(data[14:46], host)
+	copy(data[46:78], client)
+	return data
+}
+
+// th123GameMatch make HOST_GAME GAME_MATCH package
+func th123GameMatch(id byte, matchId byte) []byte {
+	data := make([]byte, 100)
+	data[0] = id
+	data[1] = byte(HOST_GAME_123)
+	data[2] = byte(GAME_MATCH_123)
+	data[3] = 14  // host character
+	data[48] = 15 // client character
+	data[93] = 3  // stage
+	data[94] = 3  // music
+	data[99] = matchId
+	return data
+}
+
+// th123GameReplay make HOST_GAME GAME_REPLAY package with inputs of (frameId-len(inputs), frameId]
+func th123GameReplay(t *testing.T, id byte, matchId byte, frameId, endFrameId int, inputs []uint16) []byte {
+	raw := []byte{byte(frameId), byte(frameId >> 8), byte(frameId >> 16), byte(frameId >> 24),
+		byte(endFrameId), byte(endFrameId >> 8), byte(endFrameId >> 16), byte(endFrameId >> 24),
+		matchId, byte(len(inputs))}
+	for i := len(inputs) - 1; i >= 0; i-- {
+		raw = append(raw, byte(inputs[i]>>8), byte(inputs[i]))
+	}
+
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	_, err := w.Write(raw)
+	if err != nil {
+		t.Fatal("Zlib compress error: ", err)
+	}
+	_ = w.Close()
+
+	return append([]byte{id, byte(HOST_GAME_123), byte(GAME_REPLAY_123), byte(z.Len())}, z.Bytes()...)
+}
+
+// th123ReplayRequest make CLIENT_GAME GAME_REPLAY_REQUEST package
+func th123ReplayRequest(id byte, frameId uint32, matchId byte) []byte {
+	return []byte{id, byte(CLIENT_GAME_123), byte(GAME_REPLAY_REQUEST_123),
+		byte(frameId), byte(frameId >> 8), byte(frameId >> 16), byte(frameId >> 24), matchId}
+}
+
+func TestSpectatorChain(t *testing.T) {
+	h := NewHisoutensoku()
+
+	// local game is a spectator and spectator 0 spectates it
+	_, data := h.WriteFunc(th123InitSuccess(0, SPECTATE_FOR_SPECTATOR_123, "host", "client"))
+	if data == nil || !h.spectatorChain || h.PeerStatus != BATTLE_123 {
+		t.Fatal("Spectator chain not detected")
+	}
+	if h.peerData.HostProf != "host" || h.peerData.ClientProf != "client" {
+		t.Error("Spectator chain profile not match: ", h.peerData.HostProf, " ", h.peerData.ClientProf)
+	}
+
+	// requests from spectator 0 are answered by local game
+	reply, data := h.ReadFunc(th123ReplayRequest(0, 0xffffffff, 0))
+	if reply || data == nil {
+		t.Error("Spectator chain request not sent to local game")
+	}
+
+	// local game sends match 1 to spectator 0
+	h.WriteFunc(th123GameMatch(0, 1))
+	h.WriteFunc(th123GameReplay(t, 0, 1, 4, 0, []uint16{1, 2, 3, 4}))
+	if h.peerData.MatchId != 1 || len(h.peerData.ReplayData[1]) != 5 {
+		t.Fatal("Spectator chain replay not recorded: ", h.peerData.MatchId, " ", len(h.peerData.ReplayData[1]))
+	}
+
+	// spectator 1 spectates spectator 0 via plugin
+	reply, data = h.ReadFunc(append([]byte{1, byte(INIT_REQUEST_123)}, make([]byte, 64)...))
+	if !reply || len(data) != 82 || spectate123type(data[6]) != SPECTATE_FOR_SPECTATOR_123 {
+		t.Fatal("Spectator 1 not get INIT_SUCCESS SPECTATE_FOR_SPECTATOR: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	if !reply || len(data) != 100 || data[99] != 1 {
+		t.Fatal("Spectator 1 not get GAME_MATCH: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 0, 1))
+	if !reply || data[2] != byte(GAME_REPLAY_123) {
+		t.Fatal("Spectator 1 not get GAME_REPLAY: ", data)
+	}
+
+	// spectator 1 restarts fetching, still counted once
+	h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	if c := h.GetSpectatorCount(); c != 2 {
+		t.Error("Spectator count not match: ", c)
+	}
+
+	// match 1 ends and match 2 starts, spectator 1 still fetch match 1
+	h.WriteFunc(th123GameReplay(t, 0, 1, 6, 6, []uint16{5, 6}))
+	h.WriteFunc(th123GameMatch(0, 2))
+	if !h.peerData.ReplayEnd[1] || h.peerData.MatchId != 2 {
+		t.Fatal("Spectator chain match 1 not end")
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 4, 1))
+	if !reply || data[2] != byte(GAME_REPLAY_123) {
+		t.Fatal("Spectator 1 not get earlier match GAME_REPLAY: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 6, 1))
+	if !reply || len(data) != 100 || data[99] != 2 {
+		t.Fatal("Spectator 1 not get next GAME_MATCH after finished earlier match: ", data)
+	}
+}
+
+func TestMatchHistory(t *testing.T) {
+	h := NewHisoutensoku()
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h.SetMatchHistory(NewMatchHistory(path))
+
+	h.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client"))
+
+	// match 1 with 2 cards in host deck ends normally
+	match := th123GameMatch(0, 1)
+	match[6] = 2
+	match[7], match[8] = 100, 0
+	match[9], match[10] = 0xc8, 0x00
+	h.ReadFunc(match)
+	h.ReadFunc(th123GameReplay(t, 0, 1, 2, 0, []uint16{1, 2}))
+
+	// spectator 1 watches match 1 only
+	h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	h.ReadFunc(th123GameReplay(t, 0, 1, 4, 4, []uint16{3, 4}))
+	h.ReadFunc([]byte{1, byte(QUIT_123)})
+
+	// match 2 interrupted by peer quit
+	h.ReadFunc(th123GameMatch(0, 2))
+	h.ReadFunc(th123GameReplay(t, 0, 2, 2, 0, []uint16{1, 2}))
+	h.ReadFunc([]byte{0, byte(QUIT_123)})
+	// history is written by plugin goroutine
+	h.flush()
+
+	records, err := ReadMatchHistory(path)
+	if err != nil {
+		t.Fatal("Read match history error: ", err)
+	}
+	if len(records) != 2 {
+		t.Fatal("Match history record count not match: ", len(records))
+	}
+
+	r := records[0]
+	if r.MatchId != 1 || !r.Ended || r.FrameCount != 4 || r.StageId != 3 || r.MusicId != 3 || r.Spectators != 1 {
+		t.Error("Match 1 record not match: ", r)
+	}
+	if r.Host.Profile != "host" || r.Host.CharacterName != "Tenshi" || r.Client.Profile != "client" || r.Client.CharacterName != "Sanae" {
+		t.Error("Match 1 players not match: ", r.Host, " ", r.Client)
+	}
+	if len(r.Host.Deck) != 2 || r.Host.Deck[0] != 100 || r.Host.Deck[1] != 200 {
+		t.Error("Match 1 host deck not match: ", r.Host.Deck)
+	}
+
+	r = records[1]
+	if r.MatchId != 2 || r.Ended || r.FrameCount != 2 || r.Spectators != 0 {
+		t.Error("Match 2 record not match: ", r)
+	}
+}
+
+func TestSokuRoll(t *testing.T) {
+	h := NewHisoutensoku()
+
+	h.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client"))
+
+	// only package types matter, payloads are placeholders
+
+	// settings negotiation
+	h.WriteFunc([]byte{0, byte(SOKUROLL_SETTINGS), 0, 0, 0, 0})
+	if s := h.GetSokuRoll(); !s.Enabled || s.Negotiated {
+		t.Fatal("SokuRoll settings not detected: ", s)
+	}
+	h.ReadFunc([]byte{0, byte(SOKUROLL_SETTINGS_ACK), 0, 0})
+	if s := h.GetSokuRoll(); !s.Negotiated {
+		t.Fatal("SokuRoll settings ack not detected: ", s)
+	}
+
+	// time sync
+	h.WriteFunc([]byte{0, byte(SOKUROLL_TIME), 0, 0, 0, 0, 0, 0, 0, 0})
+	h.ReadFunc([]byte{0, byte(SOKUROLL_TIME_ACK), 0, 0, 0, 0, 0, 0, 0, 0})
+	if s := h.GetSokuRoll(); s.TimeDelay < 0 || !h.sokuRollTimeSent.IsZero() {
+		t.Error("SokuRoll time delay not measured: ", s)
+	}
+
+	// strange length is tolerated
+	_, data := h.ReadFunc([]byte{0, byte(SOKUROLL_SETTINGS)})
+	if data == nil {
+		t.Error("Short SokuRoll package from peer dropped")
+	}
+
+	// SokuRoll package from spectator is dropped
+	_, data = h.ReadFunc([]byte{1, byte(SOKUROLL_STATE), 0, 0, 0, 0})
+	if data != nil {
+		t.Error("SokuRoll package from spectator not dropped")
+	}
+
+	// spectating still works
+	h.ReadFunc(th123GameMatch(0, 1))
+	h.ReadFunc(th123GameReplay(t, 0, 1, 2, 0, []uint16{1, 2}))
+	reply, data := h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	if !reply || len(data) != 100 || data[99] != 1 {
+		t.Fatal("Spectator not get GAME_MATCH with SokuRoll: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 0, 1))
+	if !reply || data[2] != byte(GAME_REPLAY_123) {
+		t.Fatal("Spectator not get GAME_REPLAY with SokuRoll: ", data)
+	}
+}
+
+func TestScarletWeatherRhapsody(t *testing.T) {
+	h := NewScarletWeatherRhapsody()
+
+	// th12.3 INIT_SUCCESS length not accepted
+	h.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client"))
+	if h.PeerStatus != INACTIVE_123 {
+		t.Fatal("Th105 accept th123 INIT_SUCCESS")
+	}
+
+	h.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client")[:78])
+	if h.PeerStatus != SUCCESS_123 || h.peerData.HostProf != "host" || h.peerData.ClientProf != "client" {
+		t.Fatal("Th105 INIT_SUCCESS not parsed: ", h.peerData.HostProf, " ", h.peerData.ClientProf)
+	}
+
+	h.WriteFunc([]byte{0, byte(HOST_GAME_123), byte(GAME_LOADED_ACK_123), 0x05})
+
+	// player info is 44 bytes long
+	match := make([]byte, 98)
+	match[1] = byte(HOST_GAME_123)
+	match[2] = byte(GAME_MATCH_123)
+	match[3] = 14 // host character
+	match[47] = 8 // client character
+	match[91] = 5 // stage
+	match[92] = 6 // music
+	match[97] = 1 // match id
+	h.ReadFunc(match)
+	if h.peerData.MatchId != 1 || h.peerData.StageId != 5 || h.peerData.MusicId != 6 || h.peerData.ClientInfo[0] != 8 {
+		t.Fatal("Th105 GAME_MATCH not parsed: ", h.peerData.MatchId, " ", h.peerData.StageId, " ", h.peerData.MusicId)
+	}
+	h.ReadFunc(th123GameReplay(t, 0, 1, 2, 0, []uint16{1, 2}))
+
+	// th10.5 roster has no th12.3 characters
+	if n := h.profile.characterName(int(h.peerData.HostInfo[0])); n != "Tenshi" || h.profile.characterName(15) != "Unknown" {
+		t.Error("Th105 character name error: ", n)
+	}
+
+	// spectator gets th105 packages
+	h.peerData.InitSuccessPkg = th123InitSuccess(0, SPECTATE_FOR_SPECTATOR_123, "host", "client")[1:78]
+	reply, data := h.ReadFunc(append([]byte{1, byte(INIT_REQUEST_123)}, make([]byte, 64)...))
+	if !reply || len(data) != 78 {
+		t.Fatal("Th105 spectator not get INIT_SUCCESS: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 0xffffffff, 0))
+	if !reply || len(data) != 98 || data[97] != 1 {
+		t.Fatal("Th105 spectator not get GAME_MATCH: ", data)
+	}
+	reply, data = h.ReadFunc(th123ReplayRequest(1, 0, 1))
+	if !reply || data[2] != byte(GAME_REPLAY_123) {
+		t.Fatal("Th105 spectator not get GAME_REPLAY: ", data)
+	}
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerHistory = logrus.WithField("History", "internal")
+
+// th123 character names by character id
+var th123Characters = []string{
+	"Reimu", "Marisa", "Sakuya", "Alice", "Patchouli", "Youmu", "Remilia", "Yuyuko", "Yukari", "Suika",
+	"Reisen", "Aya", "Komachi", "Iku", "Tenshi", "Sanae", "Cirno", "Meiling", "Utsuho", "Suwako",
+}
+
+// th10.5 character names by character id, th12.3 keeps these ids and appends its new characters
+var th105Characters = th123Characters[:15]
+
+// Th123CharacterName get th123 character name of character id
+func Th123CharacterName(id int) string {
+	return characterName(th123Characters, id)
+}
+
+// Th105CharacterName get th10.5 character name of character id
+func Th105CharacterName(id int) string {
+	return characterName(th105Characters, id)
+}
+
+// characterName get name of character id in names
+func characterName(names []string, id int) string {
+	if id < 0 || id >= len(names) {
+		return "Unknown"
+	}
+	return names[id]
+}
+
+// MatchPlayer player info in a match record
+type MatchPlayer struct {
+	Profile       string `json:"profile"`
+	Character     int    `json:"character"`
+	CharacterName string `json:"character_name"`
+	Skin          int    `json:"skin"`
+	Deck          []int  `json:"deck"`
+}
+
+// MatchRecord one line of match history
+type MatchRecord struct {
+	Time       time.Time   `json:"time"`
+	Game       int         `json:"game"`
+	MatchId    int         `json:"match_id"`
+	Host       MatchPlayer `json:"host"`
+	Client     MatchPlayer `json:"client"`
+	StageId    int         `json:"stage"`
+	MusicId    int         `json:"music"`
+	FrameCount int         `json:"frames"`
+	Ended      bool        `json:"ended"`
+	Spectators int         `json:"spectators"`
+}
+
+// MatchHistory match history sink, append records to a JSON Lines file
+type MatchHistory struct {
+	lock sync.Mutex
+	path string
+}
+
+// DefaultHistoryPath match history file in user config directory
+func DefaultHistoryPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "thlink", "history.jsonl")
+}
+
+// NewMatchHistory new match history sink writing to path
+func NewMatchHistory(path string) *MatchHistory {
+	return &MatchHistory{path: path}
+}
+
+// Path get match history file path
+func (m *MatchHistory) Path() string {
+	return m.path
+}
+
+// Write append one record to history file
+func (m *MatchHistory) Write(r *MatchRecord) error {
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(m.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadMatchHistory read all records in history file, broken lines are skipped
+func ReadMatchHistory(path string) ([]MatchRecord, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []MatchRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var r MatchRecord
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			loggerHistory.WithError(err).Warn("Skip broken match history line")
+			continue
+		}
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// parseTh123Player parse th123 player info in HOST_GAME GAME_MATCH package
+//
+//	+-----------+------+---------+-----------+-------------------+---------+
+//	| character | skin | deck id | deck size |       cards       | buttons |
+//	|     1     |  1   |    1    |     1     | 2 * deck size     |    1    |
+//	+-----------+------+---------+-----------+-------------------+---------+
+func parseTh123Player(profile string, info []byte, nameFunc func(int) string) MatchPlayer {
+
+	p := MatchPlayer{
+		Profile:       profile,
+		Character:     int(info[0]),
+		CharacterName: nameFunc(int(info[0])),
+		Skin:          int(info[1]),
+		Deck:          []int{},
+	}
+
+	for i := 0; i < int(info[3]) && 5+i*2 < len(info); i++ {
+		p.Deck = append(p.Deck, int(info[4+i*2])|int(info[5+i*2])<<8)
+	}
+
+	return p
+}
@@ -9,7 +9,6 @@ import (
 	"math/rand"
 	"net"
 	"time"
-	"unsafe"
 
 	"github.com/weilinfox/youmu-thlink/utils"
 
@@ -17,37 +16,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-/*
-#cgo pkg-config: zlib
-#include <stdlib.h>
-#include <string.h>
-#include <zlib.h>
-
-void zlib_encode(size_t len, const unsigned char *orig, size_t *retLen, unsigned char **ret)
-{
-	unsigned char enc[1024];
-	z_stream enc_stream;
-
-	enc_stream.zalloc = Z_NULL;
-	enc_stream.zfree = Z_NULL;
-	enc_stream.opaque = Z_NULL;
-
-	enc_stream.avail_in = (uInt)len;
-	enc_stream.next_in = (Bytef *)orig;
-	enc_stream.avail_out = (uInt)sizeof(enc);
-	enc_stream.next_out = (Bytef *)enc;
-
-	deflateInit(&enc_stream, Z_DEFAULT_COMPRESSION);
-	deflate(&enc_stream, Z_FINISH);
-	deflateEnd(&enc_stream);
-
-	*retLen = enc_stream.total_out;
-	*ret = (unsigned char *)malloc(sizeof(unsigned char) * enc_stream.total_out);
-	memcpy(*ret, enc, enc_stream.total_out);
-}
-*/
-import "C"
-
 var logger155 = logrus.WithField("Hyouibana", "internal")
 
 type type155pkg byte
@@ -97,7 +65,7 @@ var th155id = [19]byte{0x57, 0x09, 0xf6, 0x67, 0xf0, 0xfd, 0x4b, 0xd0, 0xb9, 0x9
 var th155ConfMagic = [12]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00, 0xff, 0x00, 0x00, 0x01}
 
 // version [123:131]
-var th155ConfOrig = [156]C.uchar{0x10, 0x00, 0x00, 0x08, 0x08, 0x00, 0x00, 0x00, 0x69, 0x73, 0x5f, 0x77, 0x61, 0x74, 0x63, 0x68,
+var th155ConfOrig = [156]byte{0x10, 0x00, 0x00, 0x08, 0x08, 0x00, 0x00, 0x00, 0x69, 0x73, 0x5f, 0x77, 0x61, 0x74, 0x63, 0x68,
 	0x08, 0x00, 0x00, 0x01, 0x00, 0x10, 0x00, 0x00, 0x08, 0x05, 0x00, 0x00, 0x00, 0x65, 0x78, 0x74, 0x72, 0x61, 0x01, 0x00,
 	0x00, 0x01, 0x10, 0x00, 0x00, 0x08, 0x0b, 0x00, 0x00, 0x00, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x5f, 0x77, 0x61, 0x74, 0x63,
 	0x68, 0x08, 0x00, 0x00, 0x01, 0x01, 0x10, 0x00, 0x00, 0x08, 0x04, 0x00, 0x00, 0x00, 0x6e, 0x61, 0x6d, 0x65, 0x10, 0x00,
@@ -213,7 +181,7 @@ func zlibDataDecodeSignConfVersion(l int, d []byte) error {
 			i = j + 4 + nl
 			if string(ans[j+4:i]) == "version" {
 				for k, l := i, 123; l < 131; {
-					th155ConfOrig[l] = (C.uchar)(ans[k])
+					th155ConfOrig[l] = ans[k]
 
 					l++
 					k++
@@ -240,18 +208,23 @@ func zlibDataDecodeSignConfVersion(l int, d []byte) error {
 	return errors.New("VERSION_NOT_FOUND_ERROR")
 }
 
+// zlibDataEncodeConf zlib compress th155ConfOrig with default compression level
 func zlibDataEncodeConf() (int, []byte) {
-	var cLen C.size_t = 0
-	var cAns *C.uchar
-	var ans []byte
-
-	C.zlib_encode(156, &th155ConfOrig[0], &cLen, &cAns)
-	cIAns := (*[utils.TransBufSize]C.uchar)(unsafe.Pointer(cAns))
-	for i := 0; i < int(cLen); i++ {
-		ans = append(ans, byte(cIAns[i]))
+
+	var zlibData bytes.Buffer
+	zlibw := zlib.NewWriter(&zlibData)
+	_, err := zlibw.Write(th155ConfOrig[:])
+	if err != nil {
+		logger155.WithError(err).Error("Th155 plugin zlib compress error")
+		return 0, nil
+	}
+	err = zlibw.Close()
+	if err != nil {
+		logger155.WithError(err).Error("Th155 plugin zlib compress error")
+		return 0, nil
 	}
 
-	return int(cLen), ans
+	return zlibData.Len(), zlibData.Bytes()
 }
 
 type Hyouibana struct {
@@ -272,8 +245,9 @@ type Hyouibana struct {
 	timeId          int64          // th155 protocol client start time in ms
 	randId          int32          // th155 protocol random id
 
-	spectatorCount int  // spectator counter
-	quitFlag       bool // plugin quit flag
+	spectatorCount int       // spectator counter
+	eventFunc      EventFunc // event callback, nil to disable
+	quitFlag       bool      // plugin quit flag
 }
 
 // NewHyouibana new Hyouibana spectating server
@@ -424,6 +398,7 @@ func (h *Hyouibana) ReadFunc(orig []byte) (bool, []byte) {
 
 						h.spectatorCount++
 						logger155.Info("New spector connected")
+						h.emit(Event{Type: EventSpectatorJoin})
 
 						return true, repData
 
@@ -755,74 +730,7 @@ func (h *Hyouibana) GoroutineFunc(tunnelConn interface{}, conn *net.UDPConn) {
 				}
 
 			case HOST_GAME_155:
-				switch data155pkg(buf[1]) {
-
-				case GAME_REPLAY_MATCH_155:
-					if n > 21 {
-						mid := utils.LittleIndia2Int(buf[5:9])
-						if mid != h.matchId {
-							h.matchId = mid
-							h.matchEnd = false
-							h.matchInfo = make([]byte, n)
-							copy(h.matchInfo, buf[:n])
-							h.frameId[0], h.frameId[1] = 0, 0
-							h.frameRec[0], h.frameRec[1] = []byte{}, []byte{}
-							logger155.Info("Th155 plugin spectator get new match id ", mid)
-						}
-					} else {
-						logger155.Warn("HOST_GAME GAME_REPLAY_MATCH with strange length ", n)
-					}
-
-				case GAME_REPLAY_DATA_155:
-					if n >= 24 {
-						mid := utils.LittleIndia2Int(buf[5:9])
-						if mid != h.matchId {
-							logger155.Warn("Th155 plugin spectator get invalid match id ", mid, " expect ", h.matchId)
-						} else {
-							fidS, fidE := utils.LittleIndia2Int(buf[9:13]), utils.LittleIndia2Int(buf[13:17])
-							fidL := fidE - fidS
-							if fidS == h.frameId[0] {
-								h.frameId[0] = fidE
-								h.frameRec[0] = append(h.frameRec[0], buf[17:17+fidL*2]...)
-								if len(h.frameRec[0]) != fidE*2 {
-									logger155.Warn("Th155 plugin spectator get wrong record0 length after append new data ", len(h.frameRec[0]), " expect ", fidE*2)
-								}
-							} else {
-								logger155.Warn("Th155 plugin spectator get invalid start frame id ", fidS, " expect ", h.frameId[0])
-							}
-							fidS, fidE = utils.LittleIndia2Int(buf[17+fidL*2:21+fidL*2]), utils.LittleIndia2Int(buf[21+fidL*2:25+fidL*2])
-							if fidS == h.frameId[1] {
-								h.frameId[1] = fidE
-								h.frameRec[1] = append(h.frameRec[1], buf[25+fidL*2:n]...)
-								if len(h.frameRec[1]) != fidE*2 {
-									logger155.Warn("Th155 plugin spectator get wrong record1 length after append new data ", len(h.frameRec[1]), " expect ", fidE*2)
-								}
-							} else {
-								logger155.Warn("Th155 plugin spectator get invalid start frame id ", fidS, " expect ", h.frameId[1])
-							}
-
-							// logger155.Debug("Th155 plugin spectator get HOST_GAME GAME_REPLAY_DATA match id ", h.matchId, " frame id ", h.frameId)
-						}
-					} else {
-						logger155.Warn("HOST_GAME GAME_REPLAY_DATA with strange length ", n)
-					}
-
-				case GAME_REPLAY_END_155:
-					if n == 9 {
-						mid := utils.LittleIndia2Int(buf[5:9])
-						if mid != h.matchId {
-							logger155.Warn("Th155 plugin spectator get invalid match id ", mid, " expect ", h.matchId)
-						} else {
-							logger155.Info("Th155 plugin spectator get HOST_GAME GAME_REPLAY_END match id ", h.matchId)
-							h.matchEnd = true
-						}
-					} else {
-						logger155.Warn("HOST_GAME GAME_REPLAY_END with strange length ", n)
-					}
-
-				default:
-					logger155.Warn("Th155 plugin spectator get invalid package ", buf[:n])
-				}
+				h.recordReplay(buf[:n])
 
 			case HOST_QUIT_155:
 				logger155.Info("Th155 plugin spectator get HOST_QUIT")
@@ -838,6 +746,88 @@ func (h *Hyouibana) GoroutineFunc(tunnelConn interface{}, conn *net.UDPConn) {
 	<-ch
 }
 
+// recordReplay record HOST_GAME replay package from host
+// buf: HOST_GAME package without udp multiplex id
+func (h *Hyouibana) recordReplay(buf []byte) {
+
+	n := len(buf)
+
+	switch data155pkg(buf[1]) {
+
+	case GAME_REPLAY_MATCH_155:
+		if n > 21 {
+			mid := utils.LittleIndia2Int(buf[5:9])
+			if mid != h.matchId {
+				h.matchId = mid
+				h.matchEnd = false
+				h.matchInfo = make([]byte, n)
+				copy(h.matchInfo, buf[:n])
+				h.frameId[0], h.frameId[1] = 0, 0
+				h.frameRec[0], h.frameRec[1] = []byte{}, []byte{}
+				logger155.Info("Th155 plugin spectator get new match id ", mid)
+				h.emit(Event{Type: EventMatchStart, MatchId: mid})
+			}
+		} else {
+			logger155.Warn("HOST_GAME GAME_REPLAY_MATCH with strange length ", n)
+		}
+
+	case GAME_REPLAY_DATA_155:
+		if n >= 24 {
+			mid := utils.LittleIndia2Int(buf[5:9])
+			if mid != h.matchId {
+				logger155.Warn("Th155 plugin spectator get invalid match id ", mid, " expect ", h.matchId)
+			} else {
+				fidS, fidE := utils.LittleIndia2Int(buf[9:13]), utils.LittleIndia2Int(buf[13:17])
+				fidL := fidE - fidS
+				if fidL < 0 || 25+fidL*2 > n {
+					logger155.Warn("HOST_GAME GAME_REPLAY_DATA with invalid frame range ", fidS, "-", fidE, " length ", n)
+					break
+				}
+				if fidS == h.frameId[0] {
+					h.frameId[0] = fidE
+					h.frameRec[0] = append(h.frameRec[0], buf[17:17+fidL*2]...)
+					if len(h.frameRec[0]) != fidE*2 {
+						logger155.Warn("Th155 plugin spectator get wrong record0 length after append new data ", len(h.frameRec[0]), " expect ", fidE*2)
+					}
+				} else {
+					logger155.Warn("Th155 plugin spectator get invalid start frame id ", fidS, " expect ", h.frameId[0])
+				}
+				fidS, fidE = utils.LittleIndia2Int(buf[17+fidL*2:21+fidL*2]), utils.LittleIndia2Int(buf[21+fidL*2:25+fidL*2])
+				if fidS == h.frameId[1] {
+					h.frameId[1] = fidE
+					h.frameRec[1] = append(h.frameRec[1], buf[25+fidL*2:n]...)
+					if len(h.frameRec[1]) != fidE*2 {
+						logger155.Warn("Th155 plugin spectator get wrong record1 length after append new data ", len(h.frameRec[1]), " expect ", fidE*2)
+					}
+				} else {
+					logger155.Warn("Th155 plugin spectator get invalid start frame id ", fidS, " expect ", h.frameId[1])
+				}
+
+				// logger155.Debug("Th155 plugin spectator get HOST_GAME GAME_REPLAY_DATA match id ", h.matchId, " frame id ", h.frameId)
+			}
+		} else {
+			logger155.Warn("HOST_GAME GAME_REPLAY_DATA with strange length ", n)
+		}
+
+	case GAME_REPLAY_END_155:
+		if n == 9 {
+			mid := utils.LittleIndia2Int(buf[5:9])
+			if mid != h.matchId {
+				logger155.Warn("Th155 plugin spectator get invalid match id ", mid, " expect ", h.matchId)
+			} else {
+				logger155.Info("Th155 plugin spectator get HOST_GAME GAME_REPLAY_END match id ", h.matchId)
+				h.matchEnd = true
+				h.emit(Event{Type: EventMatchEnd, MatchId: h.matchId})
+			}
+		} else {
+			logger155.Warn("HOST_GAME GAME_REPLAY_END with strange length ", n)
+		}
+
+	default:
+		logger155.Warn("Th155 plugin spectator get invalid package ", buf[:n])
+	}
+}
+
 func (h *Hyouibana) SetQuitFlag() {
 	h.quitFlag = true
 }
@@ -845,3 +835,18 @@ func (h *Hyouibana) SetQuitFlag() {
 func (h *Hyouibana) GetSpectatorCount() int {
 	return h.spectatorCount
 }
+
+// SetEventFunc set callback receiving match and spectator events
+func (h *Hyouibana) SetEventFunc(eventFunc EventFunc) {
+	h.eventFunc = eventFunc
+}
+
+// emit call event callback with game and spectator count filled
+func (h *Hyouibana) emit(e Event) {
+	if h.eventFunc == nil {
+		return
+	}
+	e.Game = 155
+	e.Spectators = h.spectatorCount
+	h.eventFunc(e)
+}
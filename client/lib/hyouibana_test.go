@@ -1,6 +1,9 @@
 package client
 
 import (
+	"bytes"
+	"compress/zlib"
+	"io"
 	"testing"
 )
 
@@ -20,3 +23,83 @@ func TestZlib(t *testing.T) {
 		}
 	*/
 }
+
+// th155ConfOrig encoded by the former cgo zlib_encode (zlib deflate, Z_DEFAULT_COMPRESSION)
+var th155ConfCgoFixture = []byte{0x78, 0x9c, 0x45, 0x8d, 0xdb, 0x0a, 0x80, 0x30, 0x0c, 0x43, 0x3b, 0x71, 0x28, 0xfa, 0xe2, 0x1f,
+	0x8e, 0x3a, 0x06, 0x0a, 0xbb, 0xc0, 0x9c, 0xce, 0xbf, 0xd7, 0x54, 0x14, 0xfb, 0x92, 0x70, 0x9a, 0x90, 0x89, 0xa8, 0xef,
+	0x89, 0x68, 0xdd, 0x4c, 0xe5, 0x62, 0x17, 0x78, 0x45, 0x13, 0xa0, 0x06, 0x74, 0x67, 0xc9, 0xac, 0x40, 0x04, 0x8c, 0x00,
+	0xec, 0x7d, 0xaa, 0x7f, 0xf0, 0xe1, 0x2d, 0x78, 0xe4, 0xe0, 0xc4, 0xc3, 0x3e, 0xe5, 0x01, 0x3a, 0x73, 0x29, 0xde, 0x99,
+	0xb8, 0x87, 0x86, 0x48, 0xab, 0xf7, 0xd3, 0x41, 0x0f, 0x97, 0xb7, 0x35, 0xc5, 0xeb, 0xbd, 0x6f, 0xcd, 0x26, 0x9f, 0xb2,
+	0x64, 0xa5, 0x2d, 0xab, 0x37, 0x33, 0xf3, 0x1e, 0x17}
+
+// th155ConfOrig with th155 version 01 00 00 00 02 aa 00 00 encoded by the former cgo zlib_encode
+var th155ConfVersionCgoFixture = []byte{0x78, 0x9c, 0x45, 0xcd, 0x4b, 0x0a, 0x80, 0x30, 0x0c, 0x04, 0xd0, 0xa9, 0x28, 0x8a, 0x6e, 0xbc,
+	0xa1, 0x44, 0x29, 0x28, 0xf4, 0x03, 0xb5, 0x7e, 0xce, 0xe4, 0x29, 0x9d, 0x88, 0xe8, 0x2a, 0xc3, 0xcb, 0x84, 0xf4, 0x40,
+	0xd3, 0x00, 0x58, 0xd6, 0xe1, 0x90, 0x3c, 0xcd, 0xcc, 0x06, 0x3d, 0xb1, 0x22, 0xda, 0x33, 0x27, 0x31, 0x14, 0x85, 0x8e,
+	0x20, 0xce, 0xc5, 0xe3, 0x2f, 0x3e, 0x5e, 0xd2, 0x83, 0x78, 0xab, 0x99, 0xf1, 0x39, 0x6e, 0x39, 0x47, 0xc9, 0xd9, 0xd9,
+	0x21, 0x6c, 0xbe, 0x00, 0x2a, 0xf3, 0x6e, 0x6a, 0xce, 0xdd, 0xa6, 0x75, 0x89, 0x41, 0xa9, 0xb8, 0xf0, 0x7d, 0x9b, 0xa2,
+	0x8b, 0x49, 0xbb, 0x7a, 0xad, 0x5f, 0x6f, 0x5b, 0xc3, 0x16, 0xcc}
+
+// zlibDecode decode zlib data in test
+func zlibDecode(t *testing.T, d []byte) []byte {
+	r, err := zlib.NewReader(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal("Zlib reader error: ", err)
+	}
+	ans, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("Zlib decode error: ", err)
+	}
+	_ = r.Close()
+	return ans
+}
+
+func TestZlibCgoOutput(t *testing.T) {
+	orig := th155ConfOrig
+	defer func() {
+		th155ConfOrig = orig
+	}()
+
+	for i, fixture := range [][]byte{th155ConfCgoFixture, th155ConfVersionCgoFixture} {
+		if i == 1 {
+			copy(th155ConfOrig[123:131], []byte{0x01, 0x00, 0x00, 0x00, 0x02, 0xaa, 0x00, 0x00})
+		}
+
+		l, z := zlibDataEncodeConf()
+		if l != len(z) || l < 3 {
+			t.Fatal("Zlib compress data length error ", l, " ", len(z))
+		}
+		// same header as zlib deflateInit with Z_DEFAULT_COMPRESSION
+		if z[0] != fixture[0] || z[1] != fixture[1] {
+			t.Errorf("Zlib header %x %x not match cgo output %x %x", z[0], z[1], fixture[0], fixture[1])
+		}
+		if !bytes.Equal(zlibDecode(t, fixture), th155ConfOrig[:]) {
+			t.Fatal("Cgo fixture not decoded into th155ConfOrig")
+		}
+		if !bytes.Equal(zlibDecode(t, z), zlibDecode(t, fixture)) {
+			t.Error("Zlib data not match cgo output after decode")
+		}
+		// buffer size in INIT_REQUEST
+		if l > len(fixture)+32 {
+			t.Error("Zlib data much longer than cgo output ", l, " ", len(fixture))
+		}
+	}
+}
+
+func TestRecordReplayTruncated(t *testing.T) {
+	h := NewHyouibana()
+	h.matchId = 1
+
+	// GAME_REPLAY_DATA of match 1 claiming frame 0-100 with only 4 bytes of input
+	data := []byte{0x12, 0x0b, 0x02, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+	h.recordReplay(data)
+	// frame range backwards
+	copy(data[9:17], []byte{0x64, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	h.recordReplay(data)
+
+	if h.frameId != [2]int{0, 0} || len(h.frameRec[0]) != 0 || len(h.frameRec[1]) != 0 {
+		t.Error("Truncated replay data recorded: ", h.frameId)
+	}
+}
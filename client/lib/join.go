@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+)
+
+// NewJoin set up new client joining tunnel of host as guest, target is peer host given by host
+// or room code. Local game connects to localPort, and data goes through QUIC/TCP tunnel to broker.
+// Broker address of peer host is used with port of serverHost, serverHost is used for room code
+func NewJoin(localPort int, serverHost string, tunnelType string, target string) (*Client, error) {
+
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return nil, errors.New("empty join target")
+	}
+
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		_, port, err := net.SplitHostPort(serverHost)
+		if err != nil {
+			return nil, errors.New("Invalid hostname " + serverHost)
+		}
+		serverHost = net.JoinHostPort(host, port)
+	} else {
+		target = strings.ToUpper(target)
+	}
+
+	c, err := New(localPort, serverHost, tunnelType)
+	if err != nil {
+		return nil, err
+	}
+	c.join = target
+
+	return c, nil
+}
+
+// Join get join target, empty if client is host
+func (c *Client) Join() string {
+	return c.join
+}
+
+// SetJoinVia join through broker via in network of host broker, usually the one nearest to guest,
+// it forwards guest tunnel to host broker over broker-to-broker link. Empty to join host broker directly
+func (c *Client) SetJoinVia(via string) {
+	c.joinVia = via
+}
+
+// JoinVia get broker guest tunnel goes through, empty if joined host broker directly
+func (c *Client) JoinVia() string {
+	return c.joinVia
+}
+
+// connectJoin ask for guest tunnel and connect
+func (c *Client) connectJoin() error {
+
+	logger.Info("Will join ", c.join, " with local port ", c.localPort)
+
+	broker := c.serverHost
+	cmd := []byte{strings.ToLower(c.tunnelType)[0]}
+	if c.joinVia != "" && c.joinVia != c.serverHost {
+		// forwarded by via to host broker
+		tcpAddr, err := net.ResolveTCPAddr("tcp", c.serverHost)
+		if err != nil {
+			return err
+		}
+		logger.Info("Join through broker ", c.joinVia)
+		broker = c.joinVia
+		cmd = append(cmd, 'f', byte(len(tcpAddr.String())))
+		cmd = append(cmd, []byte(tcpAddr.String())...)
+	}
+
+	host, _, err := net.SplitHostPort(broker)
+	if err != nil {
+		return err
+	}
+
+	if _, sport, err := net.SplitHostPort(c.join); err == nil {
+		port, err := strconv.ParseInt(sport, 10, 32)
+		if err != nil || port <= 0 || port > 65535 {
+			return errors.New("Invalid peer host " + c.join)
+		}
+		cmd = append(cmd, 'p', byte(port>>8), byte(port))
+	} else {
+		cmd = append(cmd, 'r')
+		cmd = append(cmd, []byte(c.join)...)
+	}
+
+	// join command
+	logger.Info("Ask for guest tunnel")
+	conn, err := net.DialTimeout("tcp", broker, time.Millisecond*500)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(utils.NewDataFrame(utils.JOIN, cmd))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, utils.CmdBufSize)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	// join command response
+	dataStream := utils.NewDataStream()
+	dataStream.Append(buf[:n])
+	if !dataStream.Parse() || dataStream.Type() != utils.JOIN {
+		return errors.New("invalid JOIN response from server")
+	}
+	if dataStream.Len() < 2 {
+		return errors.New("broker refused to join " + c.join)
+	}
+	port := int(dataStream.Data()[0])<<8 + int(dataStream.Data()[1])
+
+	// Set up tunnel
+	config := utils.TunnelConfig{
+		Address0: net.JoinHostPort(host, strconv.Itoa(port)),
+		Address1: ":" + strconv.Itoa(c.localPort),
+	}
+	switch strings.ToLower(c.tunnelType) {
+	case "tcp":
+		config.Type = utils.DialTcpListenUdp
+	case "quic":
+		config.Type = utils.DialQuicListenUdp
+	}
+
+	c.tunnel, err = utils.NewTunnel(&config)
+	if err != nil {
+		return err
+	}
+
+	c.peerHost = "127.0.0.1:" + strconv.Itoa(c.localPort)
+	c.spectatorHost = ""
+	c.roomCode = ""
+
+	logger.Info("Guest tunnel established, game can connect to " + c.peerHost)
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerNat = logrus.WithField("Nat", "internal")
+
+// NatType NAT type found by DetectNat
+type NatType string
+
+const (
+	NatUnknown           NatType = "unknown"                 // not enough answers
+	NatBlocked           NatType = "blocked"                 // no udp answer from any broker
+	NatOpen              NatType = "open"                    // public address, no NAT
+	NatAddressRestricted NatType = "address-restricted cone" // endpoint independent mapping, address dependent filtering at most
+	NatPortRestricted    NatType = "port-restricted cone"    // endpoint independent mapping, address and port dependent filtering
+	NatSymmetric         NatType = "symmetric"               // endpoint dependent mapping
+)
+
+// NatBrokersMax max brokers asked by DetectNat
+const NatBrokersMax = 3
+
+// NatMapping observed address of one ADDR_ECHO request
+type NatMapping struct {
+	Target string  `json:"target"`           // udp address request sent to
+	Mapped string  `json:"mapped"`           // observed address, empty if no answer
+	RttMs  float64 `json:"rtt_ms,omitempty"` // response time
+}
+
+// NatReport NAT detection result
+type NatReport struct {
+	Type       NatType      `json:"type"`
+	LocalAddr  string       `json:"local_addr"`  // local address of udp socket
+	PublicAddr string       `json:"public_addr"` // first observed address
+	ChangePort bool         `json:"change_port"` // answer from port request not sent to received
+	Mappings   []NatMapping `json:"mappings"`
+}
+
+// PunchFriendly hole punching is likely to work with this NAT type
+func (r *NatReport) PunchFriendly() bool {
+	switch r.Type {
+	case NatOpen, NatAddressRestricted, NatPortRestricted:
+		return true
+	}
+	return false
+}
+
+// DiagnoseNat detect NAT type with brokers in network of server
+func DiagnoseNat(server string) (*NatReport, error) {
+
+	servers, err := NetBrokers(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return DetectNat(servers, time.Millisecond*500)
+}
+
+// DetectNat detect NAT type by sending ADDR_ECHO from one udp socket to command port and
+// alternate port of servers, up to NatBrokersMax of them are asked
+func DetectNat(servers []string, timeout time.Duration) (*NatReport, error) {
+
+	if len(servers) == 0 {
+		return nil, errors.New("no broker to ask")
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	report := &NatReport{Type: NatUnknown}
+
+	for _, server := range servers {
+		if len(report.Mappings) >= NatBrokersMax*2 {
+			break
+		}
+
+		target, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			loggerNat.WithError(err).Warn("Resolve broker address failed")
+			continue
+		}
+		if report.LocalAddr == "" {
+			report.LocalAddr = localUdpAddr(conn, target)
+		}
+
+		mapped, altPort, rtt, err := addrEcho(conn, target, utils.ECHO_SAME_PORT, timeout)
+		report.Mappings = append(report.Mappings, NatMapping{Target: target.String(), Mapped: mapped, RttMs: rtt})
+		if err != nil {
+			loggerNat.WithError(err).Debug("No address echo from ", target.String())
+			continue
+		}
+
+		altTarget := &net.UDPAddr{IP: target.IP, Port: altPort, Zone: target.Zone}
+		mapped, _, rtt, err = addrEcho(conn, altTarget, utils.ECHO_SAME_PORT, timeout)
+		report.Mappings = append(report.Mappings, NatMapping{Target: altTarget.String(), Mapped: mapped, RttMs: rtt})
+		if err != nil {
+			loggerNat.WithError(err).Debug("No address echo from ", altTarget.String())
+		}
+
+		if !report.ChangePort {
+			_, _, _, err = addrEcho(conn, target, utils.ECHO_CHANGE_PORT, timeout)
+			report.ChangePort = err == nil
+		}
+	}
+
+	classifyNat(report)
+
+	return report, nil
+}
+
+// classifyNat set Type and PublicAddr of report with its mappings
+func classifyNat(report *NatReport) {
+
+	var answered []string
+	for _, m := range report.Mappings {
+		if m.Mapped != "" {
+			answered = append(answered, m.Mapped)
+		}
+	}
+
+	if len(answered) == 0 {
+		report.Type = NatBlocked
+		return
+	}
+	report.PublicAddr = answered[0]
+
+	for _, m := range answered[1:] {
+		if m != answered[0] {
+			report.Type = NatSymmetric
+			return
+		}
+	}
+
+	switch {
+	case len(answered) < 2:
+		report.Type = NatUnknown
+	case answered[0] == report.LocalAddr:
+		report.Type = NatOpen
+	case report.ChangePort:
+		// answer from another port of the same broker ip, full cone is not told apart without a second ip
+		report.Type = NatAddressRestricted
+	default:
+		report.Type = NatPortRestricted
+	}
+}
+
+// localUdpAddr local address of conn when talking with target
+func localUdpAddr(conn *net.UDPConn, target *net.UDPAddr) string {
+
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	// connected udp socket tells local ip of route to target
+	route, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return conn.LocalAddr().String()
+	}
+	defer route.Close()
+
+	ip, _, _ := net.SplitHostPort(route.LocalAddr().String())
+
+	return net.JoinHostPort(ip, port)
+}
+
+// addrEcho send ADDR_ECHO to target and wait for answer,
+// return observed address, alternate port and response time in milliseconds
+func addrEcho(conn *net.UDPConn, target *net.UDPAddr, flag utils.AddrEchoFlag, timeout time.Duration) (string, int, float64, error) {
+
+	buf := make([]byte, utils.CmdBufSize)
+
+	for i := 0; i < 3; i++ {
+		timeSend := time.Now()
+		request := make([]byte, utils.AddrEchoLen)
+		request[0] = byte(flag)
+		_, err := conn.WriteToUDP(utils.NewDataFrame(utils.ADDR_ECHO, request), target)
+		if err != nil {
+			return "", 0, 0, err
+		}
+
+		_ = conn.SetReadDeadline(timeSend.Add(timeout))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+
+			dataStream := utils.NewDataStream()
+			dataStream.Append(buf[:n])
+			if !dataStream.Parse() || dataStream.Type() != utils.ADDR_ECHO || dataStream.Len() < 3 {
+				continue
+			}
+			data := dataStream.Data()
+
+			// answer of earlier request may come late
+			if !from.IP.Equal(target.IP) {
+				continue
+			}
+			if flag == utils.ECHO_CHANGE_PORT {
+				if from.Port == target.Port {
+					continue
+				}
+			} else if from.Port != target.Port {
+				continue
+			}
+
+			_ = conn.SetReadDeadline(time.Time{})
+			rtt := float64(time.Since(timeSend).Nanoseconds()) / 1000000
+			return string(data[3:]), int(data[1])<<8 | int(data[2]), rtt, nil
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+
+	return "", 0, 0, errors.New("no answer from " + target.IP.String() + " port " + strconv.Itoa(target.Port))
+}
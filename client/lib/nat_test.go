@@ -0,0 +1,104 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+)
+
+// fakeAddrEcho answer ADDR_ECHO like broker, return command port address
+func fakeAddrEcho(t *testing.T) string {
+
+	var conns [2]*net.UDPConn
+	for i := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		conns[i] = conn
+	}
+	altPort := conns[1].LocalAddr().(*net.UDPAddr).Port
+
+	for i := range conns {
+		go func(from int) {
+			buf := make([]byte, utils.CmdBufSize)
+			for {
+				n, addr, err := conns[from].ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				dataStream := utils.NewDataStream()
+				dataStream.Append(buf[:n])
+				if !dataStream.Parse() || dataStream.Type() != utils.ADDR_ECHO {
+					continue
+				}
+				answer := from
+				if dataStream.Len() > 0 && utils.AddrEchoFlag(dataStream.Data()[0]) == utils.ECHO_CHANGE_PORT {
+					answer = 1 - from
+				}
+				resp := append([]byte{byte(answer), byte(altPort >> 8), byte(altPort)}, addr.String()...)
+				_, _ = conns[answer].WriteToUDP(utils.NewDataFrame(utils.ADDR_ECHO, resp), addr)
+			}
+		}(i)
+	}
+
+	return conns[0].LocalAddr().String()
+}
+
+func TestDetectNat(t *testing.T) {
+
+	report, err := DetectNat([]string{fakeAddrEcho(t)}, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mappings) != 2 || report.Mappings[0].Mapped == "" || report.Mappings[1].Mapped == "" {
+		t.Fatal("Mappings not answered: ", report.Mappings)
+	}
+	if !report.ChangePort {
+		t.Error("Change port answer not received")
+	}
+	if report.Type != NatOpen || report.PublicAddr != report.LocalAddr {
+		t.Error("Loopback should be open: ", report.Type, " ", report.PublicAddr, " ", report.LocalAddr)
+	}
+
+	// nobody answers
+	report, err = DetectNat([]string{"127.0.0.1:9"}, time.Millisecond*50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Type != NatBlocked {
+		t.Error("No answer should be blocked: ", report.Type)
+	}
+}
+
+func TestClassifyNat(t *testing.T) {
+
+	cases := []struct {
+		mapped     []string
+		changePort bool
+		want       NatType
+	}{
+		{[]string{"1.1.1.1:1000", "1.1.1.1:1000"}, true, NatAddressRestricted},
+		{[]string{"1.1.1.1:1000", "1.1.1.1:1000", "1.1.1.1:1000"}, false, NatPortRestricted},
+		{[]string{"1.1.1.1:1000", "1.1.1.1:1001"}, true, NatSymmetric},
+		{[]string{"10.0.0.2:1000", "10.0.0.2:1000"}, false, NatOpen},
+		{[]string{"1.1.1.1:1000", ""}, false, NatUnknown},
+		{[]string{"", ""}, false, NatBlocked},
+	}
+
+	for _, c := range cases {
+		report := &NatReport{LocalAddr: "10.0.0.2:1000", ChangePort: c.changePort}
+		for _, m := range c.mapped {
+			report.Mappings = append(report.Mappings, NatMapping{Mapped: m})
+		}
+		classifyNat(report)
+		if report.Type != c.want {
+			t.Error("Classify ", c.mapped, " got ", report.Type, " want ", c.want)
+		}
+	}
+}
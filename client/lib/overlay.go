@@ -0,0 +1,10 @@
+package client
+
+import _ "embed"
+
+// overlayPage overlay page for streaming software, served at GET /overlay
+//
+// Add it as browser source in OBS, e.g. http://127.0.0.1:4647/overlay?tunnel=1&token=<token>
+//
+//go:embed overlay.html
+var overlayPage []byte
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerPlugin = logrus.WithField("Plugin", "internal")
+
+// PluginAuto plugin id of automatic game detection
+const PluginAuto = -1
+
+// Plugin spectating plugin callbacks used by Client.Serve
+type Plugin interface {
+	ReadFunc([]byte) (bool, []byte)
+	WriteFunc([]byte) (bool, []byte)
+	GoroutineFunc(interface{}, *net.UDPConn)
+	SetQuitFlag()
+}
+
+// NewPlugin new plugin with plugin id, nil for id 0
+func NewPlugin(id int) (Plugin, error) {
+
+	switch id {
+	case 0:
+		return nil, nil
+	case 105:
+		return NewScarletWeatherRhapsody(), nil
+	case 123:
+		return NewHisoutensoku(), nil
+	case 155:
+		return NewHyouibana(), nil
+	case PluginAuto:
+		return NewAutoPlugin(), nil
+	}
+
+	return nil, errors.New("no such plugin " + strconv.Itoa(id))
+}
+
+// AutoPlugin detect game from first packages and attach matching plugin
+type AutoPlugin struct {
+	lock       sync.RWMutex
+	plugin     Plugin            // attached plugin, nil before detected
+	game       int               // detected game
+	swrPending map[byte][]byte   // th10.5/th12.3 INIT_REQUEST before INIT_SUCCESS tells the game
+	detectFunc func(int, Plugin) // called when game detected
+	quitFlag   bool              // plugin quit flag
+}
+
+// NewAutoPlugin new automatic game detection plugin
+func NewAutoPlugin() *AutoPlugin {
+	return &AutoPlugin{
+		swrPending: make(map[byte][]byte),
+	}
+}
+
+// SetDetectFunc set callback called with game number and plugin once game detected,
+// plugin can be configured in it before any package passed to it
+func (a *AutoPlugin) SetDetectFunc(detectFunc func(int, Plugin)) {
+	a.detectFunc = detectFunc
+}
+
+// Game get detected game number, 0 if not detected yet
+func (a *AutoPlugin) Game() int {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.game
+}
+
+// Plugin get attached plugin, nil if not detected yet
+func (a *AutoPlugin) Plugin() Plugin {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.plugin
+}
+
+// ReadFunc from game client to host
+func (a *AutoPlugin) ReadFunc(orig []byte) (bool, []byte) {
+
+	p := a.detect(orig, true)
+	if p == nil {
+		return false, orig
+	}
+
+	return p.ReadFunc(orig)
+}
+
+// WriteFunc from game host to client
+func (a *AutoPlugin) WriteFunc(orig []byte) (bool, []byte) {
+
+	p := a.detect(orig, false)
+	if p == nil {
+		return false, orig
+	}
+
+	return p.WriteFunc(orig)
+}
+
+// GoroutineFunc wait for game detected and run plugin goroutine
+func (a *AutoPlugin) GoroutineFunc(tunnelConn interface{}, conn *net.UDPConn) {
+
+	for {
+		a.lock.RLock()
+		p, quit := a.plugin, a.quitFlag
+		a.lock.RUnlock()
+
+		if quit {
+			return
+		}
+		if p != nil {
+			p.GoroutineFunc(tunnelConn, conn)
+			return
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// SetQuitFlag quit attached plugin
+func (a *AutoPlugin) SetQuitFlag() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.quitFlag = true
+	if a.plugin != nil {
+		a.plugin.SetQuitFlag()
+	}
+}
+
+// detect return attached plugin, or detect game with orig and attach new plugin
+func (a *AutoPlugin) detect(orig []byte, fromClient bool) Plugin {
+
+	a.lock.RLock()
+	p := a.plugin
+	a.lock.RUnlock()
+	if p != nil {
+		return p
+	}
+
+	if len(orig) < 2 {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.plugin != nil {
+		return a.plugin
+	}
+
+	game := 0
+	switch {
+	case (type155pkg(orig[1]) == INIT_155 || type155pkg(orig[1]) == INIT_REQUEST_155) &&
+		len(orig)-1 > 20 && bytes.Equal(orig[2:18], th155id[:16]):
+		// th155 packages carry th155id
+		game = 155
+
+	case fromClient && type123pkg(orig[1]) == HELLO_123 && len(orig)-1 == 37:
+		loggerPlugin.Debug("Th105/th123 HELLO found, wait for INIT_SUCCESS")
+
+	case fromClient && type123pkg(orig[1]) == INIT_REQUEST_123 && len(orig)-1 == 65:
+		// th10.5 and th12.3 share INIT_REQUEST, keep it for game id
+		a.swrPending[orig[0]] = append([]byte{}, orig...)
+		loggerPlugin.Debug("Th105/th123 INIT_REQUEST found, wait for INIT_SUCCESS")
+
+	case !fromClient && type123pkg(orig[1]) == INIT_SUCCESS_123:
+		switch len(orig) - 1 {
+		case swrProfile123.initSuccessLen:
+			game = 123
+		case swrProfile105.initSuccessLen:
+			game = 105
+		}
+	}
+
+	if game == 0 {
+		return nil
+	}
+
+	a.plugin, _ = NewPlugin(game)
+	a.game = game
+	loggerPlugin.Info("Detected th", game, ", attach plugin")
+
+	if a.detectFunc != nil {
+		a.detectFunc(game, a.plugin)
+	}
+	if a.quitFlag {
+		a.plugin.SetQuitFlag()
+	}
+
+	// replay INIT_REQUEST so plugin knows game id
+	if game != 155 {
+		for _, pending := range a.swrPending {
+			a.plugin.ReadFunc(pending)
+		}
+	}
+	a.swrPending = make(map[byte][]byte)
+
+	return a.plugin
+}
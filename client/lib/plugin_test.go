@@ -0,0 +1,76 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestAutoPlugin(t *testing.T) {
+	// th12.3 detected by INIT_SUCCESS length
+	a := NewAutoPlugin()
+	var detected int
+	a.SetDetectFunc(func(game int, _ Plugin) {
+		detected = game
+	})
+
+	gameId := append([]byte{0, byte(INIT_REQUEST_123)}, make([]byte, 64)...)
+	gameId[2] = 0x64
+	if _, data := a.ReadFunc(gameId); data == nil || a.Plugin() != nil {
+		t.Fatal("INIT_REQUEST should pass through before detected")
+	}
+	a.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client"))
+	h, ok := a.Plugin().(*Hisoutensoku)
+	if !ok || a.Game() != 123 || detected != 123 || h.GetGame() != 123 {
+		t.Fatal("Th123 not detected: ", a.Game())
+	}
+	if h.PeerStatus != SUCCESS_123 || h.gameId[0][0] != 0x64 {
+		t.Error("Th123 plugin not get packages before detected")
+	}
+
+	// th10.5 detected by INIT_SUCCESS length
+	a = NewAutoPlugin()
+	a.WriteFunc(th123InitSuccess(0, SPECTATE_123, "host", "client")[:78])
+	if h, ok := a.Plugin().(*Hisoutensoku); !ok || h.GetGame() != 105 {
+		t.Fatal("Th105 not detected: ", a.Game())
+	}
+
+	// th15.5 detected by th155id
+	a = NewAutoPlugin()
+	a.ReadFunc(append(append([]byte{0, byte(INIT_155)}, th155id[:]...), make([]byte, 5)...))
+	if _, ok := a.Plugin().(*Hyouibana); !ok || a.Game() != 155 {
+		t.Fatal("Th155 not detected: ", a.Game())
+	}
+
+	// unknown game
+	a = NewAutoPlugin()
+	a.ReadFunc([]byte{0, 0x42, 0x00})
+	a.WriteFunc([]byte{0, byte(INIT_SUCCESS_123), 0x00})
+	if a.Plugin() != nil {
+		t.Fatal("Unknown game detected as ", a.Game())
+	}
+	a.SetQuitFlag()
+	a.GoroutineFunc(nil, nil)
+}
+
+func TestCatalog(t *testing.T) {
+	ids := make(map[string]bool)
+	for _, g := range Catalog {
+		if ids[g.Id] {
+			t.Error("Duplicate game id ", g.Id)
+		}
+		ids[g.Id] = true
+
+		if g.Port <= 0 || g.Port > 65535 {
+			t.Error("Invalid port of ", g.Id, ": ", g.Port)
+		}
+		if _, err := NewPlugin(g.Plugin); err != nil {
+			t.Error("Invalid plugin of ", g.Id, ": ", err)
+		}
+	}
+
+	if g, ok := CatalogGame("TH123"); !ok || g.Plugin != 123 {
+		t.Error("Th123 not found in catalog")
+	}
+	if _, ok := CatalogGame("th999"); ok {
+		t.Error("Th999 found in catalog")
+	}
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loggerProbe = logrus.WithField("Probe", "internal")
+
+// ProbeOptions broker probing options
+type ProbeOptions struct {
+	Count       int           // pings per broker
+	Interval    time.Duration // interval between pings of one broker
+	Timeout     time.Duration // dial and response timeout of each request
+	Concurrency int           // brokers probed at the same time
+}
+
+// DefaultProbeOptions default probing options, 5 pings per broker like old NetBrokerDelay
+func DefaultProbeOptions() ProbeOptions {
+	return ProbeOptions{
+		Count:       5,
+		Interval:    time.Millisecond * 100,
+		Timeout:     time.Millisecond * 500,
+		Concurrency: 16,
+	}
+}
+
+// BrokerProbe probing result of one broker
+type BrokerProbe struct {
+	Address       string            `json:"address"`
+	Reachable     bool              `json:"reachable"`       // at least one ping answered
+	Sent          int               `json:"sent"`            // pings sent
+	Received      int               `json:"received"`        // pings answered
+	Loss          float64           `json:"loss"`            // ratio of lost pings
+	Median        time.Duration     `json:"median_ns"`       // median RTT of answered pings
+	Mean          time.Duration     `json:"mean_ns"`         // mean RTT of answered pings
+	Jitter        time.Duration     `json:"jitter_ns"`       // mean difference of successive RTT
+	Version       string            `json:"version"`         // broker version, empty if unknown
+	TunnelVersion byte              `json:"tunnel_version"`  // broker tunnel version, 0 if unknown
+	UserCount     int               `json:"users"`           // user count from BROKER_STATUS, -1 if unknown
+	Meta          *utils.BrokerMeta `json:"meta,omitempty"`  // metadata from network discovery, nil if unknown
+	Error         string            `json:"error,omitempty"` // last error
+}
+
+// Compatible check if broker tunnel version matches client
+func (p *BrokerProbe) Compatible() bool {
+	return p.TunnelVersion == utils.TunnelVersion
+}
+
+// RankPolicy broker ranking policy, brokers with lower score ranked first
+//
+//	score = median + JitterWeight * jitter + loss * LossPenaltyMs
+type RankPolicy struct {
+	JitterWeight      float64  `json:"jitter_weight"`      // weight of jitter in score
+	LossPenaltyMs     int      `json:"loss_penalty_ms"`    // score penalty of 100% loss
+	MaxLoss           float64  `json:"max_loss"`           // brokers with higher loss ranked after others
+	RequireCompatible bool     `json:"require_compatible"` // incompatible brokers ranked after others
+	Prefer            []string `json:"prefer"`             // usable brokers ranked first in this order
+}
+
+// DefaultRankPolicy default ranking policy
+func DefaultRankPolicy() RankPolicy {
+	return RankPolicy{
+		JitterWeight:      1,
+		LossPenaltyMs:     1000,
+		MaxLoss:           0.5,
+		RequireCompatible: true,
+	}
+}
+
+// Score broker score with policy, lower is better
+func (p *BrokerProbe) Score(policy RankPolicy) time.Duration {
+	return p.Median + time.Duration(policy.JitterWeight*float64(p.Jitter)) +
+		time.Duration(p.Loss*float64(policy.LossPenaltyMs)*float64(time.Millisecond))
+}
+
+// usable check if broker passes policy limits
+func (p *BrokerProbe) usable(policy RankPolicy) bool {
+	return p.Reachable && p.Loss <= policy.MaxLoss && (!policy.RequireCompatible || p.Compatible())
+}
+
+// RankBrokers sort probes with policy: preferred, usable by score, reachable by score, then unreachable
+func RankBrokers(probes []BrokerProbe, policy RankPolicy) []BrokerProbe {
+
+	prefer := make(map[string]int)
+	for i, addr := range policy.Prefer {
+		if _, ok := prefer[addr]; !ok {
+			prefer[addr] = i
+		}
+	}
+
+	// tier: 0 preferred, 1 usable, 2 reachable, 3 unreachable
+	tier := func(p *BrokerProbe) int {
+		switch {
+		case !p.Reachable:
+			return 3
+		case !p.usable(policy):
+			return 2
+		}
+		if _, ok := prefer[p.Address]; ok {
+			return 0
+		}
+		return 1
+	}
+
+	ranked := make([]BrokerProbe, len(probes))
+	copy(ranked, probes)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := &ranked[i], &ranked[j]
+		ta, tb := tier(a), tier(b)
+		if ta != tb {
+			return ta < tb
+		}
+		if ta == 0 {
+			return prefer[a.Address] < prefer[b.Address]
+		}
+		if ta == 3 {
+			return a.Address < b.Address
+		}
+		return a.Score(policy) < b.Score(policy)
+	})
+
+	return ranked
+}
+
+// ProbeBrokers probe brokers concurrently, results are in order of addrs
+func ProbeBrokers(addrs []string, opt ProbeOptions) []BrokerProbe {
+
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 1
+	}
+
+	probes := make([]BrokerProbe, len(addrs))
+	sem := make(chan struct{}, opt.Concurrency)
+	var wg sync.WaitGroup
+
+	for i := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = ProbeBroker(addrs[i], opt)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	return probes
+}
+
+// ProbeBroker ping broker opt.Count times and get its version and status
+func ProbeBroker(addr string, opt ProbeOptions) BrokerProbe {
+
+	p := BrokerProbe{Address: addr, UserCount: -1}
+
+	var rtts []time.Duration
+	for i := 0; i < opt.Count; i++ {
+		if i > 0 {
+			time.Sleep(opt.Interval)
+		}
+
+		p.Sent++
+		_, rtt, err := brokerRequest(addr, utils.PING, nil, opt.Timeout)
+		if err != nil {
+			loggerProbe.WithError(err).Debug("Ping ", addr, " failed")
+			p.Error = err.Error()
+			continue
+		}
+		p.Received++
+		rtts = append(rtts, rtt)
+	}
+
+	if p.Sent > 0 {
+		p.Loss = float64(p.Sent-p.Received) / float64(p.Sent)
+	}
+	if p.Received == 0 {
+		return p
+	}
+	p.Reachable = true
+
+	// mean and jitter in order of samples
+	var sum, diff time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			diff += d
+		}
+	}
+	p.Mean = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		p.Jitter = diff / time.Duration(len(rtts)-1)
+	}
+
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	if n := len(sorted); n%2 == 1 {
+		p.Median = sorted[n/2]
+	} else {
+		p.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	// version and status
+	data, _, err := brokerRequest(addr, utils.VERSION, nil, opt.Timeout)
+	if err == nil && len(data) >= 6 {
+		p.TunnelVersion = data[0]
+		p.Version = string(data[1:])
+	}
+	data, _, err = brokerRequest(addr, utils.BROKER_STATUS, nil, opt.Timeout)
+	if err == nil && len(data) >= 4 {
+		p.UserCount = int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	}
+
+	return p
+}
+
+// brokerRequest send one command to broker, return response data and time from send to response
+func brokerRequest(addr string, t utils.DataType, data []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	timeSend := time.Now()
+	_ = conn.SetDeadline(timeSend.Add(timeout))
+	_, err = conn.Write(utils.NewDataFrame(t, data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, utils.CmdBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Now().Sub(timeSend)
+
+	dataStream := utils.NewDataStream()
+	dataStream.Append(buf[:n])
+	if !dataStream.Parse() || dataStream.Type() != t {
+		return nil, 0, errors.New("invalid response from broker " + addr)
+	}
+
+	return dataStream.Data(), rtt, nil
+}
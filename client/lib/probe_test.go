@@ -0,0 +1,122 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/weilinfox/youmu-thlink/utils"
+)
+
+// fakeBroker answer PING, VERSION and BROKER_STATUS like broker
+func fakeBroker(t *testing.T, users int) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			buf := make([]byte, utils.CmdBufSize)
+			n, err := conn.Read(buf)
+			if err == nil {
+				dataStream := utils.NewDataStream()
+				dataStream.Append(buf[:n])
+				if dataStream.Parse() {
+					switch dataStream.Type() {
+					case utils.PING:
+						_, _ = conn.Write(utils.NewDataFrame(utils.PING, nil))
+					case utils.VERSION:
+						_, _ = conn.Write(utils.NewDataFrame(utils.VERSION, append([]byte{utils.TunnelVersion}, utils.Version...)))
+					case utils.BROKER_STATUS:
+						_, _ = conn.Write(utils.NewDataFrame(utils.BROKER_STATUS, []byte{0, 0, 0, byte(users)}))
+					}
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestProbeBrokers(t *testing.T) {
+	alive := fakeBroker(t, 3)
+
+	// closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := listener.Addr().String()
+	_ = listener.Close()
+
+	opt := ProbeOptions{Count: 3, Interval: time.Millisecond, Timeout: time.Millisecond * 200, Concurrency: 2}
+	probes := ProbeBrokers([]string{dead, alive}, opt)
+
+	if probes[0].Address != dead || probes[0].Reachable || probes[0].Loss != 1 || probes[0].Error == "" {
+		t.Error("Closed port should be unreachable: ", probes[0])
+	}
+	a := probes[1]
+	if !a.Reachable || a.Sent != 3 || a.Received != 3 || a.Loss != 0 || a.Median <= 0 {
+		t.Error("Fake broker probe failed: ", a)
+	}
+	if a.Version != utils.Version || !a.Compatible() || a.UserCount != 3 {
+		t.Error("Fake broker version or status wrong: ", a)
+	}
+
+	ranked := RankBrokers(probes, DefaultRankPolicy())
+	if ranked[0].Address != alive || ranked[1].Address != dead {
+		t.Error("Unreachable broker should rank last: ", ranked)
+	}
+}
+
+func TestRankBrokers(t *testing.T) {
+	ms := time.Millisecond
+	probes := []BrokerProbe{
+		{Address: "dead", Loss: 1},
+		{Address: "lossy", Reachable: true, Median: 10 * ms, Loss: 0.8, TunnelVersion: utils.TunnelVersion},
+		{Address: "old", Reachable: true, Median: 5 * ms, TunnelVersion: utils.TunnelVersion - 1},
+		{Address: "jitter", Reachable: true, Median: 20 * ms, Jitter: 30 * ms, TunnelVersion: utils.TunnelVersion},
+		{Address: "stable", Reachable: true, Median: 30 * ms, Jitter: ms, TunnelVersion: utils.TunnelVersion},
+		{Address: "fast", Reachable: true, Median: 15 * ms, Loss: 0.2, TunnelVersion: utils.TunnelVersion},
+	}
+
+	check := func(policy RankPolicy, expect ...string) {
+		t.Helper()
+		ranked := RankBrokers(probes, policy)
+		for i, addr := range expect {
+			if ranked[i].Address != addr {
+				got := make([]string, len(ranked))
+				for j := range ranked {
+					got[j] = ranked[j].Address
+				}
+				t.Fatal("Rank ", got, " expect ", expect)
+			}
+		}
+	}
+
+	// 20% loss costs 200ms with default penalty, jitter weights 1
+	check(DefaultRankPolicy(), "stable", "jitter", "fast", "old", "lossy", "dead")
+
+	// ignore loss and jitter, allow incompatible
+	check(RankPolicy{MaxLoss: 1}, "old", "lossy", "fast", "jitter", "stable", "dead")
+
+	// preferred brokers first if usable
+	policy := DefaultRankPolicy()
+	policy.Prefer = []string{"dead", "fast", "old"}
+	check(policy, "fast", "stable", "jitter", "old", "lossy", "dead")
+
+	// probes not modified
+	if probes[0].Address != "dead" {
+		t.Error("RankBrokers modified input")
+	}
+}
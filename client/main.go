@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
-	"sort"
+	"os"
+	"strings"
 
 	client "github.com/weilinfox/youmu-thlink/client/lib"
+	"github.com/weilinfox/youmu-thlink/client/lib/config"
 
 	"github.com/sirupsen/logrus"
 )
@@ -13,15 +15,50 @@ var logger = logrus.WithField("client", "main")
 
 func main() {
 
-	localPort := flag.Int("p", client.DefaultLocalPort, "local port will connect to")
-	server := flag.String("s", client.DefaultServerHost, "hostname of server")
-	tunnelType := flag.String("t", client.DefaultTunnelType, "tunnel type, support tcp and quic")
-	autoSelect := flag.Bool("a", true, "auto select broker in network with lowest latency")
-	noAutoSelect := flag.Bool("na", false, "DO NOT auto select broker in network with lowest latency (override -a)")
-	plugin := flag.Int("l", 0, "enable plugin, 123 for hisoutensoku spectacle support, 155 for hyouibana spectacle support")
-	debug := flag.Bool("d", false, "debug mode")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd.run(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	// legacy command line without subcommand, same as serve
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		printUsage(fs)
+	}
+	runTunnel(fs, os.Args[1:], true)
+}
+
+// runTunnel connect tunnel and serve, with spectating plugin options if withPlugin
+func runTunnel(fs *flag.FlagSet, args []string, withPlugin bool) {
 
-	flag.Parse()
+	localPort := fs.Int("p", client.DefaultLocalPort, "local port will connect to")
+	server := fs.String("s", client.DefaultServerHost, "hostname of server")
+	tunnelType := fs.String("t", client.DefaultTunnelType, "tunnel type, support tcp and quic")
+	autoSelect := fs.Bool("a", true, "auto select broker in network with lowest latency")
+	noAutoSelect := fs.Bool("na", false, "DO NOT auto select broker in network with lowest latency (override -a)")
+	game := fs.String("g", "", "configure port and plugin for game, one of "+strings.Join(client.CatalogIds(), ", ")+" (-p and -l override)")
+	overlay := fs.String("o", "", "serve live events and streaming overlay page on this address, e.g. "+client.DefaultControlAddr)
+	configPath := fs.String("config", config.DefaultPath(), "config file path")
+	profile := fs.String("P", "", "load saved profile, \""+config.LastProfile+"\" for last used settings (other flags override)")
+	saveProfile := fs.String("save", "", "save settings as profile with this name after connected")
+	favourite := fs.Bool("fav", false, "add connected broker to favourite brokers")
+	jsonOutput := fs.Bool("json", false, "print tunnel status as JSON lines on stdout")
+	tuiMode := fs.Bool("tui", false, "show full-screen terminal dashboard")
+	direct := fs.Bool("direct", false, "try direct connection with guests joined with \"guest\" command, fall back to broker relay")
+	debug := fs.Bool("d", false, "debug mode")
+
+	plugin, history, spectateCache, api := new(int), new(string), new(bool), new(string)
+	if withPlugin {
+		fs.IntVar(plugin, "l", 0, "enable plugin, 105 for scarlet weather rhapsody spectacle support, 123 for hisoutensoku spectacle support, 155 for hyouibana spectacle support, -1 for auto detection")
+		fs.IntVar(plugin, "plugin", 0, "same as -l")
+		fs.StringVar(history, "m", "", "append th10.5/th12.3 match history as JSON Lines to this file, \"default\" for "+client.DefaultHistoryPath()+" (need -l 105, -l 123 or -l -1)")
+		fs.BoolVar(spectateCache, "c", false, "let broker serve th12.3 spectators with cache (need -l 123 or -l -1)")
+		fs.StringVar(api, "api", "", "run headless with HTTP/JSON control API on this address, e.g. "+client.DefaultControlAddr+" or unix:/path/to/socket")
+	}
+
+	_ = fs.Parse(args)
 
 	if *debug {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -29,37 +66,120 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.WithError(err).Warn("Load config failed, use default")
+	}
+
+	if *api != "" {
+		s := client.NewControlServer()
+		s.SetRankPolicy(cfg.RankPolicy)
+		tokenPath := client.DefaultControlTokenPath()
+		err = s.SaveToken(tokenPath)
+		if err != nil {
+			logger.WithError(err).Warn("Save control API token failed")
+		} else {
+			logger.Info("Control API token saved to ", tokenPath)
+		}
+		logger.Info("Control API token: ", s.Token())
+
+		err = s.ListenAndServe(*api)
+		if err != nil {
+			logger.WithError(err).Fatal("Control API error")
+		}
+		return
+	}
+
+	// flags set by user override profile and catalog
+	userSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		userSet[f.Name] = true
+	})
+	if userSet["plugin"] {
+		userSet["l"] = true
+	}
+
+	if *profile != "" {
+		prof, ok := cfg.Profile(*profile)
+		if !ok {
+			logger.Fatal("No such profile " + *profile + ", saved " + strings.Join(cfg.ProfileNames(), ", "))
+		}
+
+		if !userSet["s"] {
+			*server = prof.Server
+		}
+		if !userSet["t"] {
+			*tunnelType = prof.TunnelType
+		}
+		if !userSet["p"] {
+			*localPort = prof.LocalPort
+			userSet["p"] = true
+		}
+		if !userSet["l"] && withPlugin {
+			*plugin = prof.Plugin
+			userSet["l"] = true
+		}
+		if !userSet["a"] && !userSet["na"] {
+			*autoSelect = prof.AutoSelect
+		}
+		if !userSet["g"] {
+			*game = prof.Game
+		}
+		if !userSet["direct"] {
+			*direct = prof.Direct
+		}
+
+		logger.Info("Load profile ", *profile)
+	}
+
+	if *game != "" {
+		g, ok := client.CatalogGame(*game)
+		if !ok {
+			logger.Fatal("No such game " + *game + ", support " + strings.Join(client.CatalogIds(), ", "))
+		}
+
+		if !userSet["p"] {
+			*localPort = g.Port
+		}
+		if !userSet["l"] && withPlugin {
+			*plugin = g.Plugin
+		}
+
+		logger.Info("Configure for ", g.Name, ": port ", *localPort, ", plugin ", *plugin, ", transport ", g.Transport)
+		for _, t := range g.Tools {
+			logger.Info("Helper tool required: ", t)
+		}
+	}
+
+	if *direct && *plugin != 0 {
+		// direct path bypasses plugin
+		logger.Fatal("-direct does not work with plugin, set -l 0")
+	}
+
 	chooseBroker := *server
 	if *autoSelect && !*noAutoSelect {
 
-		// ping delays
-		serverDelays, err := client.NetBrokerDelay(*server)
+		brokers, err := client.RankNetBrokers(*server, cfg.RankPolicy)
 		if err != nil {
 			logger.WithError(err).Fatal("Get broker delay in network failed")
 		}
 
-		// int=>string
-		delayServers := make(map[int]string)
-		sortDelay := make([]int, len(serverDelays))
-		i := 0
-		for k, v := range serverDelays {
-			delayServers[v] = k
-			sortDelay[i] = v
-			i++
+		// print 5 of best brokers
+		for i := 0; i < 5 && i < len(brokers) && brokers[i].Reachable; i++ {
+			b := brokers[i]
+			note := ""
+			if cfg.IsFavourite(b.Address) {
+				note = " (favourite)"
+			}
+			logger.Infof("%.3fms jitter %.3fms loss %.0f%% %s%s", float64(b.Median)/1000000,
+				float64(b.Jitter)/1000000, b.Loss*100, b.Address, note)
 		}
 
-		// sort ping delays
-		sort.Ints(sortDelay)
-
-		// print 5 of low latency brokers
-		for i = 0; i < 5 && i < len(delayServers); i++ {
-			// drop >200ms
-			if sortDelay[i] >= 1000000*200 {
-				break
-			}
-			logger.Infof("%.3fms %s", float64(sortDelay[i])/1000000, delayServers[sortDelay[i]])
+		if len(brokers) > 0 && brokers[0].Reachable {
+			chooseBroker = brokers[0].Address
+		} else {
+			logger.Warn("No broker reachable in network, use ", *server)
 		}
-		chooseBroker = delayServers[sortDelay[0]]
 	}
 
 	c, err := client.New(*localPort, chooseBroker, *tunnelType)
@@ -82,23 +202,128 @@ func main() {
 	bStatus := c.BrokerStatus()
 	logger.Infof("Currently %d user(s) on broker", bStatus.UserCount)
 
+	if *spectateCache && (*plugin == 123 || *plugin == client.PluginAuto) {
+		c.SetSpectateCache(true)
+	}
+	c.SetDirect(*direct)
+
 	err = c.Connect()
 	if err != nil {
 		logger.WithError(err).Fatal("Client connect error")
 	}
 
-	switch *plugin {
-	case 123:
-		logger.Info("Append th12.3 hisoutensoku plugin")
-		h := client.NewHisoutensoku()
-		err = c.Serve(h.ReadFunc, h.WriteFunc, h.GoroutineFunc, h.SetQuitFlag)
-	case 155:
-		logger.Info("Append th15.5 hyouibana plugin")
-		h := client.NewHyouibana()
-		err = c.Serve(h.ReadFunc, h.WriteFunc, h.GoroutineFunc, h.SetQuitFlag)
-	default:
+	used := config.Profile{
+		Name:       *saveProfile,
+		Server:     *server,
+		TunnelType: *tunnelType,
+		LocalPort:  *localPort,
+		Plugin:     *plugin,
+		AutoSelect: *autoSelect && !*noAutoSelect,
+		Game:       *game,
+		Direct:     *direct,
+	}
+	changed := cfg.SetLastUsed(used)
+	if *saveProfile != "" {
+		err = cfg.SetProfile(used)
+		if err != nil {
+			logger.WithError(err).Error("Save profile failed")
+		} else {
+			logger.Info("Save profile ", *saveProfile)
+			changed = true
+		}
+	}
+	if *favourite && !cfg.IsFavourite(chooseBroker) {
+		cfg.AddFavourite(chooseBroker)
+		logger.Info("Add ", chooseBroker, " to favourite brokers")
+		changed = true
+	}
+	if changed {
+		err = cfg.Save()
+		if err != nil {
+			logger.WithError(err).Warn("Save config failed")
+		}
+	}
+
+	if *history == "default" {
+		*history = client.DefaultHistoryPath()
+	}
+
+	// setupPlugin apply command line options to plugin
+	setupPlugin := func(p client.Plugin) {
+		switch h := p.(type) {
+		case *client.Hisoutensoku:
+			if h.GetGame() == 123 {
+				logger.Info("Append th12.3 hisoutensoku plugin")
+			} else {
+				logger.Info("Append th10.5 scarlet weather rhapsody plugin")
+			}
+			if c.SpectatorHost() != "" {
+				logger.Info("Spectators can connect to broker spectate cache ", c.SpectatorHost())
+				h.SetSpectateCache(true)
+			}
+			if *history != "" {
+				logger.Info("Write match history to ", *history)
+				h.SetMatchHistory(client.NewMatchHistory(*history))
+			}
+		case *client.Hyouibana:
+			logger.Info("Append th15.5 hyouibana plugin")
+		}
+	}
+
+	// newPlugin new plugin set up with command line options
+	newPlugin := func() (client.Plugin, error) {
+		p, err := client.NewPlugin(*plugin)
+		if err != nil {
+			return nil, err
+		}
+		switch h := p.(type) {
+		case nil:
+		case *client.AutoPlugin:
+			logger.Info("Append game auto detection plugin")
+			h.SetDetectFunc(func(_ int, p client.Plugin) {
+				setupPlugin(p)
+			})
+		default:
+			setupPlugin(p)
+		}
+		return p, nil
+	}
+
+	p, err := newPlugin()
+	if err != nil {
+		logger.WithError(err).Fatal("Plugin setup error")
+	}
+
+	if *overlay != "" {
+		s := client.NewOverlayServer()
+		defer s.Close()
+		s.Attach(c, p)
+		go func() {
+			err := s.ListenAndServe(*overlay)
+			if err != nil {
+				logger.WithError(err).Error("Overlay server error")
+			}
+		}()
+		logger.Info("Overlay page at http://", *overlay, "/overlay")
+	}
+
+	if *tuiMode {
+		runTUI(c, p, newPlugin)
+		return
+	}
+
+	if *jsonOutput {
+		printJSON(client.NewTunnelInfo(0, c, p))
+	}
+
+	if p != nil {
+		err = c.Serve(p.ReadFunc, p.WriteFunc, p.GoroutineFunc, p.SetQuitFlag)
+	} else {
 		err = c.Serve(nil, nil, nil, nil)
 	}
+	if *jsonOutput {
+		printJSON(client.NewTunnelInfo(0, c, p))
+	}
 	if err != nil {
 		logger.WithError(err).Fatal("Serve client error")
 	}
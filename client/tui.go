@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/weilinfox/youmu-thlink/client/lib"
+	"github.com/weilinfox/youmu-thlink/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tuiDelayLen = 40 // delay samples in sparkline, same as gtk delay chart
+	tuiLogLen   = 6  // log lines shown
+)
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+// tui full-screen terminal dashboard
+type tui struct {
+	c         *client.Client
+	plugin    client.Plugin
+	newPlugin func() (client.Plugin, error)
+
+	serveDone chan error // serve goroutine quit with error
+	serving   bool       // serve goroutine running
+	message   string     // last message shown under status
+
+	delay    []float64 // delay samples in ms
+	logLock  sync.Mutex
+	logLines []string
+}
+
+// runTUI serve client and show dashboard until q pressed
+func runTUI(c *client.Client, p client.Plugin, newPlugin func() (client.Plugin, error)) {
+
+	t := &tui{
+		c:         c,
+		plugin:    p,
+		newPlugin: newPlugin,
+		serveDone: make(chan error, 1),
+	}
+
+	// logs are shown in dashboard
+	logOutput := logrus.StandardLogger().Out
+	logrus.SetOutput(t)
+	defer logrus.SetOutput(logOutput)
+
+	restore, err := sttyRaw()
+	if err != nil {
+		t.message = "Cannot set terminal raw mode, press Enter after key"
+	} else {
+		defer restore()
+	}
+
+	// alternate screen and hide cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			if n > 0 {
+				keys <- buf[0]
+			}
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	t.serve()
+	t.draw()
+
+	for {
+		select {
+		case <-ticker.C:
+			if t.serving && t.c.TunnelStatus() == utils.STATUS_CONNECTED {
+				t.delay = append(t.delay, float64(t.c.TunnelDelay().Nanoseconds())/1000000)
+				if len(t.delay) > tuiDelayLen {
+					t.delay = t.delay[1:]
+				}
+			}
+
+		case err := <-t.serveDone:
+			t.serving = false
+			if err != nil {
+				t.message = "Tunnel closed: " + err.Error() + ", press r to reconnect"
+			} else {
+				t.message = "Tunnel closed, press r to reconnect"
+			}
+
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				break
+			}
+			switch key {
+			case 'c', 'C':
+				t.copyAddress()
+			case 'r', 'R':
+				t.reconnect()
+			case 'q', 'Q':
+				t.quit()
+				return
+			}
+
+		case <-interrupt:
+			t.quit()
+			return
+		}
+
+		t.draw()
+	}
+}
+
+// Write collect log lines
+func (t *tui) Write(p []byte) (int, error) {
+	t.logLock.Lock()
+	defer t.logLock.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.logLines = append(t.logLines, line)
+	}
+	if len(t.logLines) > tuiLogLen {
+		t.logLines = t.logLines[len(t.logLines)-tuiLogLen:]
+	}
+
+	return len(p), nil
+}
+
+// serve start serving current plugin in goroutine
+func (t *tui) serve() {
+
+	p := t.plugin
+	t.serving = true
+	go func() {
+		if p != nil {
+			t.serveDone <- t.c.Serve(p.ReadFunc, p.WriteFunc, p.GoroutineFunc, p.SetQuitFlag)
+		} else {
+			t.serveDone <- t.c.Serve(nil, nil, nil, nil)
+		}
+	}()
+}
+
+// reconnect close tunnel, connect new one and serve with new plugin
+func (t *tui) reconnect() {
+
+	t.message = "Reconnecting"
+	t.draw()
+
+	t.c.Close()
+	if t.serving {
+		select {
+		case <-t.serveDone:
+		case <-time.After(time.Second * 3):
+			logger.Warn("Serve goroutine not quit in time")
+		}
+		t.serving = false
+	}
+
+	err := t.c.Connect()
+	if err != nil {
+		t.message = "Reconnect failed: " + err.Error()
+		return
+	}
+	t.plugin, err = t.newPlugin()
+	if err != nil {
+		t.message = "Plugin setup failed: " + err.Error()
+		return
+	}
+	t.delay = t.delay[:0]
+	t.serve()
+
+	t.message = "Reconnected"
+}
+
+// copyAddress copy peer address to clipboard with OSC 52
+func (t *tui) copyAddress() {
+
+	addr := t.c.PeerHost()
+	if !t.serving || addr == "" {
+		t.message = "Nothing to copy"
+		return
+	}
+
+	fmt.Print("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(addr)) + "\a")
+	t.message = "Copied " + addr
+}
+
+// quit close tunnel
+func (t *tui) quit() {
+	t.c.Close()
+	if t.serving {
+		select {
+		case <-t.serveDone:
+		case <-time.After(time.Second * 3):
+		}
+	}
+}
+
+// draw redraw whole screen
+func (t *tui) draw() {
+
+	info := client.NewTunnelInfo(0, t.c, t.plugin)
+	status := info.Status
+	if !t.serving {
+		status = "closed"
+	}
+	peer := info.PeerHost
+	if !t.serving || peer == "" {
+		peer = "No tunnel established"
+	}
+
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		b.WriteString(fmt.Sprintf(format, a...))
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	b.WriteString("\x1b[H")
+	line("\x1b[1m白玉楼製作所 ThLink\x1b[0m v%s-%d", utils.Version, utils.TunnelVersion)
+	line("")
+	line("Broker      %s", info.Server)
+	line("Local port  %d (%s)", info.LocalPort, info.TunnelType)
+	line("Peer        \x1b[1m%s\x1b[0m", peer)
+	if info.RoomCode != "" {
+		line("Room code   \x1b[1m%s\x1b[0m", info.RoomCode)
+	}
+	if info.SpectatorHost != "" {
+		line("Spectator   %s", info.SpectatorHost)
+	}
+	line("Tunnel      %s", status)
+	line("Path        %s", info.Path)
+	if len(t.delay) > 0 {
+		line("RTT         %.2fms %s", t.delay[len(t.delay)-1], sparkline(t.delay))
+	} else {
+		line("RTT         -")
+	}
+
+	if pl := info.Plugin; pl != nil {
+		s := pl.Status
+		if pl.Game != 0 {
+			s = "th" + gameVersion(pl.Game) + " " + s
+		}
+		if pl.ReplayDelayMs > 0 {
+			s += fmt.Sprintf(" | replay delay %.0fms", pl.ReplayDelayMs)
+		}
+		s += fmt.Sprintf(" | %d spectator(s)", pl.Spectators)
+		if pl.SokuRoll != nil {
+			s += " | SokuRoll"
+		}
+		line("Plugin      %s", s)
+	}
+
+	line("")
+	line("%s", t.message)
+	line("")
+	line("\x1b[7m c \x1b[0m copy address  \x1b[7m r \x1b[0m reconnect  \x1b[7m q \x1b[0m quit")
+	line("")
+
+	t.logLock.Lock()
+	for _, l := range t.logLines {
+		line("\x1b[2m%s\x1b[0m", l)
+	}
+	t.logLock.Unlock()
+
+	// clear rest of screen
+	b.WriteString("\x1b[J")
+
+	fmt.Print(b.String())
+}
+
+// sparkline draw samples with block characters
+func sparkline(samples []float64) string {
+
+	min, max := math.MaxFloat64, 0.0
+	for _, s := range samples {
+		min = math.Min(min, s)
+		max = math.Max(max, s)
+	}
+
+	r := make([]rune, len(samples))
+	for i, s := range samples {
+		level := 0
+		if max > min {
+			level = int((s - min) / (max - min) * float64(len(sparkLevels)-1))
+		}
+		r[i] = sparkLevels[level]
+	}
+
+	return string(r)
+}
+
+// gameVersion game number to version, 123 to 12.3
+func gameVersion(game int) string {
+	return fmt.Sprintf("%d.%d", game/10, game%10)
+}
+
+// sttyRaw disable line buffering and echo of terminal with stty, return function to restore
+func sttyRaw() (func(), error) {
+
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = os.Stdin
+	state, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd = exec.Command("stty", "-icanon", "-echo", "min", "1")
+	cmd.Stdin = os.Stdin
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		cmd := exec.Command("stty", strings.TrimSpace(string(state)))
+		cmd.Stdin = os.Stdin
+		_ = cmd.Run()
+	}, nil
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	MetaFieldMax = 64 // max length of string field in BrokerMeta
+)
+
+// BrokerTransports tunnel transports supported by this broker build
+var BrokerTransports = []string{"quic", "tcp"}
+
+// BrokerMeta metadata of broker shown in network discovery
+type BrokerMeta struct {
+	Name       string   `json:"name,omitempty"`       // display name
+	Region     string   `json:"region,omitempty"`     // region, like cn-east
+	Contact    string   `json:"contact,omitempty"`    // operator contact
+	Capacity   int      `json:"capacity"`             // max tunnels, 0 unlimited
+	Load       int      `json:"load"`                 // current tunnels
+	Transports []string `json:"transports,omitempty"` // supported tunnel transports
+	Version    string   `json:"version,omitempty"`    // broker version
+}
+
+// metaTag tag of BrokerMeta field in encoded metadata
+type metaTag byte
+
+const (
+	metaName metaTag = iota + 1
+	metaRegion
+	metaContact
+	metaCapacity
+	metaLoad
+	metaTransports
+	metaVersion
+)
+
+// Encode encode metadata as tag, length, value list; strings longer than MetaFieldMax are cut
+//
+//	+-----+--------+-------+-----+
+//	| tag | length | value | ... |
+//	|  8  |   8    |       |     |
+//	+-----+--------+-------+-----+
+//
+// numbers are 32bit, transports are separated by comma
+func (m *BrokerMeta) Encode() []byte {
+
+	var data []byte
+	appendString := func(tag metaTag, s string) {
+		if s == "" {
+			return
+		}
+		if len(s) > MetaFieldMax {
+			s = s[:MetaFieldMax]
+		}
+		data = append(data, byte(tag), byte(len(s)))
+		data = append(data, []byte(s)...)
+	}
+	appendInt := func(tag metaTag, n int) {
+		data = append(data, byte(tag), 4, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	appendString(metaName, m.Name)
+	appendString(metaRegion, m.Region)
+	appendString(metaContact, m.Contact)
+	appendInt(metaCapacity, m.Capacity)
+	appendInt(metaLoad, m.Load)
+	appendString(metaTransports, strings.Join(m.Transports, ","))
+	appendString(metaVersion, m.Version)
+
+	return data
+}
+
+// DecodeBrokerMeta decode metadata, unknown tags are skipped
+func DecodeBrokerMeta(data []byte) (BrokerMeta, error) {
+
+	var m BrokerMeta
+	for i := 0; i < len(data); {
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return m, errors.New("broker metadata broken")
+		}
+		tag, value := metaTag(data[i]), data[i+2:i+2+int(data[i+1])]
+		i += 2 + len(value)
+
+		switch tag {
+		case metaName:
+			m.Name = string(value)
+		case metaRegion:
+			m.Region = string(value)
+		case metaContact:
+			m.Contact = string(value)
+		case metaCapacity, metaLoad:
+			if len(value) != 4 {
+				return m, errors.New("broker metadata broken")
+			}
+			n := int(value[0])<<24 + int(value[1])<<16 + int(value[2])<<8 + int(value[3])
+			if tag == metaCapacity {
+				m.Capacity = n
+			} else {
+				m.Load = n
+			}
+		case metaTransports:
+			m.Transports = strings.Split(string(value), ",")
+		case metaVersion:
+			m.Version = string(value)
+		}
+	}
+
+	return m, nil
+}
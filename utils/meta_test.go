@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBrokerMeta(t *testing.T) {
+	meta := BrokerMeta{
+		Name:       "thlink",
+		Region:     "cn-east",
+		Contact:    strings.Repeat("c", MetaFieldMax+10),
+		Capacity:   100,
+		Load:       70000,
+		Transports: []string{"quic", "tcp"},
+		Version:    Version,
+	}
+
+	data := meta.Encode()
+	// unknown tag skipped
+	data = append(data, 0xff, 1, 0)
+	decoded, err := DecodeBrokerMeta(data)
+	if err != nil {
+		t.Fatal("Decode broker metadata failed: ", err.Error())
+	}
+	if decoded.Name != meta.Name || decoded.Region != meta.Region || decoded.Capacity != meta.Capacity ||
+		decoded.Load != meta.Load || strings.Join(decoded.Transports, ",") != "quic,tcp" || decoded.Version != Version {
+		t.Error("Broker metadata decode error: ", decoded)
+	}
+	if len(decoded.Contact) != MetaFieldMax {
+		t.Error("Long field not cut: ", len(decoded.Contact))
+	}
+
+	if _, err = DecodeBrokerMeta(data[:len(data)-1]); err == nil {
+		t.Error("Broken metadata accepted")
+	}
+}
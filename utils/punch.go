@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bytes"
+)
+
+// PunchMagic prefix of hole punching package, such package received by udp port of
+// a listening Tunnel is passed to PunchCallback instead of being forwarded
+var PunchMagic = []byte{0xff, 'T', 'H', 'P'}
+
+// PunchType type of hole punching package
+//
+//	+-------+------+-----------------+
+//	| magic | type |      data       |
+//	|   4   |  1   |                 |
+//	+-------+------+-----------------+
+//
+// PUNCH_HOST and PUNCH_GUEST are sent to broker to register observed endpoint,
+// PUNCH_HOST carries nonce given in TUNNEL response and is dropped without it,
+// broker answers both with PUNCH_PEER, data is endpoint of the other side
+// (observed endpoint of host itself for PUNCH_HOST, empty if not known);
+// PUNCH_PING and PUNCH_PONG are sent between peers and have no data
+type PunchType byte
+
+const (
+	PUNCH_HOST PunchType = iota
+	PUNCH_GUEST
+	PUNCH_PEER
+	PUNCH_PING
+	PUNCH_PONG
+)
+
+// NewPunchPackage build hole punching package
+func NewPunchPackage(t PunchType, data []byte) []byte {
+	pkg := append([]byte{}, PunchMagic...)
+	pkg = append(pkg, byte(t))
+	return append(pkg, data...)
+}
+
+// ParsePunchPackage parse hole punching package, false if b is not one
+func ParsePunchPackage(b []byte) (PunchType, []byte, bool) {
+	if len(b) <= len(PunchMagic) || !bytes.Equal(b[:len(PunchMagic)], PunchMagic) {
+		return 0, nil, false
+	}
+	return PunchType(b[len(PunchMagic)]), b[len(PunchMagic)+1:], true
+}
@@ -8,9 +8,10 @@ import (
 )
 
 const (
-	CmdBufSize    = 64       // command frame size
-	TransBufSize  = 2048 - 3 // forward frame size
-	BrokersCntMax = 40       // max broker count
+	CmdBufSize    = 64         // command frame size
+	CmdFrameMax   = 0xffff + 3 // max command frame size broker accepts
+	TransBufSize  = 2048 - 3   // forward frame size
+	BrokersCntMax = 40         // max broker count
 )
 
 var loggerStream = logrus.WithField("utils", "stream")
@@ -76,11 +77,53 @@ const (
 	TUNNEL                          // TUNNEL ask for new tunnel
 	LZW_DATA                        // LZW_DATA lzw compressed data
 	NET_INFO                        // NET_INFO ask for all broker address in this net
-	NET_INFO_UPDATE                 // NET_INFO_UPDATE add or delete broker address in net
+	NET_INFO_UPDATE                 // NET_INFO_UPDATE message in broker to broker session
 	BROKER_INFO                     // BROKER_INFO info of this broker
 	VERSION                         // VERSION of tunnel
 	RUBBISH                         // RUBBISH nobody care about this package
 	BROKER_STATUS                   // BROKER_STATUS status of broker
+	SPECTATE_CACHE                  // SPECTATE_CACHE spectating data pushed from client to broker
+	RENDEZVOUS                      // RENDEZVOUS observed udp endpoint of guest pushed from broker to client
+	ADDR_ECHO                       // ADDR_ECHO ask broker for observed udp address, over udp
+	JOIN                            // JOIN ask for guest tunnel attached to existing udp tunnel
+)
+
+// AddrEchoFlag first byte of ADDR_ECHO request, response data is
+//
+//	+------+------------------+-------------------+
+//	| from | alternate port   | observed address  |
+//	|  1   |        2         |                   |
+//	+------+------------------+-------------------+
+//
+// from is 0 if answered by command port, 1 by alternate port
+type AddrEchoFlag byte
+
+const (
+	ECHO_SAME_PORT   AddrEchoFlag = iota // answer from the port request sent to
+	ECHO_CHANGE_PORT                     // answer from the other port
+)
+
+// AddrEchoLen ADDR_ECHO request data length, flag padded with zero,
+// request is never shorter than response so that echo does not amplify
+const AddrEchoLen = CmdBufSize - 3
+
+// SpectateCacheType first byte of SPECTATE_CACHE frame data
+//
+//	+------+-----------------------------------------------------+
+//	| type |                        data                         |
+//	+------+-----------------------------------------------------+
+//
+// SPECTATE_INIT data is th12.3 INIT_SUCCESS package;
+// SPECTATE_MATCH data is th12.3 HOST_GAME GAME_MATCH package;
+// SPECTATE_INPUT data is 8bit match id, 32bit little india first frame id, 8bit end flag and 16bit inputs;
+// SPECTATE_QUIT has no data
+type SpectateCacheType byte
+
+const (
+	SPECTATE_INIT SpectateCacheType = iota
+	SPECTATE_MATCH
+	SPECTATE_INPUT
+	SPECTATE_QUIT
 )
 
 // NewDataStream return a empty data stream parser
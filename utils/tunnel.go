@@ -26,6 +26,11 @@ type Tunnel struct {
 
 	pingDelay time.Duration
 
+	frameFunc FrameCallback
+	punchFunc PunchCallback
+
+	stream interface{} // quic.Stream or *net.TCPConn while serving
+
 	configPort0 int
 	configPort1 int
 	connection0 interface{}
@@ -43,6 +48,10 @@ const (
 	DialTcpDialUdp
 	ListenQuicListenUdp
 	ListenTcpListenUdp
+	ListenQuicDialUdp // guest joined on broker, dial udp port of host tunnel
+	ListenTcpDialUdp
+	DialQuicListenUdp // guest client, listen udp for local game
+	DialTcpListenUdp
 )
 
 type TunnelStatus int
@@ -54,7 +63,7 @@ const (
 	STATUS_FAILED
 )
 
-// TunnelConfig default IP is 0.0.0.0:0
+// TunnelConfig default address is :0, all addresses of both IPv4 and IPv6
 type TunnelConfig struct {
 	Type     TunnelType
 	Address0 string
@@ -67,10 +76,10 @@ var loggerTunnel = logrus.WithField("utils", "tunnel")
 func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
 
 	if len(strings.TrimSpace(config.Address0)) == 0 {
-		config.Address0 = "0.0.0.0:0"
+		config.Address0 = ":0"
 	}
 	if len(strings.TrimSpace(config.Address1)) == 0 {
-		config.Address1 = "0.0.0.0:0"
+		config.Address1 = ":0"
 	}
 
 	switch config.Type {
@@ -100,17 +109,14 @@ func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
 		}
 		loggerTunnel.Debug("UDP listen at ", udpConn.LocalAddr().String())
 
-		_, sport0, _ := net.SplitHostPort(quicListener.Addr().String())
-		_, sport1, _ := net.SplitHostPort(udpConn.LocalAddr().String())
-		port0, _ := strconv.ParseInt(sport0, 10, 32)
-		port1, _ := strconv.ParseInt(sport1, 10, 32)
+		port0, port1 := AddrPort(quicListener.Addr()), AddrPort(udpConn.LocalAddr())
 
 		return &Tunnel{
 			tunnelType:   config.Type,
 			tunnelStatus: STATUS_INIT,
-			configPort0:  int(port0),
+			configPort0:  port0,
 			connection0:  quicListener,
-			configPort1:  int(port1),
+			configPort1:  port1,
 			connection1:  udpConn,
 		}, nil
 
@@ -140,16 +146,13 @@ func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
 		}
 		loggerTunnel.Debug("UDP listen at ", udpConn.LocalAddr().String())
 
-		_, sport0, _ := net.SplitHostPort(tcpListener.Addr().String())
-		_, sport1, _ := net.SplitHostPort(udpConn.LocalAddr().String())
-		port0, _ := strconv.ParseInt(sport0, 10, 32)
-		port1, _ := strconv.ParseInt(sport1, 10, 32)
+		port0, port1 := AddrPort(tcpListener.Addr()), AddrPort(udpConn.LocalAddr())
 
 		return &Tunnel{
 			tunnelType:  config.Type,
-			configPort0: int(port0),
+			configPort0: port0,
 			connection0: tcpListener,
-			configPort1: int(port1),
+			configPort1: port1,
 			connection1: udpConn,
 		}, nil
 
@@ -183,16 +186,13 @@ func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
 		}
 		loggerTunnel.Debug("UDP dial ", config.Address1)
 
-		_, sport0, _ := net.SplitHostPort(config.Address0)
-		_, sport1, _ := net.SplitHostPort(config.Address1)
-		port0, _ := strconv.ParseInt(sport0, 10, 32)
-		port1, _ := strconv.ParseInt(sport1, 10, 32)
+		port0, port1 := splitPort(config.Address0), udpAddr.Port
 
 		return &Tunnel{
 			tunnelType:  config.Type,
-			configPort0: int(port0),
+			configPort0: port0,
 			connection0: quicStream,
-			configPort1: int(port1),
+			configPort1: port1,
 			connection1: udpConn,
 		}, nil
 
@@ -228,19 +228,141 @@ func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
 		}
 		loggerTunnel.Debug("UDP dial ", config.Address1)
 
-		_, sport0, _ := net.SplitHostPort(config.Address0)
-		_, sport1, _ := net.SplitHostPort(config.Address1)
-		port0, _ := strconv.ParseInt(sport0, 10, 32)
-		port1, _ := strconv.ParseInt(sport1, 10, 32)
+		port0, port1 := tcpAddr.Port, udpAddr.Port
 
 		return &Tunnel{
 			tunnelType:  config.Type,
-			configPort0: int(port0),
+			configPort0: port0,
 			connection0: tcpConn,
-			configPort1: int(port1),
+			configPort1: port1,
 			connection1: udpConn,
 		}, nil
 
+	case ListenQuicDialUdp, ListenTcpDialUdp:
+
+		var listener interface{}
+		var port0 int
+
+		if config.Type == ListenQuicDialUdp {
+			// listen quic port
+			tlsConfig, err := GenerateTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			quicListener, err := quic.ListenAddr(config.Address0, tlsConfig, nil)
+			if err != nil {
+				return nil, err
+			}
+			loggerTunnel.Debug("QUIC listen at ", quicListener.Addr().String())
+			listener = quicListener
+			port0 = AddrPort(quicListener.Addr())
+		} else {
+			// listen tcp port
+			tcpAddr, err := net.ResolveTCPAddr("tcp", config.Address0)
+			if err != nil {
+				return nil, err
+			}
+			tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+			if err != nil {
+				return nil, err
+			}
+			loggerTunnel.Debug("TCP listen at ", tcpListener.Addr().String())
+			listener = tcpListener
+			port0 = AddrPort(tcpListener.Addr())
+		}
+
+		// connect udp addr
+		udpAddr, err := net.ResolveUDPAddr("udp", config.Address1)
+		if err == nil {
+			var udpConn *net.UDPConn
+			udpConn, err = net.DialUDP("udp", nil, udpAddr)
+			if err == nil {
+				loggerTunnel.Debug("UDP dial ", config.Address1)
+
+				port1 := udpAddr.Port
+
+				return &Tunnel{
+					tunnelType:   config.Type,
+					tunnelStatus: STATUS_INIT,
+					configPort0:  port0,
+					connection0:  listener,
+					configPort1:  port1,
+					connection1:  udpConn,
+				}, nil
+			}
+		}
+
+		switch l := listener.(type) {
+		case quic.Listener:
+			_ = l.Close()
+		case *net.TCPListener:
+			_ = l.Close()
+		}
+		return nil, err
+
+	case DialQuicListenUdp, DialTcpListenUdp:
+
+		var stream interface{}
+
+		if config.Type == DialQuicListenUdp {
+			// connect quic addr
+			tlsConfig := &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{nextProto},
+			}
+			quicConn, err := quic.DialAddr(config.Address0, tlsConfig, nil)
+			if err != nil {
+				return nil, err
+			}
+			quicStream, err := quicConn.OpenStreamSync(context.Background())
+			if err != nil {
+				return nil, err
+			}
+			loggerTunnel.Debug("QUIC dial ", quicConn.RemoteAddr())
+			stream = quicStream
+		} else {
+			// connect tcp addr
+			tcpAddr, err := net.ResolveTCPAddr("tcp", config.Address0)
+			if err != nil {
+				return nil, err
+			}
+			tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+			if err != nil {
+				return nil, err
+			}
+			loggerTunnel.Debug("TCP dial ", tcpConn.RemoteAddr())
+			_ = tcpConn.SetNoDelay(true)
+			stream = tcpConn
+		}
+
+		// listen udp port
+		udpAddr, err := net.ResolveUDPAddr("udp", config.Address1)
+		if err == nil {
+			var udpConn *net.UDPConn
+			udpConn, err = net.ListenUDP("udp", udpAddr)
+			if err == nil {
+				loggerTunnel.Debug("UDP listen at ", udpConn.LocalAddr().String())
+
+				port0, port1 := splitPort(config.Address0), AddrPort(udpConn.LocalAddr())
+
+				return &Tunnel{
+					tunnelType:  config.Type,
+					configPort0: port0,
+					connection0: stream,
+					configPort1: port1,
+					connection1: udpConn,
+				}, nil
+			}
+		}
+
+		switch c := stream.(type) {
+		case quic.Stream:
+			_ = c.Close()
+		case *net.TCPConn:
+			_ = c.Close()
+		}
+		return nil, err
+
 	}
 
 	return nil, errors.New("no such protocol")
@@ -302,15 +424,64 @@ type PluginGoroutine func(interface{}, *net.UDPConn)
 // PluginSetQuitFlag set quit flag and plugin will stop function when it found it
 type PluginSetQuitFlag func()
 
+// FrameCallback called when data frame other than DATA and PING received from QUIC/TCP stream,
+// data will be reused after return, copy it if needed
+type FrameCallback func(DataType, []byte)
+
+// SetFrameCallback set FrameCallback, should be called before Serve
+func (t *Tunnel) SetFrameCallback(frameFunc FrameCallback) {
+	t.frameFunc = frameFunc
+}
+
+// PunchCallback called with sender address, type and data when hole punching package
+// received by udp port of a listening tunnel, data will be reused after return
+type PunchCallback func(*net.UDPAddr, PunchType, []byte)
+
+// SetPunchCallback set PunchCallback, should be called before Serve
+func (t *Tunnel) SetPunchCallback(punchFunc PunchCallback) {
+	t.punchFunc = punchFunc
+}
+
+// WriteFrame send data frame to the other side of QUIC/TCP stream
+func (t *Tunnel) WriteFrame(dataType DataType, data []byte) error {
+
+	var err error
+
+	switch stream := t.stream.(type) {
+	case quic.Stream:
+		_, err = stream.Write(NewDataFrame(dataType, data))
+	case *net.TCPConn:
+		_, err = stream.Write(NewDataFrame(dataType, data))
+	default:
+		err = errors.New("tunnel not serving")
+	}
+
+	return err
+}
+
+// WriteToUDP send data to addr with udp port of a listening tunnel
+func (t *Tunnel) WriteToUDP(data []byte, addr *net.UDPAddr) error {
+
+	switch t.tunnelType {
+	case ListenQuicListenUdp, ListenTcpListenUdp, DialQuicListenUdp, DialTcpListenUdp:
+		_, err := t.connection1.(*net.UDPConn).WriteToUDP(data, addr)
+		return err
+	}
+
+	return errors.New("udp port is not listening")
+}
+
 // Serve wait for connection and sync data
 // readFunc, writeFunc: see syncUdp
 func (t *Tunnel) Serve(readFunc, writeFunc PluginCallback, plRoutine PluginGoroutine, plQuit PluginSetQuitFlag) error {
 
 	switch t.tunnelType {
-	case ListenQuicListenUdp:
+	case ListenQuicListenUdp, ListenQuicDialUdp:
 
 		// accept quic stream
-		quicConn, err := t.connection0.(quic.Listener).Accept(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		quicConn, err := t.connection0.(quic.Listener).Accept(ctx)
+		cancel()
 		if err != nil {
 			t.tunnelStatus = STATUS_FAILED
 			return err
@@ -326,9 +497,9 @@ func (t *Tunnel) Serve(readFunc, writeFunc PluginCallback, plRoutine PluginGorou
 
 		defer quicStream.Close()
 
-		t.syncUdp(quicStream, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, false, false)
+		t.syncUdp(quicStream, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, false, t.tunnelType == ListenQuicDialUdp)
 
-	case ListenTcpListenUdp:
+	case ListenTcpListenUdp, ListenTcpDialUdp:
 
 		// accept tcp connection
 		err := t.connection0.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 10))
@@ -352,7 +523,7 @@ func (t *Tunnel) Serve(readFunc, writeFunc PluginCallback, plRoutine PluginGorou
 
 		defer tcpConn.Close()
 
-		t.syncUdp(tcpConn, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, false, false)
+		t.syncUdp(tcpConn, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, false, t.tunnelType == ListenTcpDialUdp)
 
 	case DialQuicDialUdp:
 
@@ -362,6 +533,10 @@ func (t *Tunnel) Serve(readFunc, writeFunc PluginCallback, plRoutine PluginGorou
 
 		t.syncUdp(t.connection0, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, true, true)
 
+	case DialQuicListenUdp, DialTcpListenUdp:
+
+		t.syncUdp(t.connection0, t.connection1.(*net.UDPConn), readFunc, writeFunc, plRoutine, plQuit, true, false)
+
 	}
 
 	return nil
@@ -404,6 +579,8 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 		return
 	}
 
+	t.stream = conn
+
 	const maxUdpRemoteNo byte = 0xFF
 
 	udpRemoteID := make(map[string]byte) // remote ip record
@@ -411,7 +588,9 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 	udpVClients := make(map[byte]chan []byte) // local virtual client
 
 	var pingTime time.Time
-	ch := make(chan int, int(maxUdpRemoteNo)*2+2)
+	ch := make(chan int, (int(maxUdpRemoteNo)+1)*2+2)
+	done := make(chan struct{}) // closed when syncUdp returns, stop udp virtual clients
+	defer close(done)
 
 	if readFunc == nil {
 		readFunc = func(data []byte) (bool, []byte) {
@@ -479,9 +658,16 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 				defer func() {
 					ch <- 1
 				}()
+				// also stop reading below
+				defer myUdpConn.Close()
 
 				for {
-					_, _ = myUdpConn.Write(<-msg)
+					select {
+					case data := <-msg:
+						_, _ = myUdpConn.Write(data)
+					case <-done:
+						return
+					}
 
 					/*if err != nil {
 						loggerTunnel.WithError(err).Warn("Write data to connected udp error")
@@ -502,7 +688,11 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 					cnt, err := myUdpConn.Read(buf)
 					if err != nil {
 						// loggerTunnel.WithError(err).Warn("Read data from connected udp error")
-						time.Sleep(time.Millisecond * 100)
+						select {
+						case <-done:
+							return
+						case <-time.After(time.Millisecond * 100):
+						}
 						continue
 					}
 
@@ -582,13 +772,15 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 									break
 								}
 							} else {
-								if ch, ok := udpVClients[data[0]]; ok {
-									ch <- data[1:]
-								} else {
-									ch = make(chan []byte, 32)
-									udpVClients[data[0]] = ch
-									udpVirtualClient(data[0], ch)
-									ch <- data[1:]
+								msg, ok := udpVClients[data[0]]
+								if !ok {
+									msg = make(chan []byte, 32)
+									udpVClients[data[0]] = msg
+									udpVirtualClient(data[0], msg)
+								}
+								select {
+								case msg <- data[1:]:
+								case <-done:
 								}
 							}
 						}
@@ -647,6 +839,12 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 						}
 					}
 
+				default:
+
+					if t.frameFunc != nil {
+						t.frameFunc(dataStream.Type(), dataStream.Data())
+					}
+
 				}
 			}
 
@@ -678,7 +876,14 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 					break
 				}
 
-				addrString := udpAddr.IP.String() + ":" + strconv.Itoa(udpAddr.Port)
+				if t.punchFunc != nil {
+					if punchType, data, ok := ParsePunchPackage(buf[:cnt]); ok {
+						t.punchFunc(udpAddr, punchType, data)
+						continue
+					}
+				}
+
+				addrString := udpAddr.String()
 				if v, ok := udpRemoteID[addrString]; ok {
 					remoteNo = v
 				} else {
@@ -738,3 +943,27 @@ func (t *Tunnel) syncUdp(conn interface{}, udpConn *net.UDPConn, readFunc, write
 	plQuit()
 
 }
+
+// AddrPort port of tcp or udp address, 0 if unknown
+func AddrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return splitPort(addr.String())
+}
+
+// splitPort port of host:port address, IPv6 host in brackets, 0 if invalid
+func splitPort(hostport string) int {
+	_, sport, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return 0
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return int(port)
+}
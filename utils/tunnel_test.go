@@ -3,6 +3,7 @@ package utils
 import (
 	"math/rand"
 	"net"
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
@@ -12,6 +13,15 @@ import (
 )
 
 func TestQuicTunnel(t *testing.T) {
+	testQuicTunnel(t, "0.0.0.0", "localhost")
+}
+
+func TestQuicTunnelIPv6(t *testing.T) {
+	testQuicTunnel(t, "::1", "::1")
+}
+
+// testQuicTunnel quic tunnel listening on listenHost and dialing dialHost
+func testQuicTunnel(t *testing.T, listenHost, dialHost string) {
 
 	logrus.SetLevel(logrus.DebugLevel)
 
@@ -19,8 +29,8 @@ func TestQuicTunnel(t *testing.T) {
 	t.Log("Setup quic tunnel 0")
 	tunnel0, err := NewTunnel(&TunnelConfig{
 		Type:     ListenQuicListenUdp,
-		Address0: "0.0.0.0:0",
-		Address1: "0.0.0.0:0",
+		Address0: net.JoinHostPort(listenHost, "0"),
+		Address1: net.JoinHostPort(listenHost, "0"),
 	})
 	if err != nil {
 		t.Fatal("New quic tunnel 0 error: ", err)
@@ -32,7 +42,7 @@ func TestQuicTunnel(t *testing.T) {
 
 	// udpConn
 	t.Log("Setup to quic tunnel udpConn")
-	udpAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(listenHost, "0"))
 	if err != nil {
 		t.Fatal("ResolveUDPAddr error: ", err)
 	}
@@ -48,8 +58,8 @@ func TestQuicTunnel(t *testing.T) {
 	t.Log("Setup quic tunnel 1")
 	tunnel1, err := NewTunnel(&TunnelConfig{
 		Type:     DialQuicDialUdp,
-		Address0: "localhost:" + strconv.Itoa(port00),
-		Address1: "localhost:" + strconv.Itoa(int(udpPort64)),
+		Address0: net.JoinHostPort(dialHost, strconv.Itoa(port00)),
+		Address1: net.JoinHostPort(dialHost, strconv.Itoa(int(udpPort64))),
 	})
 	if err != nil {
 		t.Fatal("New quic tunnel 1 error: ", err)
@@ -58,7 +68,7 @@ func TestQuicTunnel(t *testing.T) {
 
 	go tunnel1.Serve(nil, nil, nil, nil)
 
-	testTunnel(t, udpConn, port01)
+	testTunnel(t, udpConn, dialHost, port01)
 
 }
 
@@ -109,12 +119,67 @@ func TestTcpTunnel(t *testing.T) {
 
 	go tunnel1.Serve(nil, nil, nil, nil)
 
-	testTunnel(t, udpConn, port01)
+	testTunnel(t, udpConn, "localhost", port01)
+
+}
+
+func TestTunnelClose(t *testing.T) {
+
+	goroutines := runtime.NumGoroutine()
 
+	tunnel0, err := NewTunnel(&TunnelConfig{
+		Type:     ListenTcpListenUdp,
+		Address0: "127.0.0.1:0",
+		Address1: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal("New tcp tunnel 0 error: ", err)
+	}
+	port00, port01 := tunnel0.Ports()
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("ListenUDP error: ", err)
+	}
+	defer udpConn.Close()
+
+	// udp virtual clients of connected udp run in tunnel1
+	tunnel1, err := NewTunnel(&TunnelConfig{
+		Type:     DialTcpDialUdp,
+		Address0: "127.0.0.1:" + strconv.Itoa(port00),
+		Address1: udpConn.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal("New tcp tunnel 1 error: ", err)
+	}
+
+	served := make(chan int, 2)
+	go func() {
+		_ = tunnel0.Serve(nil, nil, nil, nil)
+		served <- 1
+	}()
+	go func() {
+		_ = tunnel1.Serve(nil, nil, nil, nil)
+		served <- 1
+	}()
+
+	testTunnel(t, udpConn, "127.0.0.1", port01)
+
+	tunnel0.Close()
+	tunnel1.Close()
+	<-served
+	<-served
+
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 20 {
+			t.Fatal("Goroutines leaked after tunnel closed: ", runtime.NumGoroutine(), " > ", goroutines)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
 }
 
 // testTunnel goroutine0 <--> udpConn <--> tunnel1 <--> tunnel0 <--> goroutine1
-func testTunnel(t *testing.T, udpConn *net.UDPConn, port01 int) {
+func testTunnel(t *testing.T, udpConn *net.UDPConn, host string, port01 int) {
 
 	// test data
 	var wg sync.WaitGroup
@@ -172,7 +237,7 @@ func testTunnel(t *testing.T, udpConn *net.UDPConn, port01 int) {
 		time.Sleep(time.Millisecond * 100)
 		buf := make([]byte, TransBufSize)
 
-		udpAddr, err := net.ResolveUDPAddr("udp", "localhost:"+strconv.Itoa(port01))
+		udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port01)))
 		if err != nil {
 			t.Error("Resolve tunnel0 addr error: ", err)
 		} else {